@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// chartSource describes where the deployment chart is loaded from
+type chartSource struct {
+	// ref is a local path, an oci:// reference, the URL of a chart archive
+	// or, when name is set, the URL of a helm repository
+	ref      string
+	name     string
+	version  string
+	username string
+	password string
+	cacheDir string
+}
+
+// chartSourceFromFlags returns the chart source configured by the chart flags
+func chartSourceFromFlags() chartSource {
+	return chartSource{
+		ref:      viper.GetString("chart-path"),
+		name:     viper.GetString("chart-name"),
+		version:  viper.GetString("chart-version"),
+		username: viper.GetString("chart-username"),
+		password: viper.GetString("chart-password"),
+		cacheDir: viper.GetString("chart-cache-dir"),
+	}
+}
+
+// isRemote reports whether the chart has to be downloaded before loading
+func (c chartSource) isRemote() bool {
+	return c.name != "" || registry.IsOCI(c.ref) || strings.HasPrefix(c.ref, "https://") || strings.HasPrefix(c.ref, "http://")
+}
+
+// locate returns the local path of the chart, downloading remote charts into
+// the cache directory first. Registry logins are written to a credentials
+// file private to this call and removed once the chart is located, so the
+// chart password is never persisted.
+func (c chartSource) locate() (string, error) {
+	if !c.isRemote() {
+		return c.ref, nil
+	}
+
+	cacheDir := c.cacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "loadbalanceroperator")
+	}
+
+	settings := cli.New()
+	settings.RepositoryCache = filepath.Join(cacheDir, "repository")
+	settings.RepositoryConfig = filepath.Join(cacheDir, "repositories.yaml")
+
+	credsDir, err := os.MkdirTemp("", "loadbalanceroperator-registry")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(credsDir)
+
+	settings.RegistryConfig = filepath.Join(credsDir, "config.json")
+
+	registryClient, err := registry.NewClient(
+		registry.ClientOptWriter(io.Discard),
+		registry.ClientOptCredentialsFile(settings.RegistryConfig),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if registry.IsOCI(c.ref) && c.username != "" {
+		u, err := url.Parse(c.ref)
+		if err != nil {
+			return "", err
+		}
+
+		if err := registryClient.Login(u.Host, registry.LoginOptBasicAuth(c.username, c.password)); err != nil {
+			return "", err
+		}
+	}
+
+	// the install action wires the registry client into its chart options
+	locator := action.NewInstall(&action.Configuration{RegistryClient: registryClient})
+	locator.Version = c.version
+	locator.Username = c.username
+	locator.Password = c.password
+
+	name := c.ref
+	if c.name != "" {
+		locator.RepoURL = c.ref
+		name = c.name
+	}
+
+	return locator.LocateChart(name, settings)
+}
+
+// load locates the chart and loads it
+func (c chartSource) load() (*chart.Chart, error) {
+	chartPath, err := c.locate()
+	if err != nil {
+		return nil, err
+	}
+
+	return loadHelmChart(chartPath)
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func TestChartSourceLoad(t *testing.T) {
+	type testCase struct {
+		name        string
+		source      func(repoURL string) chartSource
+		expectError bool
+	}
+
+	testDir, err := os.MkdirTemp("", "chart-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	repoDir := filepath.Join(testDir, "repo")
+	if err := os.Mkdir(repoDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	chartPath, err := utils.CreateTestChart(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileServer := http.FileServer(http.Dir(repoDir))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "lbo" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	index, err := repo.IndexDirectory(repoDir, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := index.WriteFile(filepath.Join(repoDir, "index.yaml"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name: "local path",
+			source: func(string) chartSource {
+				return chartSource{ref: chartPath}
+			},
+		},
+		{
+			name: "helm repository",
+			source: func(repoURL string) chartSource {
+				return chartSource{
+					ref:      repoURL,
+					name:     ch.Metadata.Name,
+					version:  ch.Metadata.Version,
+					username: "lbo",
+					password: "secret",
+					cacheDir: filepath.Join(testDir, "cache"),
+				}
+			},
+		},
+		{
+			name: "helm repository version constraint",
+			source: func(repoURL string) chartSource {
+				return chartSource{
+					ref:      repoURL,
+					name:     ch.Metadata.Name,
+					version:  ">= 0.0.0-0",
+					username: "lbo",
+					password: "secret",
+					cacheDir: filepath.Join(testDir, "cache"),
+				}
+			},
+		},
+		{
+			name: "chart archive url",
+			source: func(repoURL string) chartSource {
+				return chartSource{
+					ref:      repoURL + "/" + filepath.Base(chartPath),
+					username: "lbo",
+					password: "secret",
+					cacheDir: filepath.Join(testDir, "cache"),
+				}
+			},
+		},
+		{
+			name: "invalid credentials",
+			source: func(repoURL string) chartSource {
+				return chartSource{
+					ref:      repoURL,
+					name:     ch.Metadata.Name,
+					username: "lbo",
+					password: "wrong",
+					cacheDir: filepath.Join(testDir, "cache"),
+				}
+			},
+			expectError: true,
+		},
+		{
+			name: "missing version",
+			source: func(repoURL string) chartSource {
+				return chartSource{
+					ref:      repoURL,
+					name:     ch.Metadata.Name,
+					version:  "99.0.0",
+					username: "lbo",
+					password: "secret",
+					cacheDir: filepath.Join(testDir, "cache"),
+				}
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			loaded, err := tcase.source(srv.URL).load()
+
+			if tcase.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+
+			if assert.NotNil(t, loaded) {
+				assert.Equal(t, ch.Metadata.Name, loaded.Metadata.Name)
+				assert.Equal(t, ch.Metadata.Version, loaded.Metadata.Version)
+			}
+		})
+	}
+
+	// the chart password is never written to the cache
+	err = filepath.Walk(filepath.Join(testDir, "cache"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		assert.NotContains(t, string(data), "secret", path)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestChartSourceIsRemote(t *testing.T) {
+	assert.False(t, chartSource{ref: "/chart.tgz"}.isRemote())
+	assert.True(t, chartSource{ref: "oci://ghcr.io/infratographer/charts/haproxy"}.isRemote())
+	assert.True(t, chartSource{ref: "https://charts.example.com/haproxy-1.0.0.tgz"}.isRemote())
+	assert.True(t, chartSource{ref: "https://charts.example.com", name: "haproxy"}.isRemote())
+}
@@ -11,4 +11,25 @@ var (
 	ErrNATSStreamName = errors.New("nats stream name is required and cannot be empty")
 	// ErrChartPath is returned when a Helm chart path is missing
 	ErrChartPath = errors.New("chart path is required and cannot be empty")
+	// ErrNoLocations is returned when a locations file does not map any
+	// locations to clusters
+	ErrNoLocations = errors.New("no locations configured")
+	// ErrInvalidLocation is returned when a locations file contains a
+	// location that is not a UUID
+	ErrInvalidLocation = errors.New("invalid location")
+	// ErrUnknownCluster is returned when a location refers to a cluster that
+	// has not been defined
+	ErrUnknownCluster = errors.New("unknown cluster")
+	// ErrInvalidSecretRef is returned when a cluster's kubeconfig Secret
+	// cannot be used
+	ErrInvalidSecretRef = errors.New("invalid kubeconfig secret")
+	// ErrInvalidBounds is returned when a resource bound is not a quantity or
+	// the minimum is larger than the maximum
+	ErrInvalidBounds = errors.New("invalid resource bounds")
+	// ErrQueryAllowedURLs is returned when fetching loadbalancer definitions
+	// is enabled without any valid allowed urls
+	ErrQueryAllowedURLs = errors.New("query-url-allowed-urls must list http or https base urls when query-url-enabled is set")
+	// ErrEventFormat is returned when the event format is not one the
+	// operator understands
+	ErrEventFormat = errors.New("event format must be auto, pubsubx or cloudevents")
 )
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"go.infratographer.com/loadbalanceroperator/internal/srv"
+)
+
+const defaultSecretKey = "kubeconfig"
+
+// clusterTarget describes how to reach a cluster loadbalancers are deployed
+// to. A target without a kubeconfig or secret is the cluster the operator
+// runs in.
+type clusterTarget struct {
+	// Kubeconfig is the path of the kubeconfig for the cluster, relative
+	// paths are resolved from the directory of the locations file
+	Kubeconfig string `mapstructure:"kubeconfig"`
+	// Secret is the namespace/name of a Secret in the operator's cluster
+	// holding the kubeconfig for the cluster
+	Secret string `mapstructure:"secret"`
+	// SecretKey is the key of the kubeconfig in Secret
+	SecretKey string `mapstructure:"secretKey"`
+	// Context is the kubeconfig context to use, the current context when
+	// empty
+	Context string `mapstructure:"context"`
+}
+
+// loadLocations reads a file of named clusters and the location IDs deployed
+// to each. Locations either name a cluster or describe one inline, inline
+// clusters being named after the first location using them. The returned
+// locations are keyed by lowercase location ID.
+func loadLocations(ctx context.Context, path string, home *rest.Config, homeClient kubernetes.Interface) (*srv.ClusterRegistry, map[string]*srv.Cluster, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, nil, err
+	}
+
+	targets := map[string]clusterTarget{}
+	if err := v.UnmarshalKey("clusters", &targets); err != nil {
+		return nil, nil, err
+	}
+
+	locationTargets := map[string]interface{}{}
+	if err := v.UnmarshalKey("locations", &locationTargets); err != nil {
+		return nil, nil, err
+	}
+
+	if len(locationTargets) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoLocations, path)
+	}
+
+	loader := &clusterLoader{
+		ctx:        ctx,
+		dir:        filepath.Dir(path),
+		home:       home,
+		homeClient: homeClient,
+		registry:   srv.NewClusterRegistry(),
+		inline:     map[clusterTarget]*srv.Cluster{},
+	}
+
+	for name, target := range targets {
+		if _, err := loader.add(name, target); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ids := make([]string, 0, len(locationTargets))
+	for id := range locationTargets {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	locations := map[string]*srv.Cluster{}
+
+	for _, id := range ids {
+		location, err := uuid.Parse(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w %q: %s", ErrInvalidLocation, id, err)
+		}
+
+		cluster, err := loader.location(v, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		locations[strings.ToLower(location.String())] = cluster
+	}
+
+	return loader.registry, locations, nil
+}
+
+// clusterLoader builds the clusters of a locations file
+type clusterLoader struct {
+	ctx        context.Context
+	dir        string
+	home       *rest.Config
+	homeClient kubernetes.Interface
+	registry   *srv.ClusterRegistry
+	inline     map[clusterTarget]*srv.Cluster
+}
+
+// location returns the cluster for a location, given either as the name of
+// a cluster or as an inline target
+func (l *clusterLoader) location(v *viper.Viper, id string) (*srv.Cluster, error) {
+	key := "locations." + id
+
+	if name, ok := v.Get(key).(string); ok {
+		// viper lowercases the cluster names it reads
+		cluster, ok := l.registry.Get(strings.ToLower(name))
+		if !ok {
+			return nil, fmt.Errorf("%w %q for location %s", ErrUnknownCluster, name, id)
+		}
+
+		return cluster, nil
+	}
+
+	target := clusterTarget{}
+	if err := v.UnmarshalKey(key, &target); err != nil {
+		return nil, fmt.Errorf("%w %q: %s", ErrInvalidLocation, id, err)
+	}
+
+	if cluster, ok := l.inline[target]; ok {
+		return cluster, nil
+	}
+
+	cluster, err := l.add(id, target)
+	if err != nil {
+		return nil, err
+	}
+
+	l.inline[target] = cluster
+
+	return cluster, nil
+}
+
+// add registers the cluster described by target as name
+func (l *clusterLoader) add(name string, target clusterTarget) (*srv.Cluster, error) {
+	config, err := l.config(target)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load cluster %s: %w", name, err)
+	}
+
+	cluster := srv.NewCluster(name, config)
+	l.registry.Add(cluster)
+
+	return cluster, nil
+}
+
+// config returns the rest config for a target
+func (l *clusterLoader) config(target clusterTarget) (*rest.Config, error) {
+	switch {
+	case target.Secret != "":
+		return l.secretConfig(target)
+	case target.Kubeconfig != "":
+		path := target.Kubeconfig
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(l.dir, path)
+		}
+
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+			&clientcmd.ConfigOverrides{CurrentContext: target.Context},
+		).ClientConfig()
+	default:
+		return l.home, nil
+	}
+}
+
+// secretConfig returns the rest config held by the kubeconfig Secret of a
+// target
+func (l *clusterLoader) secretConfig(target clusterTarget) (*rest.Config, error) {
+	namespace, name, ok := strings.Cut(target.Secret, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSecretRef, target.Secret)
+	}
+
+	key := target.SecretKey
+	if key == "" {
+		key = defaultSecretKey
+	}
+
+	secret, err := l.homeClient.CoreV1().Secrets(namespace).Get(l.ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no key %q", ErrInvalidSecretRef, target.Secret, key)
+	}
+
+	kubeconfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientcmd.NewNonInteractiveClientConfig(*kubeconfig, target.Context, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+}
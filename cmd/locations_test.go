@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: edge-1
+clusters:
+  - name: edge-1
+    cluster:
+      server: https://edge-1.example.com
+  - name: edge-2
+    cluster:
+      server: https://edge-2.example.com
+contexts:
+  - name: edge-1
+    context:
+      cluster: edge-1
+      user: operator
+  - name: edge-2
+    context:
+      cluster: edge-2
+      user: operator
+users:
+  - name: operator
+    user:
+      token: secret
+`
+
+func TestLoadLocations(t *testing.T) {
+	type testCase struct {
+		name          string
+		config        string
+		expectError   error
+		expectServers map[string]string
+		expectNames   map[string]string
+	}
+
+	testDir, err := os.MkdirTemp("", "locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	if err := os.WriteFile(filepath.Join(testDir, "kubeconfig"), []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	home := &rest.Config{Host: "https://home.example.com"}
+	homeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "edge-3", Namespace: "lbo-system"},
+		Data:       map[string][]byte{"kubeconfig": []byte(testKubeconfig)},
+	})
+
+	testCases := []testCase{
+		{
+			name: "locations mapped to contexts",
+			config: `locations:
+  0A6F1C1E-6A55-4E5B-8F8C-1F2E3D4C5B6A:
+    kubeconfig: kubeconfig
+  7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43:
+    kubeconfig: kubeconfig
+    context: edge-2
+`,
+			expectServers: map[string]string{
+				"0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a": "https://edge-1.example.com",
+				"7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43": "https://edge-2.example.com",
+			},
+		},
+		{
+			name: "locations mapped to named clusters",
+			config: `clusters:
+  home: {}
+  Edge-2:
+    kubeconfig: kubeconfig
+    context: edge-2
+  edge-3:
+    secret: lbo-system/edge-3
+    context: edge-1
+locations:
+  0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a: home
+  7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43: Edge-2
+  2d9c4f5a-7f4f-4f5a-9a43-2c7a6f0f1f43: edge-3
+`,
+			expectServers: map[string]string{
+				"0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a": "https://home.example.com",
+				"7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43": "https://edge-2.example.com",
+				"2d9c4f5a-7f4f-4f5a-9a43-2c7a6f0f1f43": "https://edge-1.example.com",
+			},
+			expectNames: map[string]string{
+				"0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a": "home",
+				"7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43": "edge-2",
+				"2d9c4f5a-7f4f-4f5a-9a43-2c7a6f0f1f43": "edge-3",
+			},
+		},
+		{
+			name: "unknown cluster",
+			config: `locations:
+  0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a: edge-9
+`,
+			expectError: ErrUnknownCluster,
+		},
+		{
+			name: "secret without the kubeconfig key",
+			config: `clusters:
+  edge-3:
+    secret: lbo-system/edge-3
+    secretKey: value
+locations:
+  0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a: edge-3
+`,
+			expectError: ErrInvalidSecretRef,
+		},
+		{
+			name:        "no locations",
+			config:      "locations: {}\n",
+			expectError: ErrNoLocations,
+		},
+		{
+			name: "location is not a uuid",
+			config: `locations:
+  edge-1:
+    kubeconfig: kubeconfig
+`,
+			expectError: ErrInvalidLocation,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			path := filepath.Join(testDir, "locations.yaml")
+			if err := os.WriteFile(path, []byte(tcase.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, locations, err := loadLocations(context.Background(), path, home, homeClient)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Len(t, locations, len(tcase.expectServers))
+
+			for id, server := range tcase.expectServers {
+				if assert.Contains(t, locations, id) {
+					assert.Equal(t, server, locations[id].Config.Host)
+				}
+			}
+
+			for id, name := range tcase.expectNames {
+				assert.Equal(t, name, locations[id].Name)
+			}
+		})
+	}
+}
+
+func TestLoadLocationsSharedCluster(t *testing.T) {
+	testDir, err := os.MkdirTemp("", "locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	if err := os.WriteFile(filepath.Join(testDir, "kubeconfig"), []byte(testKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(testDir, "locations.yaml")
+	config := `locations:
+  0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a:
+    kubeconfig: kubeconfig
+  7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43:
+    kubeconfig: kubeconfig
+`
+
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, locations, err := loadLocations(context.Background(), path, &rest.Config{}, fake.NewSimpleClientset())
+	assert.Nil(t, err)
+
+	// locations on the same cluster share it so the cluster is only visited
+	// once when reconciling
+	assert.Same(t, locations["0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a"], locations["7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43"])
+	assert.Len(t, registry.List(), 1)
+	assert.Equal(t, "0a6f1c1e-6a55-4e5b-8f8c-1f2e3d4c5b6a", locations["7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43"].Name)
+}
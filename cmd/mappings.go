@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+
+	"go.infratographer.com/loadbalanceroperator/internal/srv"
+)
+
+// loadValueMappings reads a file of mappings from event data to chart values
+// and the chart values keys they are allowed to set
+func loadValueMappings(path string) (*srv.ValueMapper, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	mappings := []srv.ValueMapping{}
+	if err := v.UnmarshalKey("mappings", &mappings); err != nil {
+		return nil, err
+	}
+
+	return srv.NewValueMapper(mappings, v.GetStringSlice("allowedKeys"))
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.infratographer.com/loadbalanceroperator/internal/srv"
+)
+
+func TestLoadValueMappings(t *testing.T) {
+	type testCase struct {
+		name        string
+		config      string
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name: "allowed mappings",
+			config: `allowedKeys:
+  - replicaCount
+  - service.annotations
+mappings:
+  - path: "{.replicas}"
+    key: replicaCount
+    type: int
+    default: 2
+  - path: .annotations
+    key: service.annotations
+`,
+		},
+		{
+			name: "key not allowed",
+			config: `allowedKeys:
+  - replicaCount
+mappings:
+  - path: "{.image}"
+    key: image.repository
+`,
+			expectError: srv.ErrValueKeyNotAllowed,
+		},
+		{
+			name: "invalid default",
+			config: `allowedKeys:
+  - replicaCount
+mappings:
+  - path: "{.replicas}"
+    key: replicaCount
+    type: int
+    default: many
+`,
+			expectError: srv.ErrInvalidValueMapping,
+		},
+	}
+
+	testDir, err := os.MkdirTemp("", "mappings")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			path := filepath.Join(testDir, "mappings.yaml")
+			if err := os.WriteFile(path, []byte(tcase.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			mapper, err := loadValueMappings(path)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.NotNil(t, mapper)
+		})
+	}
+
+	_, err = loadValueMappings(filepath.Join(testDir, "missing.yaml"))
+	assert.NotNil(t, err)
+}
@@ -18,11 +18,16 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -48,12 +53,23 @@ func process(ctx context.Context) error {
 		return err
 	}
 
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		logger.Fatalw("failed to initialize tracing", "error", err)
+	}
+
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Errorw("failed to flush traces", "error", err)
+		}
+	}()
+
 	client, err := newKubeAuth(viper.GetString("kube-config-path"))
 	if err != nil {
 		logger.Fatalw("failed to create Kubernetes client", "error", err)
 	}
 
-	js, err := newJetstreamConnection()
+	nc, js, err := newJetstreamConnection()
 	if err != nil {
 		logger.Fatalw("failed to create NATS jetstream connection", "error", err)
 	}
@@ -62,23 +78,122 @@ func process(ctx context.Context) error {
 		return err
 	}
 
-	chart, err := loadHelmChart(viper.GetString("chart-path"))
+	var (
+		clusters  *srv.ClusterRegistry
+		locations map[string]*srv.Cluster
+	)
+
+	if path := viper.GetString("locations-config"); path != "" {
+		homeClient, err := kubernetes.NewForConfig(client)
+		if err != nil {
+			logger.Fatalw("failed to create Kubernetes client", "error", err)
+		}
+
+		clusters, locations, err = loadLocations(ctx, path, client, homeClient)
+		if err != nil {
+			logger.Fatalw("failed to load locations", "error", err)
+		}
+	}
+
+	var mapper *srv.ValueMapper
+
+	if path := viper.GetString("value-mappings-config"); path != "" {
+		mapper, err = loadValueMappings(path)
+		if err != nil {
+			logger.Fatalw("failed to load value mappings", "error", err)
+		}
+	}
+
+	queryAllowedURLs, err := queryAllowedURLs()
 	if err != nil {
-		logger.Fatalw("failed to load helm chart from provided path", "error", err)
+		return err
+	}
+
+	cpuBounds, err := quantityBounds("validation.min-cpu", "validation.max-cpu")
+	if err != nil {
+		return err
+	}
+
+	memoryBounds, err := quantityBounds("validation.min-memory", "validation.max-memory")
+	if err != nil {
+		return err
+	}
+
+	chartSrc := chartSourceFromFlags()
+
+	chart, err := chartSrc.load()
+	if err != nil {
+		logger.Fatalw("failed to load helm chart from provided source", "error", err)
+	}
+
+	// only local charts can be watched and reloaded
+	chartPath := ""
+	if !chartSrc.isRemote() {
+		chartPath = chartSrc.ref
+	}
+
+	dlqSubject := viper.GetString("nats.dead-letter-subject")
+	if dlqSubject == "" {
+		dlqSubject = viper.GetString("nats.subject-prefix") + ".dlq"
+	}
+
+	statusSubject := viper.GetString("nats.status-subject")
+	if statusSubject == "" {
+		statusSubject = viper.GetString("nats.subject-prefix") + ".status"
 	}
 
 	cx, cancel := context.WithCancel(ctx)
 
 	server := &srv.Server{
-		Chart:           chart,
-		Context:         cx,
-		Debug:           viper.GetBool("logging.debug"),
-		JetstreamClient: js,
-		KubeClient:      client,
-		Logger:          logger,
-		Prefix:          viper.GetString("nats.subject-prefix"),
-		StreamName:      viper.GetString("nats.stream-name"),
-		ValuesPath:      viper.GetString("chart-values-path"),
+		Chart:                 chart,
+		ChartPath:             chartPath,
+		Context:               cx,
+		Debug:                 viper.GetBool("logging.debug"),
+		JetstreamClient:       js,
+		NATSClient:            nc,
+		KubeClient:            client,
+		Logger:                logger,
+		Prefix:                viper.GetString("nats.subject-prefix"),
+		StreamName:            viper.GetString("nats.stream-name"),
+		ValuesPath:            viper.GetString("chart-values-path"),
+		MaxDeliver:            viper.GetInt("nats.max-deliver"),
+		NakDelay:              viper.GetDuration("nats.nak-delay"),
+		DeadLetterSubject:     dlqSubject,
+		StatusSubject:         statusSubject,
+		DedupBucket:           viper.GetString("nats.dedup-bucket"),
+		DedupTTL:              viper.GetDuration("nats.dedup-ttl"),
+		Workers:               viper.GetInt("workers"),
+		ConsumerName:          viper.GetString("nats.consumer-name"),
+		FetchBatch:            viper.GetInt("nats.fetch-batch"),
+		FetchTimeout:          viper.GetDuration("nats.fetch-timeout"),
+		AckWait:               viper.GetDuration("nats.ack-wait"),
+		MaxAckPending:         viper.GetInt("nats.max-ack-pending"),
+		LeaderElection:        viper.GetBool("leader-election.enabled"),
+		LeaseName:             viper.GetString("leader-election.lease-name"),
+		LeaseNamespace:        viper.GetString("leader-election.namespace"),
+		LeaseIdentity:         viper.GetString("leader-election.identity"),
+		LeaseDuration:         viper.GetDuration("leader-election.lease-duration"),
+		RenewDeadline:         viper.GetDuration("leader-election.renew-deadline"),
+		RetryPeriod:           viper.GetDuration("leader-election.retry-period"),
+		UseCustomResources:    viper.GetBool("use-custom-resources"),
+		Clusters:              clusters,
+		Locations:             locations,
+		ClusterHealthInterval: viper.GetDuration("cluster-health-interval"),
+		QueryEnabled:          viper.GetBool("query-url.enabled"),
+		QueryAllowedURLs:      queryAllowedURLs,
+		QueryToken:            viper.GetString("query-url.token"),
+		QueryTokenFile:        viper.GetString("query-url.token-file"),
+		QueryTimeout:          viper.GetDuration("query-url.timeout"),
+		QueryRetries:          viper.GetInt("query-url.retries"),
+		QueryValuesKey:        viper.GetString("query-url.values-key"),
+		ValueMapper:           mapper,
+		EventFormat:           viper.GetString("event-format"),
+		EventValuesKey:        viper.GetString("event-values-key"),
+		CPUBounds:             cpuBounds,
+		MemoryBounds:          memoryBounds,
+		ReconcileInterval:     viper.GetDuration("reconcile-interval"),
+		UpgradeOnReload:       viper.GetBool("upgrade-on-reload"),
+		ReloadUpgrade:         fleetUpgradeOptions(),
 	}
 
 	if err := server.Run(cx); err != nil {
@@ -86,17 +201,25 @@ func process(ctx context.Context) error {
 	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	recvSig := <-sigCh
 	signal.Stop(sigCh)
+	logger.Infow("exiting. Performing necessary cleanup", "signal", recvSig.String())
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+	defer shutdownCancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Errorw("failed to shutdown cleanly", "error", err)
+	}
+
 	cancel()
-	logger.Infof("exiting. Performing necessary cleanup", recvSig)
 
 	return nil
 }
 
-func newJetstreamConnection() (nats.JetStreamContext, error) {
+func newJetstreamConnection() (*nats.Conn, nats.JetStreamContext, error) {
 	opts := []nats.Option{}
 
 	if viper.GetBool("development") {
@@ -109,15 +232,15 @@ func newJetstreamConnection() (nats.JetStreamContext, error) {
 
 	nc, err := nats.Connect(viper.GetString("nats.url"), opts...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	js, err := nc.JetStream()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return js, nil
+	return nc, js, nil
 }
 
 func newKubeAuth(path string) (*rest.Config, error) {
@@ -147,9 +270,62 @@ func validateFlags() error {
 		return ErrChartPath
 	}
 
+	switch viper.GetString("event-format") {
+	case "", srv.EventFormatAuto, srv.EventFormatPubsubx, srv.EventFormatCloudEvents:
+	default:
+		return fmt.Errorf("%w: %q", ErrEventFormat, viper.GetString("event-format"))
+	}
+
 	return nil
 }
 
+// queryAllowedURLs returns the base urls loadbalancer definitions may be
+// fetched from, at least one being required when fetching is enabled
+func queryAllowedURLs() ([]*url.URL, error) {
+	allowed := []*url.URL{}
+
+	for _, value := range viper.GetStringSlice("query-url.allowed-urls") {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return nil, fmt.Errorf("%w: %q", ErrQueryAllowedURLs, value)
+		}
+
+		allowed = append(allowed, u)
+	}
+
+	if viper.GetBool("query-url.enabled") && len(allowed) == 0 {
+		return nil, ErrQueryAllowedURLs
+	}
+
+	return allowed, nil
+}
+
+// quantityBounds returns the resource bounds set by the minKey and maxKey
+// settings, either being unbounded when empty
+func quantityBounds(minKey string, maxKey string) (srv.QuantityBounds, error) {
+	bounds := srv.QuantityBounds{}
+
+	for key, bound := range map[string]**resource.Quantity{minKey: &bounds.Min, maxKey: &bounds.Max} {
+		value := viper.GetString(key)
+		if value == "" {
+			continue
+		}
+
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return bounds, fmt.Errorf("%w: %s %q: %s", ErrInvalidBounds, key, value, err)
+		}
+
+		*bound = &quantity
+	}
+
+	if bounds.Min != nil && bounds.Max != nil && bounds.Min.Cmp(*bounds.Max) > 0 {
+		return bounds, fmt.Errorf("%w: %s %s is larger than %s %s", ErrInvalidBounds, minKey, bounds.Min, maxKey, bounds.Max)
+	}
+
+	return bounds, nil
+}
+
 func loadHelmChart(chartPath string) (*chart.Chart, error) {
 	chart, err := loader.Load(chartPath)
 	if err != nil {
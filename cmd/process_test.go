@@ -93,6 +93,12 @@ func TestValidateFlags(t *testing.T) {
 			errors:      ErrNATSSubjectPrefix,
 			expectError: true,
 		},
+		{
+			name:        "invalid event-format",
+			flagSet:     []flagSet{{"chart-path", "chart"}, {"nats.subject-prefix", "stream"}, {"event-format", "avro"}},
+			errors:      ErrEventFormat,
+			expectError: true,
+		},
 	}
 
 	for _, tcase := range testCases {
@@ -113,3 +119,137 @@ func TestValidateFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestQuantityBounds(t *testing.T) {
+	type testCase struct {
+		name        string
+		min         string
+		max         string
+		expectMin   string
+		expectMax   string
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name: "unbounded",
+		},
+		{
+			name:      "bounded",
+			min:       "100m",
+			max:       "4",
+			expectMin: "100m",
+			expectMax: "4",
+		},
+		{
+			name:      "minimum only",
+			min:       "64Mi",
+			expectMin: "64Mi",
+		},
+		{
+			name:        "invalid quantity",
+			max:         "lots",
+			expectError: ErrInvalidBounds,
+		},
+		{
+			name:        "minimum above maximum",
+			min:         "2Gi",
+			max:         "1Gi",
+			expectError: ErrInvalidBounds,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			viper.Set("validation.min-cpu", tcase.min)
+			viper.Set("validation.max-cpu", tcase.max)
+
+			defer viper.Reset()
+
+			bounds, err := quantityBounds("validation.min-cpu", "validation.max-cpu")
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			if tcase.expectMin == "" {
+				assert.Nil(t, bounds.Min)
+			} else {
+				assert.Equal(t, tcase.expectMin, bounds.Min.String())
+			}
+
+			if tcase.expectMax == "" {
+				assert.Nil(t, bounds.Max)
+			} else {
+				assert.Equal(t, tcase.expectMax, bounds.Max.String())
+			}
+		})
+	}
+}
+
+func TestQueryAllowedURLs(t *testing.T) {
+	type testCase struct {
+		name        string
+		enabled     bool
+		urls        []string
+		expected    []string
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name:     "disabled",
+			expected: []string{},
+		},
+		{
+			name:     "allowed urls",
+			enabled:  true,
+			urls:     []string{"https://lbapi.example.com/v1/", "http://lbapi.internal:8080"},
+			expected: []string{"https://lbapi.example.com/v1/", "http://lbapi.internal:8080"},
+		},
+		{
+			name:        "enabled without allowed urls",
+			enabled:     true,
+			expectError: ErrQueryAllowedURLs,
+		},
+		{
+			name:        "relative url",
+			enabled:     true,
+			urls:        []string{"/v1"},
+			expectError: ErrQueryAllowedURLs,
+		},
+		{
+			name:        "unsupported scheme",
+			urls:        []string{"file:///etc"},
+			expectError: ErrQueryAllowedURLs,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			viper.Set("query-url.enabled", tcase.enabled)
+			viper.Set("query-url.allowed-urls", tcase.urls)
+
+			defer viper.Reset()
+
+			allowed, err := queryAllowedURLs()
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			urls := []string{}
+			for _, u := range allowed {
+				urls = append(urls, u.String())
+			}
+
+			assert.Equal(t, tcase.expected, urls)
+		})
+	}
+}
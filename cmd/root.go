@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -71,28 +72,185 @@ func init() {
 	rootCmd.PersistentFlags().String("nats-stream-name", "loadbalanceroperator", "prefix for NATS subjects")
 	viperBindFlag("nats.stream-name", rootCmd.PersistentFlags().Lookup("nats-stream-name"))
 
+	rootCmd.PersistentFlags().String("nats-consumer-name", "loadbalanceroperator", "name of the durable consumer messages are pulled from")
+	viperBindFlag("nats.consumer-name", rootCmd.PersistentFlags().Lookup("nats-consumer-name"))
+
+	rootCmd.PersistentFlags().Int("nats-fetch-batch", 10, "maximum number of messages pulled from the consumer at once")
+	viperBindFlag("nats.fetch-batch", rootCmd.PersistentFlags().Lookup("nats-fetch-batch"))
+
+	rootCmd.PersistentFlags().Duration("nats-fetch-timeout", 5*time.Second, "time to wait for messages when pulling from the consumer")
+	viperBindFlag("nats.fetch-timeout", rootCmd.PersistentFlags().Lookup("nats-fetch-timeout"))
+
+	rootCmd.PersistentFlags().Duration("nats-ack-wait", 30*time.Second, "time the consumer waits for an acknowledgement before redelivering a message")
+	viperBindFlag("nats.ack-wait", rootCmd.PersistentFlags().Lookup("nats-ack-wait"))
+
+	rootCmd.PersistentFlags().Int("nats-max-ack-pending", 100, "maximum number of messages awaiting acknowledgement across all replicas")
+	viperBindFlag("nats.max-ack-pending", rootCmd.PersistentFlags().Lookup("nats-max-ack-pending"))
+
+	rootCmd.PersistentFlags().Int("nats-max-deliver", 5, "maximum number of times a message is delivered before giving up")
+	viperBindFlag("nats.max-deliver", rootCmd.PersistentFlags().Lookup("nats-max-deliver"))
+
+	rootCmd.PersistentFlags().Duration("nats-nak-delay", 5*time.Second, "initial delay before redelivering a message that failed processing, doubled on each attempt")
+	viperBindFlag("nats.nak-delay", rootCmd.PersistentFlags().Lookup("nats-nak-delay"))
+
+	rootCmd.PersistentFlags().String("nats-dead-letter-subject", "", "subject failed events are republished to (default is <nats-subject-prefix>.dlq)")
+	viperBindFlag("nats.dead-letter-subject", rootCmd.PersistentFlags().Lookup("nats-dead-letter-subject"))
+
+	rootCmd.PersistentFlags().String("nats-status-subject", "", "subject prefix load balancer status events are published to (default is <nats-subject-prefix>.status)")
+	viperBindFlag("nats.status-subject", rootCmd.PersistentFlags().Lookup("nats-status-subject"))
+
+	rootCmd.PersistentFlags().String("nats-dedup-bucket", "", "jetstream key-value bucket applied events are recorded in to skip duplicate and out of order events, empty disables deduplication")
+	viperBindFlag("nats.dedup-bucket", rootCmd.PersistentFlags().Lookup("nats-dedup-bucket"))
+
+	rootCmd.PersistentFlags().Duration("nats-dedup-ttl", 24*time.Hour, "how long applied events are remembered when the dedup bucket is created")
+	viperBindFlag("nats.dedup-ttl", rootCmd.PersistentFlags().Lookup("nats-dedup-ttl"))
+
 	rootCmd.PersistentFlags().String("healthcheck-port", ":8080", "port to run healthcheck probe on")
 	viperBindFlag("healthcheck-port", rootCmd.PersistentFlags().Lookup("healthcheck-port"))
 
-	rootCmd.PersistentFlags().String("chart-path", "", "path that contains deployment chart")
+	rootCmd.PersistentFlags().Int("workers", 4, "number of load balancer events processed concurrently")
+	viperBindFlag("workers", rootCmd.PersistentFlags().Lookup("workers"))
+
+	rootCmd.PersistentFlags().Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight messages to finish processing when shutting down")
+	viperBindFlag("shutdown-timeout", rootCmd.PersistentFlags().Lookup("shutdown-timeout"))
+
+	rootCmd.PersistentFlags().Bool("leader-election", false, "only process messages while holding a kubernetes lease, allowing multiple replicas to run for high availability")
+	viperBindFlag("leader-election.enabled", rootCmd.PersistentFlags().Lookup("leader-election"))
+
+	rootCmd.PersistentFlags().String("leader-election-lease-name", "loadbalanceroperator", "name of the lease used for leader election")
+	viperBindFlag("leader-election.lease-name", rootCmd.PersistentFlags().Lookup("leader-election-lease-name"))
+
+	rootCmd.PersistentFlags().String("leader-election-namespace", "", "namespace the leader election lease is held in")
+	viperBindFlag("leader-election.namespace", rootCmd.PersistentFlags().Lookup("leader-election-namespace"))
+
+	rootCmd.PersistentFlags().String("leader-election-identity", "", "identity of this replica when holding the lease (default is the hostname)")
+	viperBindFlag("leader-election.identity", rootCmd.PersistentFlags().Lookup("leader-election-identity"))
+
+	rootCmd.PersistentFlags().Duration("leader-election-lease-duration", 15*time.Second, "time other replicas wait before taking over an expired lease")
+	viperBindFlag("leader-election.lease-duration", rootCmd.PersistentFlags().Lookup("leader-election-lease-duration"))
+
+	rootCmd.PersistentFlags().Duration("leader-election-renew-deadline", 10*time.Second, "time the leader retries renewing the lease before giving up leadership")
+	viperBindFlag("leader-election.renew-deadline", rootCmd.PersistentFlags().Lookup("leader-election-renew-deadline"))
+
+	rootCmd.PersistentFlags().Duration("leader-election-retry-period", 2*time.Second, "time between attempts to acquire or renew the lease")
+	viperBindFlag("leader-election.retry-period", rootCmd.PersistentFlags().Lookup("leader-election-retry-period"))
+
+	rootCmd.PersistentFlags().Bool("use-custom-resources", false, "record loadbalancers as LoadBalancer resources and deploy them from the resource, requires the LoadBalancer CRD")
+	viperBindFlag("use-custom-resources", rootCmd.PersistentFlags().Lookup("use-custom-resources"))
+
+	rootCmd.PersistentFlags().Duration("reconcile-interval", 10*time.Minute, "how often deployed loadbalancers are checked for drift and repaired, 0 disables the check")
+	viperBindFlag("reconcile-interval", rootCmd.PersistentFlags().Lookup("reconcile-interval"))
+
+	rootCmd.PersistentFlags().Bool("upgrade-on-reload", false, "upgrade deployed loadbalancers as soon as a change to the chart or values file is loaded")
+	viperBindFlag("upgrade-on-reload", rootCmd.PersistentFlags().Lookup("upgrade-on-reload"))
+
+	rootCmd.PersistentFlags().Int("fleet-upgrade-batch-size", 5, "number of releases upgraded at the same time by upgrade-fleet or upgrade-on-reload")
+	viperBindFlag("fleet-upgrade.batch-size", rootCmd.PersistentFlags().Lookup("fleet-upgrade-batch-size"))
+
+	rootCmd.PersistentFlags().Int("fleet-upgrade-max-failures", 0, "number of failed releases tolerated before an upgrade of all releases halts")
+	viperBindFlag("fleet-upgrade.max-failures", rootCmd.PersistentFlags().Lookup("fleet-upgrade-max-failures"))
+
+	rootCmd.PersistentFlags().Bool("fleet-upgrade-rollback", false, "roll failed releases back to their previous revision when an upgrade of all releases halts")
+	viperBindFlag("fleet-upgrade.rollback", rootCmd.PersistentFlags().Lookup("fleet-upgrade-rollback"))
+
+	rootCmd.PersistentFlags().Duration("fleet-upgrade-timeout", 5*time.Minute, "how long each release is given to become ready during an upgrade of all releases")
+	viperBindFlag("fleet-upgrade.timeout", rootCmd.PersistentFlags().Lookup("fleet-upgrade-timeout"))
+
+	rootCmd.PersistentFlags().String("chart-path", "", "path, oci:// reference or URL of the deployment chart, or the URL of a helm repository when chart-name is set")
 	viperBindFlag("chart-path", rootCmd.PersistentFlags().Lookup("chart-path"))
 
+	rootCmd.PersistentFlags().String("chart-name", "", "name of the deployment chart in the helm repository given by chart-path")
+	viperBindFlag("chart-name", rootCmd.PersistentFlags().Lookup("chart-name"))
+
+	rootCmd.PersistentFlags().String("chart-version", "", "version or semver constraint of a remote deployment chart (default is the latest version)")
+	viperBindFlag("chart-version", rootCmd.PersistentFlags().Lookup("chart-version"))
+
+	rootCmd.PersistentFlags().String("chart-username", "", "username for the registry or helm repository the deployment chart is pulled from")
+	viperBindFlag("chart-username", rootCmd.PersistentFlags().Lookup("chart-username"))
+
+	rootCmd.PersistentFlags().String("chart-password", "", "password for the registry or helm repository the deployment chart is pulled from")
+	viperBindFlag("chart-password", rootCmd.PersistentFlags().Lookup("chart-password"))
+
+	rootCmd.PersistentFlags().String("chart-cache-dir", "", "directory remote deployment charts are downloaded to (default is a directory in the system temp dir)")
+	viperBindFlag("chart-cache-dir", rootCmd.PersistentFlags().Lookup("chart-cache-dir"))
+
 	rootCmd.PersistentFlags().String("chart-values-path", "", "path that contains values file to configure deployment chart")
 	viperBindFlag("chart-values-path", rootCmd.PersistentFlags().Lookup("chart-values-path"))
 
 	rootCmd.PersistentFlags().String("kube-config-path", "", "path to a valid kubeconfig file")
 	viperBindFlag("kube-config-path", rootCmd.PersistentFlags().Lookup("kube-config-path"))
 
+	rootCmd.PersistentFlags().Bool("query-url-enabled", false, "fetch the full definition of each loadbalancer from the query_url of its event and set it in the chart values")
+	viperBindFlag("query-url.enabled", rootCmd.PersistentFlags().Lookup("query-url-enabled"))
+
+	rootCmd.PersistentFlags().StringSlice("query-url-allowed-urls", nil, "base urls loadbalancer definitions may be fetched from, required when query-url-enabled is set")
+	viperBindFlag("query-url.allowed-urls", rootCmd.PersistentFlags().Lookup("query-url-allowed-urls"))
+
+	rootCmd.PersistentFlags().String("query-url-token", "", "bearer token sent when fetching loadbalancer definitions")
+	viperBindFlag("query-url.token", rootCmd.PersistentFlags().Lookup("query-url-token"))
+
+	rootCmd.PersistentFlags().String("query-url-token-file", "", "file holding the bearer token sent when fetching loadbalancer definitions, read on every request")
+	viperBindFlag("query-url.token-file", rootCmd.PersistentFlags().Lookup("query-url-token-file"))
+
+	rootCmd.PersistentFlags().Duration("query-url-timeout", 10*time.Second, "timeout of each request for a loadbalancer definition")
+	viperBindFlag("query-url.timeout", rootCmd.PersistentFlags().Lookup("query-url-timeout"))
+
+	rootCmd.PersistentFlags().Int("query-url-retries", 3, "number of times a failed request for a loadbalancer definition is retried before the event is redelivered")
+	viperBindFlag("query-url.retries", rootCmd.PersistentFlags().Lookup("query-url-retries"))
+
+	rootCmd.PersistentFlags().String("query-url-values-key", "loadBalancer", "chart values key the fetched loadbalancer definition is set under")
+	viperBindFlag("query-url.values-key", rootCmd.PersistentFlags().Lookup("query-url-values-key"))
+
+	rootCmd.PersistentFlags().String("locations-config", "", "path to a file mapping location IDs to the cluster their loadbalancers are deployed to (default deploys every loadbalancer to the cluster of kube-config-path)")
+	viperBindFlag("locations-config", rootCmd.PersistentFlags().Lookup("locations-config"))
+
+	rootCmd.PersistentFlags().String("min-cpu", "", "smallest cpu quantity a loadbalancer may request, unbounded when empty")
+	viperBindFlag("validation.min-cpu", rootCmd.PersistentFlags().Lookup("min-cpu"))
+
+	rootCmd.PersistentFlags().String("max-cpu", "", "largest cpu quantity a loadbalancer may request, unbounded when empty")
+	viperBindFlag("validation.max-cpu", rootCmd.PersistentFlags().Lookup("max-cpu"))
+
+	rootCmd.PersistentFlags().String("min-memory", "", "smallest memory quantity a loadbalancer may request, unbounded when empty")
+	viperBindFlag("validation.min-memory", rootCmd.PersistentFlags().Lookup("min-memory"))
+
+	rootCmd.PersistentFlags().String("max-memory", "", "largest memory quantity a loadbalancer may request, unbounded when empty")
+	viperBindFlag("validation.max-memory", rootCmd.PersistentFlags().Lookup("max-memory"))
+
+	rootCmd.PersistentFlags().String("event-format", "auto", "format of received events: pubsubx, cloudevents, or auto to detect cloudevents by their headers and payload")
+	viperBindFlag("event-format", rootCmd.PersistentFlags().Lookup("event-format"))
+
+	rootCmd.PersistentFlags().String("event-values-key", "event", "chart values key the labels, ports, listeners and backend pools of v1alpha2 events are set under")
+	viperBindFlag("event-values-key", rootCmd.PersistentFlags().Lookup("event-values-key"))
+
+	rootCmd.PersistentFlags().String("value-mappings-config", "", "path to a file mapping fields of the event data to chart values keys")
+	viperBindFlag("value-mappings-config", rootCmd.PersistentFlags().Lookup("value-mappings-config"))
+
+	rootCmd.PersistentFlags().Duration("cluster-health-interval", 30*time.Second, "how often every cluster loadbalancers are deployed to is checked for reachability")
+	viperBindFlag("cluster-health-interval", rootCmd.PersistentFlags().Lookup("cluster-health-interval"))
+
 	rootCmd.PersistentFlags().StringSlice("helm-cpu-flag", nil, "flag to set cpu limit for helm chart")
 	viperBindFlag("helm-cpu-flag", rootCmd.PersistentFlags().Lookup("helm-cpu-flag"))
 
 	rootCmd.PersistentFlags().StringSlice("helm-memory-flag", nil, "flag to set memory limit for helm chart")
 	viperBindFlag("helm-memory-flag", rootCmd.PersistentFlags().Lookup("helm-memory-flag"))
 
+	rootCmd.PersistentFlags().String("tracing-endpoint", "", "OTLP gRPC endpoint to export traces to, tracing is disabled when empty")
+	viperBindFlag("tracing.endpoint", rootCmd.PersistentFlags().Lookup("tracing-endpoint"))
+
+	rootCmd.PersistentFlags().Bool("tracing-insecure", false, "disable TLS when exporting traces")
+	viperBindFlag("tracing.insecure", rootCmd.PersistentFlags().Lookup("tracing-insecure"))
+
+	rootCmd.PersistentFlags().Float64("tracing-sample-ratio", 1.0, "ratio of new traces to sample, traces started upstream follow the upstream decision")
+	viperBindFlag("tracing.sample-ratio", rootCmd.PersistentFlags().Lookup("tracing-sample-ratio"))
+
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	rootCmd.AddCommand(processCmd)
+	rootCmd.AddCommand(upgradeFleetCmd)
+
+	upgradeFleetCmd.Flags().Duration("lease-wait-timeout", 5*time.Minute, "how long upgrade-fleet waits to acquire the leader election lease before failing, 0 waits indefinitely")
+	viperBindFlag("lease-wait-timeout", upgradeFleetCmd.Flags().Lookup("lease-wait-timeout"))
 }
 
 // initConfig reads in config file and ENV variables if set.
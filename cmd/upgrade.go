@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+
+	"go.infratographer.com/loadbalanceroperator/internal/srv"
+)
+
+const metricsReadHeaderTimeout = 10 * time.Second
+
+// upgradeFleetCmd upgrades every deployed loadbalancer to the configured chart
+var upgradeFleetCmd = &cobra.Command{
+	Use:   "upgrade-fleet",
+	Short: "Upgrade all loadbalancers to the configured chart.",
+	Long: `Upgrade every loadbalancer release owned by the operator to the configured
+chart and values in batches, waiting for each batch to become ready before
+moving on. The upgrade halts once more releases have failed than allowed by
+--fleet-upgrade-max-failures, optionally rolling the failed releases back.
+
+With --leader-election the upgrade only starts once the leader election lease
+of the operator is held, so no release is changed while the operator processes
+messages for it. The upgrade fails if the lease is not acquired within
+--lease-wait-timeout. The lease is released when the upgrade finishes, or the
+upgrade stops once the lease is lost.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return upgradeFleet(cmd.Context())
+	},
+}
+
+func upgradeFleet(ctx context.Context) error {
+	if viper.GetString("chart-path") == "" {
+		return ErrChartPath
+	}
+
+	client, err := newKubeAuth(viper.GetString("kube-config-path"))
+	if err != nil {
+		logger.Fatalw("failed to create Kubernetes client", "error", err)
+	}
+
+	homeClient, err := kubernetes.NewForConfig(client)
+	if err != nil {
+		logger.Fatalw("failed to create Kubernetes client", "error", err)
+	}
+
+	var (
+		clusters  *srv.ClusterRegistry
+		locations map[string]*srv.Cluster
+	)
+
+	if path := viper.GetString("locations-config"); path != "" {
+		clusters, locations, err = loadLocations(ctx, path, client, homeClient)
+		if err != nil {
+			logger.Fatalw("failed to load locations", "error", err)
+		}
+	}
+
+	var mapper *srv.ValueMapper
+
+	if path := viper.GetString("value-mappings-config"); path != "" {
+		mapper, err = loadValueMappings(path)
+		if err != nil {
+			logger.Fatalw("failed to load value mappings", "error", err)
+		}
+	}
+
+	chartSrc := chartSourceFromFlags()
+
+	chart, err := chartSrc.load()
+	if err != nil {
+		logger.Fatalw("failed to load helm chart from provided source", "error", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	metricsServer := &http.Server{
+		Handler:           promhttp.Handler(),
+		Addr:              viper.GetString("healthcheck-port"),
+		ReadHeaderTimeout: metricsReadHeaderTimeout,
+	}
+
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorw("metrics endpoint stopped", "error", err)
+		}
+	}()
+
+	defer func() {
+		_ = metricsServer.Close()
+	}()
+
+	server := &srv.Server{
+		Chart:              chart,
+		Context:            ctx,
+		Debug:              viper.GetBool("logging.debug"),
+		KubeClient:         client,
+		Logger:             logger,
+		ValuesPath:         viper.GetString("chart-values-path"),
+		UseCustomResources: viper.GetBool("use-custom-resources"),
+		Clusters:           clusters,
+		Locations:          locations,
+		QueryEnabled:       viper.GetBool("query-url.enabled"),
+		QueryValuesKey:     viper.GetString("query-url.values-key"),
+		ValueMapper:        mapper,
+		EventValuesKey:     viper.GetString("event-values-key"),
+		LeaderElection:     viper.GetBool("leader-election.enabled"),
+		LeaseName:          viper.GetString("leader-election.lease-name"),
+		LeaseNamespace:     viper.GetString("leader-election.namespace"),
+		LeaseIdentity:      viper.GetString("leader-election.identity"),
+		LeaseDuration:      viper.GetDuration("leader-election.lease-duration"),
+		RenewDeadline:      viper.GetDuration("leader-election.renew-deadline"),
+		RetryPeriod:        viper.GetDuration("leader-election.retry-period"),
+		LeaseWaitTimeout:   viper.GetDuration("lease-wait-timeout"),
+	}
+
+	var result *srv.FleetUpgradeResult
+
+	// the operator leader deploys loadbalancers while holding the lease, so
+	// with leader election the fleet is only upgraded once the lease has been
+	// handed over
+	err = server.RunLeading(ctx, homeClient, func(ctx context.Context) error {
+		var err error
+
+		result, err = server.UpgradeFleet(ctx, fleetUpgradeOptions())
+
+		return err
+	})
+
+	if result != nil {
+		logger.Infow("fleet upgrade finished",
+			"upgraded", result.Upgraded,
+			"skipped", result.Skipped,
+			"failed", result.Failed,
+			"rolled_back", result.RolledBack,
+			"pending", result.Pending,
+		)
+	}
+
+	return err
+}
+
+// fleetUpgradeOptions returns how releases are rolled out, both by
+// upgrade-fleet and when upgrade-on-reload is set
+func fleetUpgradeOptions() srv.FleetUpgradeOptions {
+	return srv.FleetUpgradeOptions{
+		BatchSize:   viper.GetInt("fleet-upgrade.batch-size"),
+		MaxFailures: viper.GetInt("fleet-upgrade.max-failures"),
+		Rollback:    viper.GetBool("fleet-upgrade.rollback"),
+		Timeout:     viper.GetDuration("fleet-upgrade.timeout"),
+	}
+}
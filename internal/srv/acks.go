@@ -0,0 +1,137 @@
+package srv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+const (
+	defaultNakDelay = 5 * time.Second
+	maxNakDelay     = 5 * time.Minute
+)
+
+// isPermanentError reports whether an error will never succeed on
+// redelivery, such as events that cannot be parsed, fail validation or are
+// for an unknown location
+func isPermanentError(err error) bool {
+	var validationErr *ValidationError
+
+	return errors.Is(err, ErrInvalidEvent) || errors.Is(err, ErrUnknownLocation) || errors.As(err, &validationErr)
+}
+
+// acknowledge reports the outcome of processing a message back to jetstream.
+// Successful messages are acked, permanent errors and messages that have
+// exhausted their redelivery budget are dead-lettered and terminated, and
+// everything else is redelivered with an exponential backoff. Messages that
+// cannot be dead-lettered are redelivered rather than terminated so they are
+// never lost.
+func (s *Server) acknowledge(m *nats.Msg, handler string, procErr error) {
+	var err error
+
+	attempt := deliveryAttempt(m)
+
+	switch {
+	case procErr == nil:
+		err = m.Ack()
+	case isPermanentError(procErr):
+		s.Logger.Warnw("terminating message that cannot be processed", "subject", m.Subject, "error", procErr)
+		err = s.terminate(m, handler, attempt, procErr)
+	case s.MaxDeliver > 0 && attempt >= uint64(s.MaxDeliver):
+		s.Logger.Warnw("terminating message that exhausted its redeliveries", "subject", m.Subject, "attempts", attempt, "error", procErr)
+		err = s.terminate(m, handler, attempt, procErr)
+	default:
+		delay := s.nakDelay(attempt)
+		s.Logger.Infow("requesting redelivery of message", "subject", m.Subject, "delay", delay.String(), "error", procErr)
+		err = m.NakWithDelay(delay)
+	}
+
+	if err != nil {
+		s.Logger.Errorw("unable to acknowledge message", "subject", m.Subject, "error", err)
+	}
+}
+
+// terminate dead-letters a message and stops its redelivery. When the dead
+// letter cannot be published the message is redelivered instead.
+func (s *Server) terminate(m *nats.Msg, handler string, attempt uint64, procErr error) error {
+	if err := s.deadLetter(m, handler, attempt, procErr); err != nil {
+		delay := s.nakDelay(attempt)
+		s.Logger.Warnw("requesting redelivery of message that could not be dead-lettered", "subject", m.Subject, "delay", delay.String(), "error", err)
+
+		return m.NakWithDelay(delay)
+	}
+
+	return m.Term()
+}
+
+// deadLetter republishes the original payload of a message that could not be
+// processed to the dead-letter subject, describing the failure in headers
+func (s *Server) deadLetter(m *nats.Msg, handler string, attempt uint64, procErr error) error {
+	if s.DeadLetterSubject == "" {
+		return nil
+	}
+
+	dlq := nats.NewMsg(s.DeadLetterSubject)
+	dlq.Data = m.Data
+
+	for key, values := range m.Header {
+		// jetstream headers such as the message id would cause the dead
+		// letter to be rejected or dropped as a duplicate
+		if strings.HasPrefix(key, "Nats-") {
+			continue
+		}
+
+		for _, value := range values {
+			dlq.Header.Add(key, value)
+		}
+	}
+
+	dlq.Header.Set(events.DeadLetterSubjectHeader, m.Subject)
+	dlq.Header.Set(events.DeadLetterErrorHeader, procErr.Error())
+	dlq.Header.Set(events.DeadLetterHandlerHeader, handler)
+	dlq.Header.Set(events.DeadLetterAttemptsHeader, strconv.FormatUint(attempt, 10))
+	dlq.Header.Set(events.DeadLetterTimestampHeader, time.Now().UTC().Format(time.RFC3339))
+
+	if _, err := s.JetstreamClient.PublishMsg(dlq); err != nil {
+		s.Logger.Errorw("unable to publish message to dead-letter subject", "subject", s.DeadLetterSubject, "error", err)
+		return err
+	}
+
+	s.Logger.Infow("published message to dead-letter subject", "subject", s.DeadLetterSubject, "handler", handler)
+
+	return nil
+}
+
+// nakDelay returns the delay before a message is redelivered, doubling the
+// configured delay for every attempt already made
+func (s *Server) nakDelay(attempt uint64) time.Duration {
+	delay := s.NakDelay
+	if delay <= 0 {
+		delay = defaultNakDelay
+	}
+
+	for i := uint64(1); i < attempt; i++ {
+		delay *= 2
+		if delay >= maxNakDelay {
+			return maxNakDelay
+		}
+	}
+
+	return delay
+}
+
+// deliveryAttempt returns the number of times a message has been delivered,
+// defaulting to the first attempt when jetstream metadata is unavailable
+func deliveryAttempt(m *nats.Msg) uint64 {
+	meta, err := m.Metadata()
+	if err != nil || meta.NumDelivered == 0 {
+		return 1
+	}
+
+	return meta.NumDelivered
+}
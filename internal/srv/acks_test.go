@@ -0,0 +1,377 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/client-go/rest"
+
+	"go.infratographer.com/x/pubsubx"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	type testCase struct {
+		name     string
+		err      error
+		expected bool
+	}
+
+	testCases := []testCase{
+		{
+			name:     "invalid event",
+			err:      ErrInvalidEvent,
+			expected: true,
+		},
+		{
+			name:     "wrapped invalid event",
+			err:      fmt.Errorf("%w: bad uuid", ErrInvalidEvent),
+			expected: true,
+		},
+		{
+			name:     "unknown location",
+			err:      fmt.Errorf("%w: %s", ErrUnknownLocation, uuid.New()),
+			expected: true,
+		},
+		{
+			name:     "validation error",
+			err:      fmt.Errorf("unable to sync: %w", &ValidationError{Field: "resources.cpu", Value: "lots", Err: ErrInvalidQuantity}),
+			expected: true,
+		},
+		{
+			name:     "transient error",
+			err:      errors.New("connection refused"), //nolint:goerr113
+			expected: false,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, isPermanentError(tcase.err))
+		})
+	}
+}
+
+func TestNakDelay(t *testing.T) {
+	type testCase struct {
+		name     string
+		delay    time.Duration
+		attempt  uint64
+		expected time.Duration
+	}
+
+	testCases := []testCase{
+		{
+			name:     "default delay",
+			attempt:  1,
+			expected: defaultNakDelay,
+		},
+		{
+			name:     "first attempt",
+			delay:    time.Second,
+			attempt:  1,
+			expected: time.Second,
+		},
+		{
+			name:     "third attempt",
+			delay:    time.Second,
+			attempt:  3,
+			expected: 4 * time.Second,
+		},
+		{
+			name:     "capped delay",
+			delay:    time.Second,
+			attempt:  100,
+			expected: maxNakDelay,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Logger:   zap.NewNop().Sugar(),
+				NakDelay: tcase.delay,
+			}
+
+			assert.Equal(t, tcase.expected, srv.nakDelay(tcase.attempt))
+		})
+	}
+}
+
+func TestMessageHandlerAcknowledgement(t *testing.T) {
+	type testCase struct {
+		name      string
+		data      []byte
+		expectAck string
+	}
+
+	nc, _, cleanup := newTestJetstream(t, "")
+	defer cleanup()
+
+	newEvent := func(eventType string, data map[string]interface{}) []byte {
+		evt, err := json.Marshal(pubsubx.Message{
+			SubjectURN:     uuid.NewString(),
+			EventType:      eventType,
+			Source:         "loadbalancerapi",
+			Timestamp:      time.Now(),
+			AdditionalData: data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return evt
+	}
+
+	testCases := []testCase{
+		{
+			name:      "unparseable message",
+			data:      []byte("not json"),
+			expectAck: "+TERM",
+		},
+		{
+			name:      "invalid loadbalancer id",
+			data:      newEvent("create", map[string]interface{}{"load_balancer_id": "not-a-uuid"}),
+			expectAck: "+TERM",
+		},
+		{
+			name:      "invalid cpu",
+			data:      newEvent("create", map[string]interface{}{"load_balancer_id": uuid.New(), "location_id": uuid.New(), "resources": map[string]interface{}{"cpu": "lots"}}),
+			expectAck: "+TERM",
+		},
+		{
+			name:      "missing resources",
+			data:      newEvent("create", map[string]interface{}{"load_balancer_id": uuid.New(), "location_id": uuid.New()}),
+			expectAck: "+TERM",
+		},
+		{
+			name:      "invalid cloudevent",
+			data:      []byte(`{"specversion":"1.0","id":"1","source":"loadbalancerapi"}`),
+			expectAck: "+TERM",
+		},
+		{
+			name:      "unknown event type",
+			data:      newEvent("unknown", nil),
+			expectAck: "+ACK",
+		},
+		{
+			name:      "unreachable cluster",
+			data:      newEvent("create", map[string]interface{}{"load_balancer_id": uuid.New(), "location_id": uuid.New(), "resources": map[string]interface{}{"cpu": "500m", "memory": "512Mi"}}),
+			expectAck: "-NAK",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context:    context.TODO(),
+				Logger:     zap.NewNop().Sugar(),
+				KubeClient: &rest.Config{Host: "http://127.0.0.1:1", Timeout: time.Second},
+				NakDelay:   time.Second,
+			}
+
+			sub, err := nc.SubscribeSync("test.events")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer sub.Unsubscribe() //nolint:errcheck
+
+			inbox := nats.NewInbox()
+
+			acks, err := nc.SubscribeSync(inbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer acks.Unsubscribe() //nolint:errcheck
+
+			if err := nc.PublishRequest("test.events", inbox, tcase.data); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv.MessageHandler(m)
+
+			ack, err := acks.NextMsg(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, strings.HasPrefix(string(ack.Data), tcase.expectAck), "unexpected ack %q", ack.Data)
+		})
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	type testCase struct {
+		name        string
+		data        []byte
+		maxDeliver  int
+		dlqSubject  string
+		locations   map[string]*Cluster
+		expectDLQ   bool
+		expectError string
+	}
+
+	nc, js, cleanup := newTestJetstream(t, "dlq", "dlq.>")
+	defer cleanup()
+
+	createEvent, err := json.Marshal(pubsubx.Message{
+		SubjectURN:     uuid.NewString(),
+		EventType:      "create",
+		Timestamp:      time.Now(),
+		AdditionalData: map[string]interface{}{"load_balancer_id": uuid.New(), "location_id": uuid.New(), "resources": map[string]interface{}{"cpu": "500m", "memory": "512Mi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name:        "permanent error",
+			data:        []byte("not json"),
+			maxDeliver:  5,
+			dlqSubject:  "dlq.permanent",
+			expectDLQ:   true,
+			expectError: "invalid event",
+		},
+		{
+			name:        "unknown location",
+			data:        createEvent,
+			maxDeliver:  5,
+			dlqSubject:  "dlq.location",
+			locations:   map[string]*Cluster{uuid.NewString(): NewCluster("edge", &rest.Config{Host: "http://127.0.0.1:1"})},
+			expectDLQ:   true,
+			expectError: "no cluster configured for location",
+		},
+		{
+			name:        "redeliveries exhausted",
+			data:        createEvent,
+			maxDeliver:  1,
+			dlqSubject:  "dlq.exhausted",
+			expectDLQ:   true,
+			expectError: "connection refused",
+		},
+		{
+			name:       "redeliveries remaining",
+			data:       createEvent,
+			maxDeliver: 5,
+			dlqSubject: "dlq.remaining",
+			expectDLQ:  false,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context:           context.TODO(),
+				Logger:            zap.NewNop().Sugar(),
+				KubeClient:        &rest.Config{Host: "http://127.0.0.1:1", Timeout: time.Second},
+				JetstreamClient:   js,
+				MaxDeliver:        tcase.maxDeliver,
+				DeadLetterSubject: tcase.dlqSubject,
+				Locations:         tcase.locations,
+			}
+
+			sub, err := nc.SubscribeSync("events.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer sub.Unsubscribe() //nolint:errcheck
+
+			if err := nc.PublishRequest("events.test", nats.NewInbox(), tcase.data); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv.MessageHandler(m)
+
+			dlq, err := js.GetLastMsg("dlq", tcase.dlqSubject)
+			if !tcase.expectDLQ {
+				assert.ErrorIs(t, err, nats.ErrMsgNotFound)
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tcase.data, dlq.Data)
+			assert.Equal(t, "events.test", dlq.Header.Get(events.DeadLetterSubjectHeader))
+			assert.Equal(t, "1", dlq.Header.Get(events.DeadLetterAttemptsHeader))
+			assert.Contains(t, dlq.Header.Get(events.DeadLetterErrorHeader), tcase.expectError)
+			assert.NotEmpty(t, dlq.Header.Get(events.DeadLetterHandlerHeader))
+			assert.NotEmpty(t, dlq.Header.Get(events.DeadLetterTimestampHeader))
+		})
+	}
+}
+
+func TestDeadLetterFailure(t *testing.T) {
+	nc, js, cleanup := newTestJetstream(t, "dlq", "dlq.>")
+	defer cleanup()
+
+	// no stream captures the dead-letter subject, so publishing to it fails
+	srv := Server{
+		Context:           context.TODO(),
+		Logger:            zap.NewNop().Sugar(),
+		JetstreamClient:   js,
+		MaxDeliver:        5,
+		NakDelay:          time.Second,
+		DeadLetterSubject: "unrouted.dlq",
+	}
+
+	sub, err := nc.SubscribeSync("events.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sub.Unsubscribe() //nolint:errcheck
+
+	inbox := nats.NewInbox()
+
+	acks, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer acks.Unsubscribe() //nolint:errcheck
+
+	if err := nc.PublishRequest("events.test", inbox, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.MessageHandler(m)
+
+	ack, err := acks.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is redelivered rather than terminated and lost
+	assert.True(t, strings.HasPrefix(string(ack.Data), "-NAK"), "unexpected ack %q", ack.Data)
+}
@@ -2,30 +2,45 @@
 package srv
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/cli/values"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/cli-runtime/pkg/genericclioptions"
 	applyv1 "k8s.io/client-go/applyconfigurations/core/v1"
 	applymetav1 "k8s.io/client-go/applyconfigurations/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/helm/pkg/strvals"
 )
 
 const (
-	nameLength = 53
+	nameLength   = 53
+	fieldManager = "loadbalanceroperator"
 )
 
 // CreateNamespace creates namespaces for the specified group that is
 // provided in the event received
-func (s *Server) CreateNamespace(groupID string) error {
+func (s *Server) CreateNamespace(ctx context.Context, groupID string) (err error) {
+	ctx, span := tracer.Start(ctx, "CreateNamespace", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", groupID),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
 	s.Logger.Debugf("ensuring namespace %s exists", groupID)
-	kc, err := kubernetes.NewForConfig(s.KubeClient)
+	kc, err := s.cluster(ctx).Clientset()
 
 	if err != nil {
 		s.Logger.Errorln("unable to authenticate against kubernetes cluster")
@@ -45,86 +60,293 @@ func (s *Server) CreateNamespace(groupID string) error {
 		Spec:   &applyv1.NamespaceSpecApplyConfiguration{},
 		Status: &applyv1.NamespaceStatusApplyConfiguration{},
 	}
-	_, err = kc.CoreV1().Namespaces().Apply(s.Context, &apSpec, metav1.ApplyOptions{FieldManager: "loadbalanceroperator"})
+	start := time.Now()
+	ns, err := kc.CoreV1().Namespaces().Apply(ctx, &apSpec, metav1.ApplyOptions{FieldManager: fieldManager})
+	namespaceApplyDuration.Observe(time.Since(start).Seconds())
 
 	if err != nil {
 		s.Logger.Errorf("unable to create namespace: %s", err)
 		return err
 	}
 
+	// nothing can be installed until a previous removal has finished, the
+	// event is redelivered once it has
+	if ns.DeletionTimestamp != nil {
+		return fmt.Errorf("%w: %s", ErrNamespaceTerminating, groupID)
+	}
+
 	return nil
 }
 
-func (s *Server) newHelmValues(overrides []valueSet) (map[string]interface{}, error) {
-	provider := getter.All(&cli.EnvSettings{})
+// DeleteNamespace removes the namespace for the specified group once no
+// helm releases remain in it. Namespaces that were not created by
+// CreateNamespace are left untouched.
+func (s *Server) DeleteNamespace(ctx context.Context, groupID string) (err error) {
+	ctx, span := tracer.Start(ctx, "DeleteNamespace", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", groupID),
+	))
 
-	valOpts := &values.Options{
-		ValueFiles: []string{s.ValuesPath},
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	s.Logger.Debugf("removing namespace %s if unused", groupID)
+
+	// no release may be installed between checking the namespace is unused
+	// and deleting it
+	return s.lockNamespace(ctx, groupID, true, func(ctx context.Context) error {
+		return s.deleteUnusedNamespace(ctx, groupID)
+	})
+}
+
+// deleteUnusedNamespace deletes a namespace managed by the operator when no
+// helm releases remain in it
+func (s *Server) deleteUnusedNamespace(ctx context.Context, groupID string) error {
+	client, err := s.newHelmClient(ctx, groupID)
+	if err != nil {
+		s.Logger.Errorw("unable to initialize helm client", "error", err)
+		return err
+	}
+
+	lst := action.NewList(client)
+	lst.All = true
+	lst.StateMask = action.ListAll
+
+	releases, err := lst.Run()
+	if err != nil {
+		s.Logger.Errorw("unable to list releases", "error", err)
+		return err
+	}
+
+	if len(releases) > 0 {
+		s.Logger.Debugf("namespace %s still contains %d releases, skipping removal", groupID, len(releases))
+		return nil
+	}
+
+	kc, err := s.cluster(ctx).Clientset()
+	if err != nil {
+		s.Logger.Errorln("unable to authenticate against kubernetes cluster")
+		return err
+	}
+
+	ns, err := kc.CoreV1().Namespaces().Get(ctx, groupID, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		s.Logger.Errorf("unable to retrieve namespace: %s", err)
+
+		return err
+	}
+
+	managed := false
+
+	for _, field := range ns.ManagedFields {
+		if field.Manager == fieldManager {
+			managed = true
+			break
+		}
+	}
+
+	if !managed {
+		s.Logger.Infof("namespace %s is not managed by loadbalanceroperator, skipping removal", groupID)
+		return nil
+	}
+
+	err = kc.CoreV1().Namespaces().Delete(ctx, groupID, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		s.Logger.Errorf("unable to delete namespace: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) newHelmValues(ctx context.Context, overrides []valueSet) (_ map[string]interface{}, err error) {
+	_, span := tracer.Start(ctx, "newHelmValues")
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	var vals map[string]interface{}
+
+	if s.values != nil {
+		// copy the loaded values so overrides never leak between deployments
+		vals, err = normalizeValues(s.values)
+	} else {
+		valOpts := &values.Options{
+			ValueFiles: []string{s.ValuesPath},
+		}
+
+		vals, err = valOpts.MergeValues(getter.All(&cli.EnvSettings{}))
 	}
 
-	values, err := valOpts.MergeValues(provider)
 	if err != nil {
 		s.Logger.Errorw("unable to load values data", "error", err)
 		return nil, err
 	}
 
 	for _, override := range overrides {
-		if err := strvals.ParseInto(override.helmKey+"="+override.value, values); err != nil {
-			s.Logger.Errorw("unable to parse values", "error", err)
-			return nil, err
+		// overrides without a value, such as null mapped values, leave the
+		// key as in the loaded values rather than setting it to ""
+		switch {
+		case override.data != nil:
+			setValue(vals, override.helmKey, override.data)
+		case override.value != "":
+			if err := strvals.ParseInto(override.helmKey+"="+override.value, vals); err != nil {
+				s.Logger.Errorw("unable to parse values", "error", err)
+				return nil, err
+			}
 		}
 	}
 
-	return values, nil
+	return vals, nil
 }
 
-// newDeployment deploys a loadBalancer based upon the configuration provided
-// from the event that is processed.
-func (s *Server) newDeployment(name string, namespace string, overrides []valueSet) error {
-	releaseName := fmt.Sprintf("lb-%s-%s", name, namespace)
-	if len(releaseName) > nameLength {
-		releaseName = releaseName[0:nameLength]
+// setValue sets the dotted key in vals to data, replacing any value already
+// there and creating intermediate maps as needed
+func setValue(vals map[string]interface{}, key string, data interface{}) {
+	parts := strings.Split(key, ".")
+
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := vals[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			vals[part] = next
+		}
+
+		vals = next
 	}
 
-	values, err := s.newHelmValues(overrides)
+	vals[parts[len(parts)-1]] = data
+}
+
+// newDeployment deploys a loadBalancer based upon the configuration provided
+// from the event that is processed. Creating a loadBalancer that already
+// exists is a no-op when its values match, otherwise the existing release is
+// upgraded or recovered.
+func (s *Server) newDeployment(ctx context.Context, name string, namespace string, overrides []valueSet) (err error) {
+	releaseName := newReleaseName(name, namespace)
+
+	ctx, span := tracer.Start(ctx, "newDeployment", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", namespace),
+		attribute.String("loadbalanceroperator.release", releaseName),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	s.chartMu.RLock()
+	defer s.chartMu.RUnlock()
+
+	ch, values, err := s.releaseConfig(ctx, overrides)
 	if err != nil {
 		s.Logger.Errorw("unable to prepare chart values", "error", err)
 		return err
 	}
 
-	client, err := s.newHelmClient(namespace)
+	client, err := s.newHelmClient(ctx, namespace)
 	if err != nil {
 		s.Logger.Errorln("unable to initialize helm client: %s", err)
 		return err
 	}
 
-	hc := action.NewInstall(client)
-	hc.ReleaseName = releaseName
-	hc.Namespace = namespace
-	_, err = hc.Run(s.Chart, values)
+	return s.deployRelease(client, ch, releaseName, namespace, values, false)
+}
+
+// updateDeployment upgrades an existing loadBalancer with the configuration
+// provided from the event that is processed. If the release does not exist
+// yet it will be installed instead.
+func (s *Server) updateDeployment(ctx context.Context, name string, namespace string, overrides []valueSet) (err error) {
+	releaseName := newReleaseName(name, namespace)
+
+	ctx, span := tracer.Start(ctx, "updateDeployment", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", namespace),
+		attribute.String("loadbalanceroperator.release", releaseName),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	s.chartMu.RLock()
+	defer s.chartMu.RUnlock()
+
+	ch, values, err := s.releaseConfig(ctx, overrides)
+	if err != nil {
+		s.Logger.Errorw("unable to prepare chart values", "error", err)
+		return err
+	}
+
+	client, err := s.newHelmClient(ctx, namespace)
+	if err != nil {
+		s.Logger.Errorw("unable to initialize helm client", "error", err)
+		return err
+	}
+
+	return s.deployRelease(client, ch, releaseName, namespace, values, true)
+}
+
+// removeDeployment uninstalls the loadBalancer release that was created by
+// newDeployment. A release that no longer exists is not treated as an error.
+func (s *Server) removeDeployment(ctx context.Context, name string, namespace string) (err error) {
+	releaseName := newReleaseName(name, namespace)
 
+	ctx, span := tracer.Start(ctx, "removeDeployment", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", namespace),
+		attribute.String("loadbalanceroperator.release", releaseName),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	client, err := s.newHelmClient(ctx, namespace)
 	if err != nil {
-		s.Logger.Errorf("unable to deploy %s to %s", releaseName, namespace)
+		s.Logger.Errorw("unable to initialize helm client", "error", err)
 		return err
 	}
 
-	s.Logger.Infof("%s deployed to %s successfully", releaseName, namespace)
+	hist := action.NewHistory(client)
+	hist.Max = 1
 
-	return nil
+	if _, err := hist.Run(releaseName); err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			s.Logger.Infof("%s not found in %s, nothing to uninstall", releaseName, namespace)
+			return nil
+		}
+
+		s.Logger.Errorw("unable to retrieve release history", "error", err)
+
+		return err
+	}
+
+	return s.uninstallRelease(client, releaseName, namespace)
 }
 
-func (s *Server) newHelmClient(namespace string) (*action.Configuration, error) {
-	config := &action.Configuration{}
-	cliopt := genericclioptions.NewConfigFlags(false)
-	wrapper := func(*rest.Config) *rest.Config {
-		return s.KubeClient
+// newReleaseName returns the helm release name for a loadBalancer, truncated
+// to the maximum length helm allows
+func newReleaseName(name string, namespace string) string {
+	releaseName := fmt.Sprintf("lb-%s-%s", name, namespace)
+	if len(releaseName) > nameLength {
+		releaseName = releaseName[0:nameLength]
 	}
-	cliopt.WithWrapConfigFn(wrapper)
 
-	err := config.Init(cliopt, namespace, "secret", func(format string, v ...interface{}) {
-		// fmt.Println(v)
+	return releaseName
+}
 
-	})
+// newHelmClient returns a helm client for namespace in the cluster ctx is
+// directed at
+func (s *Server) newHelmClient(ctx context.Context, namespace string) (*action.Configuration, error) {
+	config, err := s.cluster(ctx).HelmClient(namespace)
 	if err != nil {
 		s.Logger.Errorw("unable to initialize helm client", "error", err)
 		return nil, err
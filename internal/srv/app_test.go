@@ -11,6 +11,8 @@ import (
 	"go.uber.org/zap"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 
@@ -62,7 +64,7 @@ func TestNewHelmValues(t *testing.T) {
 				Logger:     zap.NewNop().Sugar(),
 				ValuesPath: tcase.valuesPath,
 			}
-			values, err := srv.newHelmValues(tcase.overrides)
+			values, err := srv.newHelmValues(context.TODO(), tcase.overrides)
 			if tcase.expectError {
 				assert.NotNil(t, err)
 			} else {
@@ -111,7 +113,7 @@ func TestCreateNamespace(t *testing.T) {
 				KubeClient: tcase.kubeclient,
 			}
 
-			err := srv.CreateNamespace(tcase.appNamespace)
+			err := srv.CreateNamespace(context.TODO(), tcase.appNamespace)
 
 			if tcase.expectError {
 				assert.NotNil(t, err)
@@ -224,8 +226,8 @@ func TestNewDeployment(t *testing.T) {
 				Chart:      tcase.chart,
 			}
 
-			_ = srv.CreateNamespace(tcase.appNamespace)
-			err = srv.newDeployment(tcase.appName, tcase.appNamespace, nil)
+			_ = srv.CreateNamespace(context.TODO(), tcase.appNamespace)
+			err = srv.newDeployment(context.TODO(), tcase.appName, tcase.appNamespace, nil)
 
 			if tcase.expectError {
 				assert.NotNil(t, err)
@@ -274,7 +276,7 @@ func TestNewHelmClient(t *testing.T) {
 				KubeClient: tcase.kubeClient,
 			}
 
-			_, err := srv.newHelmClient(tcase.appNamespace)
+			_, err := srv.newHelmClient(context.Background(), tcase.appNamespace)
 
 			if tcase.expectError {
 				assert.NotNil(t, err)
@@ -284,3 +286,355 @@ func TestNewHelmClient(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateDeployment(t *testing.T) {
+	type testCase struct {
+		name         string
+		appNamespace string
+		appName      string
+		expectError  bool
+		preinstall   bool
+		chart        *chart.Chart
+		valPath      string
+	}
+
+	testDir, err := os.MkdirTemp("", "test-update-deployment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := envtest.Environment{}
+
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name:         "upgrade existing release",
+			expectError:  false,
+			preinstall:   true,
+			appNamespace: uuid.New().String(),
+			appName:      uuid.New().String(),
+			chart:        ch,
+			valPath:      pwd + "/../../hack/ci/values.yaml",
+		},
+		{
+			name:         "install missing release",
+			expectError:  false,
+			preinstall:   false,
+			appNamespace: uuid.New().String(),
+			appName:      uuid.New().String(),
+			chart:        ch,
+			valPath:      pwd + "/../../hack/ci/values.yaml",
+		},
+		{
+			name:         "missing values path",
+			expectError:  true,
+			preinstall:   true,
+			appNamespace: uuid.New().String(),
+			appName:      uuid.New().String(),
+			chart:        ch,
+			valPath:      "",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context:    context.TODO(),
+				Logger:     zap.NewNop().Sugar(),
+				KubeClient: cfg,
+				ValuesPath: pwd + "/../../hack/ci/values.yaml",
+				Chart:      tcase.chart,
+			}
+
+			_ = srv.CreateNamespace(context.TODO(), tcase.appNamespace)
+
+			if tcase.preinstall {
+				if err := srv.newDeployment(context.TODO(), tcase.appName, tcase.appNamespace, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv.ValuesPath = tcase.valPath
+			err = srv.updateDeployment(context.TODO(), tcase.appName, tcase.appNamespace, []valueSet{{helmKey: "hello", value: "world"}})
+
+			if tcase.expectError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+
+	err = env.Stop()
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestNewReleaseName(t *testing.T) {
+	type testCase struct {
+		name      string
+		appName   string
+		namespace string
+		expected  string
+	}
+
+	testCases := []testCase{
+		{
+			name:      "short name",
+			appName:   "short",
+			namespace: "name",
+			expected:  "lb-short-name",
+		},
+		{
+			name:      "truncated name",
+			appName:   "d9c2ec30-8e0f-4f55-a2e2-e22c5a6b3c6b",
+			namespace: "2ec2e0b9-3c9b-4e3c-bdd3-0e5a5e7d7c35",
+			expected:  "lb-d9c2ec30-8e0f-4f55-a2e2-e22c5a6b3c6b-2ec2e0b9-3c9b",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			releaseName := newReleaseName(tcase.appName, tcase.namespace)
+			assert.Equal(t, tcase.expected, releaseName)
+			assert.LessOrEqual(t, len(releaseName), nameLength)
+		})
+	}
+}
+
+func TestRemoveDeployment(t *testing.T) {
+	type testCase struct {
+		name         string
+		appNamespace string
+		appName      string
+		expectError  bool
+		preinstall   bool
+	}
+
+	testDir, err := os.MkdirTemp("", "test-remove-deployment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := envtest.Environment{}
+
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name:         "uninstall existing release",
+			expectError:  false,
+			preinstall:   true,
+			appNamespace: uuid.New().String(),
+			appName:      uuid.New().String(),
+		},
+		{
+			name:         "missing release",
+			expectError:  false,
+			preinstall:   false,
+			appNamespace: uuid.New().String(),
+			appName:      uuid.New().String(),
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context:    context.TODO(),
+				Logger:     zap.NewNop().Sugar(),
+				KubeClient: cfg,
+				ValuesPath: pwd + "/../../hack/ci/values.yaml",
+				Chart:      ch,
+			}
+
+			_ = srv.CreateNamespace(context.TODO(), tcase.appNamespace)
+
+			if tcase.preinstall {
+				if err := srv.newDeployment(context.TODO(), tcase.appName, tcase.appNamespace, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = srv.removeDeployment(context.TODO(), tcase.appName, tcase.appNamespace)
+
+			if tcase.expectError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+
+	err = env.Stop()
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	type testCase struct {
+		name          string
+		appNamespace  string
+		createNS      bool
+		preinstall    bool
+		expectError   bool
+		expectRemoval bool
+	}
+
+	testDir, err := os.MkdirTemp("", "test-delete-namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := envtest.Environment{}
+
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name:          "empty namespace",
+			appNamespace:  uuid.New().String(),
+			createNS:      true,
+			expectError:   false,
+			expectRemoval: true,
+		},
+		{
+			name:          "namespace with releases",
+			appNamespace:  uuid.New().String(),
+			createNS:      true,
+			preinstall:    true,
+			expectError:   false,
+			expectRemoval: false,
+		},
+		{
+			name:          "missing namespace",
+			appNamespace:  uuid.New().String(),
+			expectError:   false,
+			expectRemoval: true,
+		},
+		{
+			name:          "unmanaged namespace",
+			appNamespace:  "default",
+			expectError:   false,
+			expectRemoval: false,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context:    context.TODO(),
+				Logger:     zap.NewNop().Sugar(),
+				KubeClient: cfg,
+				ValuesPath: pwd + "/../../hack/ci/values.yaml",
+				Chart:      ch,
+			}
+
+			if tcase.createNS {
+				_ = srv.CreateNamespace(context.TODO(), tcase.appNamespace)
+			}
+
+			if tcase.preinstall {
+				if err := srv.newDeployment(context.TODO(), uuid.New().String(), tcase.appNamespace, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = srv.DeleteNamespace(context.TODO(), tcase.appNamespace)
+
+			if tcase.expectError {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			ns, err := kc.CoreV1().Namespaces().Get(context.TODO(), tcase.appNamespace, metav1.GetOptions{})
+			if tcase.expectRemoval {
+				// envtest does not run the namespace controller, so removed
+				// namespaces remain in a terminating state
+				if err == nil {
+					assert.NotNil(t, ns.DeletionTimestamp)
+				}
+			} else {
+				assert.Nil(t, err)
+				assert.Nil(t, ns.DeletionTimestamp)
+			}
+		})
+	}
+
+	err = env.Stop()
+
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,229 @@
+package srv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"go.infratographer.com/x/pubsubx"
+)
+
+const (
+	// EventFormatAuto detects the format of each message from its headers
+	// and payload
+	EventFormatAuto = "auto"
+	// EventFormatPubsubx only accepts pubsubx messages
+	EventFormatPubsubx = "pubsubx"
+	// EventFormatCloudEvents only accepts CloudEvents, in either the
+	// structured or binary content mode
+	EventFormatCloudEvents = "cloudevents"
+
+	cloudEventsContentType  = "application/cloudevents+json"
+	cloudEventsHeaderPrefix = "ce-"
+	contentTypeHeader       = "Content-Type"
+)
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON content mode.
+// The actorurn extension carries the actor of infratographer events.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      string          `json:"data_base64"`
+	ActorURN        string          `json:"actorurn"`
+}
+
+// decodeMessage returns the pubsubx message a NATS message holds, converting
+// CloudEvents onto the same fields
+func (s *Server) decodeMessage(m *nats.Msg) (pubsubx.Message, error) {
+	if s.eventFormat(m) == EventFormatCloudEvents {
+		return decodeCloudEvent(m)
+	}
+
+	msg := pubsubx.Message{}
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		return msg, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	return msg, nil
+}
+
+// eventFormat returns the format of a message, which is the configured
+// EventFormat unless it is detected automatically. CloudEvents are recognised
+// by their ce- headers, their content type or a specversion in the payload.
+func (s *Server) eventFormat(m *nats.Msg) string {
+	switch s.EventFormat {
+	case EventFormatPubsubx, EventFormatCloudEvents:
+		return s.EventFormat
+	}
+
+	if headerValue(m.Header, cloudEventsHeaderPrefix+"specversion") != "" {
+		return EventFormatCloudEvents
+	}
+
+	if mediaType(headerValue(m.Header, contentTypeHeader)) == cloudEventsContentType {
+		return EventFormatCloudEvents
+	}
+
+	evt := struct {
+		SpecVersion string `json:"specversion"`
+	}{}
+
+	if err := json.Unmarshal(m.Data, &evt); err == nil && evt.SpecVersion != "" {
+		return EventFormatCloudEvents
+	}
+
+	return EventFormatPubsubx
+}
+
+// decodeCloudEvent converts a CloudEvent onto a pubsubx message. Events in
+// the binary content mode carry their attributes in ce- headers and their data
+// as the payload, otherwise the payload is a structured JSON event.
+func decodeCloudEvent(m *nats.Msg) (pubsubx.Message, error) {
+	evt := cloudEvent{}
+
+	if headerValue(m.Header, cloudEventsHeaderPrefix+"specversion") != "" {
+		evt = cloudEvent{
+			SpecVersion:     headerValue(m.Header, cloudEventsHeaderPrefix+"specversion"),
+			ID:              headerValue(m.Header, cloudEventsHeaderPrefix+"id"),
+			Source:          headerValue(m.Header, cloudEventsHeaderPrefix+"source"),
+			Type:            headerValue(m.Header, cloudEventsHeaderPrefix+"type"),
+			Subject:         headerValue(m.Header, cloudEventsHeaderPrefix+"subject"),
+			Time:            headerValue(m.Header, cloudEventsHeaderPrefix+"time"),
+			DataContentType: headerValue(m.Header, contentTypeHeader),
+			Data:            m.Data,
+			ActorURN:        headerValue(m.Header, cloudEventsHeaderPrefix+"actorurn"),
+		}
+	} else if err := json.Unmarshal(m.Data, &evt); err != nil {
+		return pubsubx.Message{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	return evt.message()
+}
+
+// cloudEventID returns the source and id that together identify a
+// CloudEvent, or an empty string when the message has no id
+func cloudEventID(m *nats.Msg) string {
+	evt := cloudEvent{
+		ID:     headerValue(m.Header, cloudEventsHeaderPrefix+"id"),
+		Source: headerValue(m.Header, cloudEventsHeaderPrefix+"source"),
+	}
+
+	if evt.ID == "" {
+		if err := json.Unmarshal(m.Data, &evt); err != nil || evt.ID == "" {
+			return ""
+		}
+	}
+
+	return evt.Source + "/" + evt.ID
+}
+
+// message returns the pubsubx message equivalent to a CloudEvent. The last
+// dot separated part of the event type is used as the event type, so
+// com.infratographer.loadbalancer.create is handled as a create event.
+func (evt *cloudEvent) message() (pubsubx.Message, error) {
+	msg := pubsubx.Message{}
+
+	if !strings.HasPrefix(evt.SpecVersion, "1.") {
+		return msg, fmt.Errorf("%w: unsupported cloudevents specversion %q", ErrInvalidEvent, evt.SpecVersion)
+	}
+
+	for _, attr := range []struct{ name, value string }{{"id", evt.ID}, {"source", evt.Source}, {"type", evt.Type}} {
+		if attr.value == "" {
+			return msg, fmt.Errorf("%w: cloudevent has no %s", ErrInvalidEvent, attr.name)
+		}
+	}
+
+	if evt.Time != "" {
+		ts, err := time.Parse(time.RFC3339, evt.Time)
+		if err != nil {
+			return msg, fmt.Errorf("%w: invalid cloudevent time: %s", ErrInvalidEvent, err)
+		}
+
+		msg.Timestamp = ts
+	}
+
+	data, err := evt.data()
+	if err != nil {
+		return msg, err
+	}
+
+	msg.EventType = evt.Type[strings.LastIndex(evt.Type, ".")+1:]
+	msg.SubjectURN = evt.Subject
+	msg.Source = evt.Source
+	msg.ActorURN = evt.ActorURN
+	msg.AdditionalData = data
+
+	return msg, nil
+}
+
+// data returns the JSON object held in the data of a CloudEvent
+func (evt *cloudEvent) data() (map[string]interface{}, error) {
+	if contentType := mediaType(evt.DataContentType); contentType != "" &&
+		contentType != "application/json" && !strings.HasSuffix(contentType, "+json") {
+		return nil, fmt.Errorf("%w: unsupported cloudevent datacontenttype %q", ErrInvalidEvent, evt.DataContentType)
+	}
+
+	raw := []byte(evt.Data)
+
+	if evt.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(evt.DataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cloudevent data_base64: %s", ErrInvalidEvent, err)
+		}
+
+		raw = decoded
+	}
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%w: cloudevent data is not a JSON object: %s", ErrInvalidEvent, err)
+	}
+
+	return data, nil
+}
+
+// headerValue returns the first value of a header, matching its name
+// case-insensitively as producers differ in how they write CloudEvents headers
+func headerValue(h nats.Header, key string) string {
+	if value := h.Get(key); value != "" {
+		return value
+	}
+
+	for name, values := range h {
+		if strings.EqualFold(name, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+// mediaType returns the lowercase media type of a content type, without any
+// parameters
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	return mt
+}
@@ -0,0 +1,221 @@
+package srv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	"go.infratographer.com/x/pubsubx"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	type testCase struct {
+		name        string
+		format      string
+		header      nats.Header
+		data        string
+		expected    pubsubx.Message
+		expectError error
+	}
+
+	ts := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	lbData := `{"load_balancer_id":"8f2d8d53-6bb3-4b26-9d8f-6b4a6f6c1e1e"}`
+	expectedData := map[string]interface{}{"load_balancer_id": "8f2d8d53-6bb3-4b26-9d8f-6b4a6f6c1e1e"}
+
+	cloudEvent := pubsubx.Message{
+		SubjectURN:     "urn:infratographer:loadbalancer:8f2d8d53",
+		EventType:      "create",
+		Source:         "loadbalancerapi",
+		Timestamp:      ts,
+		ActorURN:       "urn:infratographer:user:1",
+		AdditionalData: expectedData,
+	}
+
+	testCases := []testCase{
+		{
+			name: "pubsubx message",
+			data: `{"subject_urn":"urn:infratographer:loadbalancer:8f2d8d53","event_type":"create","source":"loadbalancerapi","timestamp":"2023-01-02T03:04:05Z","actor_urn":"urn:infratographer:user:1","additional_data":` + lbData + `}`,
+			expected: pubsubx.Message{
+				SubjectURN:     "urn:infratographer:loadbalancer:8f2d8d53",
+				EventType:      "create",
+				Source:         "loadbalancerapi",
+				Timestamp:      ts,
+				ActorURN:       "urn:infratographer:user:1",
+				AdditionalData: expectedData,
+			},
+		},
+		{
+			name:        "invalid pubsubx message",
+			data:        "not json",
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:     "structured cloudevent",
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"com.infratographer.loadbalancer.create","subject":"urn:infratographer:loadbalancer:8f2d8d53","time":"2023-01-02T03:04:05Z","actorurn":"urn:infratographer:user:1","datacontenttype":"application/json","data":` + lbData + `}`,
+			expected: cloudEvent,
+		},
+		{
+			name:     "structured cloudevent content type",
+			header:   nats.Header{"Content-Type": []string{"application/cloudevents+json; charset=utf-8"}},
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"com.infratographer.loadbalancer.create","subject":"urn:infratographer:loadbalancer:8f2d8d53","time":"2023-01-02T03:04:05Z","actorurn":"urn:infratographer:user:1","data":` + lbData + `}`,
+			expected: cloudEvent,
+		},
+		{
+			name:     "structured cloudevent with base64 data",
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"com.infratographer.loadbalancer.create","subject":"urn:infratographer:loadbalancer:8f2d8d53","time":"2023-01-02T03:04:05Z","actorurn":"urn:infratographer:user:1","data_base64":"` + base64.StdEncoding.EncodeToString([]byte(lbData)) + `"}`,
+			expected: cloudEvent,
+		},
+		{
+			name: "binary cloudevent",
+			header: nats.Header{
+				"ce-specversion": []string{"1.0"},
+				"ce-id":          []string{"1"},
+				"ce-source":      []string{"loadbalancerapi"},
+				"ce-type":        []string{"com.infratographer.loadbalancer.create"},
+				"ce-subject":     []string{"urn:infratographer:loadbalancer:8f2d8d53"},
+				"ce-time":        []string{"2023-01-02T03:04:05Z"},
+				"ce-actorurn":    []string{"urn:infratographer:user:1"},
+				"Content-Type":   []string{"application/json"},
+			},
+			data:     lbData,
+			expected: cloudEvent,
+		},
+		{
+			name: "binary cloudevent with canonical headers",
+			header: nats.Header{
+				"Ce-Specversion": []string{"1.0"},
+				"Ce-Id":          []string{"1"},
+				"Ce-Source":      []string{"loadbalancerapi"},
+				"Ce-Type":        []string{"create"},
+			},
+			data: lbData,
+			expected: pubsubx.Message{
+				EventType:      "create",
+				Source:         "loadbalancerapi",
+				AdditionalData: expectedData,
+			},
+		},
+		{
+			name:        "unsupported specversion",
+			data:        `{"specversion":"0.3","id":"1","source":"loadbalancerapi","type":"create"}`,
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:        "missing type",
+			data:        `{"specversion":"1.0","id":"1","source":"loadbalancerapi"}`,
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:        "invalid time",
+			data:        `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"create","time":"yesterday"}`,
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name: "unsupported data content type",
+			header: nats.Header{
+				"ce-specversion": []string{"1.0"},
+				"ce-id":          []string{"1"},
+				"ce-source":      []string{"loadbalancerapi"},
+				"ce-type":        []string{"create"},
+				"Content-Type":   []string{"application/xml"},
+			},
+			data:        "<lb/>",
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:        "data is not an object",
+			data:        `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"create","data":"lb"}`,
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:        "cloudevents format rejects pubsubx messages",
+			format:      EventFormatCloudEvents,
+			data:        `{"event_type":"create","additional_data":` + lbData + `}`,
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:   "pubsubx format ignores cloudevents headers",
+			format: EventFormatPubsubx,
+			header: nats.Header{"ce-specversion": []string{"1.0"}},
+			data:   `{"event_type":"create","additional_data":` + lbData + `}`,
+			expected: pubsubx.Message{
+				EventType:      "create",
+				AdditionalData: expectedData,
+			},
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := &Server{EventFormat: tcase.format}
+
+			msg, err := srv.decodeMessage(&nats.Msg{Header: tcase.header, Data: []byte(tcase.data)})
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.True(t, tcase.expected.Timestamp.Equal(msg.Timestamp))
+
+			tcase.expected.Timestamp, msg.Timestamp = time.Time{}, time.Time{}
+			assert.Equal(t, tcase.expected, msg)
+		})
+	}
+}
+
+func TestEventFormat(t *testing.T) {
+	type testCase struct {
+		name     string
+		format   string
+		header   nats.Header
+		data     interface{}
+		expected string
+	}
+
+	testCases := []testCase{
+		{
+			name:     "pubsubx payload",
+			data:     pubsubx.Message{EventType: "create"},
+			expected: EventFormatPubsubx,
+		},
+		{
+			name:     "specversion header",
+			header:   nats.Header{"CE-SpecVersion": []string{"1.0"}},
+			expected: EventFormatCloudEvents,
+		},
+		{
+			name:     "content type",
+			header:   nats.Header{"Content-Type": []string{"application/cloudevents+json"}},
+			expected: EventFormatCloudEvents,
+		},
+		{
+			name:     "specversion payload",
+			data:     map[string]interface{}{"specversion": "1.0"},
+			expected: EventFormatCloudEvents,
+		},
+		{
+			name:     "configured format",
+			format:   EventFormatPubsubx,
+			data:     map[string]interface{}{"specversion": "1.0"},
+			expected: EventFormatPubsubx,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			data, err := json.Marshal(tcase.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv := &Server{EventFormat: tcase.format}
+			assert.Equal(t, tcase.expected, srv.eventFormat(&nats.Msg{Header: tcase.header, Data: data}))
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	defaultClusterName           = "default"
+	defaultClusterHealthInterval = 30 * time.Second
+	clusterHealthTimeout         = 10 * time.Second
+)
+
+// Cluster is a kubernetes cluster loadbalancers can be deployed to. Its
+// clientset and the getter helm configurations are created from are created
+// on first use and reused.
+type Cluster struct {
+	Name   string
+	Config *rest.Config
+
+	mu        sync.Mutex
+	clientset kubernetes.Interface
+	getter    *genericclioptions.ConfigFlags
+	healthErr error
+	checked   bool
+}
+
+// NewCluster returns a cluster named name reached with config
+func NewCluster(name string, config *rest.Config) *Cluster {
+	return &Cluster{
+		Name:   name,
+		Config: config,
+	}
+}
+
+// Clientset returns the cached kubernetes clientset for the cluster
+func (c *Cluster) Clientset() (kubernetes.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clientset != nil {
+		return c.clientset, nil
+	}
+
+	if c.Config == nil {
+		return nil, fmt.Errorf("%w: %s", ErrClusterConfig, c.Name)
+	}
+
+	kc, err := kubernetes.NewForConfig(c.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	c.clientset = kc
+
+	return kc, nil
+}
+
+// HelmClient returns a new helm configuration for namespace, an empty
+// namespace covering all namespaces. Helm writes to its configuration while
+// running actions, so every operation needs its own. Only the getter, which
+// caches the discovery client and REST mapper, is shared.
+func (c *Cluster) HelmClient(namespace string) (*action.Configuration, error) {
+	getter, err := c.restClientGetter()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &action.Configuration{}
+
+	if err := config.Init(getter, namespace, "secret", func(format string, v ...interface{}) {}); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// restClientGetter returns the cached getter helm configurations for the
+// cluster are created from
+func (c *Cluster) restClientGetter() (*genericclioptions.ConfigFlags, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.getter != nil {
+		return c.getter, nil
+	}
+
+	if c.Config == nil {
+		return nil, fmt.Errorf("%w: %s", ErrClusterConfig, c.Name)
+	}
+
+	// discovery is not cached on disk, clusters share the default cache
+	// directory and a stale cache would not see newly installed resources
+	c.getter = genericclioptions.NewConfigFlags(false)
+	c.getter.WithWrapConfigFn(func(*rest.Config) *rest.Config {
+		return c.Config
+	})
+
+	return c.getter, nil
+}
+
+// Check requests the version of the cluster to confirm it is reachable and
+// records the result
+func (c *Cluster) Check(ctx context.Context) error {
+	kc, err := c.Clientset()
+
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ctx, clusterHealthTimeout)
+		defer cancel()
+
+		_, err = kc.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+	}
+
+	c.mu.Lock()
+	c.healthErr = err
+	c.checked = true
+	c.mu.Unlock()
+
+	if err != nil {
+		clusterHealthy.WithLabelValues(c.Name).Set(0)
+	} else {
+		clusterHealthy.WithLabelValues(c.Name).Set(1)
+	}
+
+	return err
+}
+
+// Healthy reports whether the last health check succeeded. Clusters that
+// have not been checked yet are assumed to be healthy.
+func (c *Cluster) Healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.checked || c.healthErr == nil
+}
+
+// ClusterRegistry holds the named clusters loadbalancers can be deployed to
+type ClusterRegistry struct {
+	mu       sync.RWMutex
+	clusters map[string]*Cluster
+}
+
+// NewClusterRegistry returns a registry holding clusters
+func NewClusterRegistry(clusters ...*Cluster) *ClusterRegistry {
+	r := &ClusterRegistry{clusters: map[string]*Cluster{}}
+
+	for _, c := range clusters {
+		r.Add(c)
+	}
+
+	return r
+}
+
+// Add registers a cluster, replacing any cluster with the same name
+func (r *ClusterRegistry) Add(c *Cluster) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clusters[c.Name] = c
+}
+
+// Get returns the cluster named name
+func (r *ClusterRegistry) Get(name string) (*Cluster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.clusters[name]
+
+	return c, ok
+}
+
+// List returns every registered cluster ordered by name
+func (r *ClusterRegistry) List() []*Cluster {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clusters := make([]*Cluster, 0, len(r.clusters))
+	for _, c := range r.clusters {
+		clusters = append(clusters, c)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	return clusters
+}
+
+// Degraded returns the names of clusters that failed their last health check
+func (r *ClusterRegistry) Degraded() []string {
+	degraded := []string{}
+
+	for _, c := range r.List() {
+		if !c.Healthy() {
+			degraded = append(degraded, c.Name)
+		}
+	}
+
+	return degraded
+}
+
+// clusterKey is the context key holding the cluster a request is directed at
+type clusterKey struct{}
+
+// withCluster returns a context that directs kubernetes and helm calls made
+// with it to cluster
+func withCluster(ctx context.Context, cluster *Cluster) context.Context {
+	return context.WithValue(ctx, clusterKey{}, cluster)
+}
+
+// cluster returns the cluster ctx is directed at, falling back to the
+// operator's own cluster when none was set
+func (s *Server) cluster(ctx context.Context) *Cluster {
+	if c, ok := ctx.Value(clusterKey{}).(*Cluster); ok && c != nil {
+		return c
+	}
+
+	return s.home()
+}
+
+// home returns the cluster given by KubeClient, which the operator runs
+// against and records LoadBalancer resources in
+func (s *Server) home() *Cluster {
+	s.homeOnce.Do(func() {
+		s.homeCluster = NewCluster(defaultClusterName, s.KubeClient)
+	})
+
+	return s.homeCluster
+}
+
+// clusterRegistry returns the configured clusters, or a registry holding
+// only the operator's own cluster when none were configured
+func (s *Server) clusterRegistry() *ClusterRegistry {
+	if s.Clusters != nil && len(s.Clusters.List()) > 0 {
+		return s.Clusters
+	}
+
+	return NewClusterRegistry(s.home())
+}
+
+// checkClusters checks the health of every cluster on each
+// ClusterHealthInterval until ctx is cancelled
+func (s *Server) checkClusters(ctx context.Context) {
+	interval := s.ClusterHealthInterval
+	if interval <= 0 {
+		interval = defaultClusterHealthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, c := range s.clusterRegistry().List() {
+			if err := c.Check(ctx); err != nil && ctx.Err() == nil {
+				s.Logger.Warnw("cluster health check failed", "cluster", c.Name, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
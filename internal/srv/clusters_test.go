@@ -0,0 +1,113 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+func TestClusterHelmClient(t *testing.T) {
+	cluster := NewCluster("edge", &rest.Config{Host: "https://edge.example.com"})
+
+	first, err := cluster.HelmClient("tenant")
+	assert.Nil(t, err)
+
+	// concurrent operations must not share a configuration
+	again, err := cluster.HelmClient("tenant")
+	assert.Nil(t, err)
+	assert.NotSame(t, first, again)
+	assert.NotSame(t, first.Releases, again.Releases)
+
+	getter, err := cluster.restClientGetter()
+	assert.Nil(t, err)
+	assert.Same(t, getter, cluster.getter)
+
+	_, err = NewCluster("missing", nil).HelmClient("tenant")
+	assert.ErrorIs(t, err, ErrClusterConfig)
+}
+
+func TestClusterCheck(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"major":"1","minor":"26"}`))
+	}))
+	defer api.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	healthy := NewCluster("healthy", &rest.Config{Host: api.URL})
+	degraded := NewCluster("degraded", &rest.Config{Host: unreachable.URL})
+	registry := NewClusterRegistry(healthy, degraded)
+
+	// clusters are assumed healthy until checked
+	assert.Empty(t, registry.Degraded())
+
+	assert.Nil(t, healthy.Check(context.Background()))
+	assert.NotNil(t, degraded.Check(context.Background()))
+
+	assert.True(t, healthy.Healthy())
+	assert.False(t, degraded.Healthy())
+	assert.Equal(t, []string{"degraded"}, registry.Degraded())
+}
+
+func TestClusterReadiness(t *testing.T) {
+	type testCase struct {
+		name         string
+		unhealthy    []string
+		expectStatus int
+		expectBody   string
+	}
+
+	testCases := []testCase{
+		{
+			name:         "all clusters healthy",
+			expectStatus: http.StatusOK,
+			expectBody:   "ok",
+		},
+		{
+			name:         "some clusters degraded",
+			unhealthy:    []string{"edge-2"},
+			expectStatus: http.StatusOK,
+			expectBody:   "ok - Degraded clusters: edge-2",
+		},
+		{
+			name:         "all clusters degraded",
+			unhealthy:    []string{"edge-1", "edge-2"},
+			expectStatus: http.StatusServiceUnavailable,
+			expectBody:   "503 - No clusters reachable: edge-1, edge-2",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			registry := NewClusterRegistry(
+				NewCluster("edge-1", &rest.Config{}),
+				NewCluster("edge-2", &rest.Config{}),
+			)
+
+			for _, name := range tcase.unhealthy {
+				cluster, _ := registry.Get(name)
+				cluster.checked = true
+				cluster.healthErr = context.DeadlineExceeded
+			}
+
+			srv := &Server{Clusters: registry}
+			w := httptest.NewRecorder()
+
+			srv.clusterReadiness(w)
+
+			assert.Equal(t, tcase.expectStatus, w.Code)
+			assert.Equal(t, tcase.expectBody, w.Body.String())
+		})
+	}
+}
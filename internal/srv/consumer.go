@@ -0,0 +1,164 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultConsumerName  = "loadbalanceroperator"
+	defaultFetchBatch    = 10
+	defaultFetchTimeout  = 5 * time.Second
+	defaultAckWait       = 30 * time.Second
+	defaultMaxAckPending = 100
+
+	// fetchRetryDelay is how long to wait before fetching again after an
+	// unexpected error
+	fetchRetryDelay = time.Second
+)
+
+// consumerConfig returns the desired configuration of the durable consumer
+// the operator pulls messages from
+func (s *Server) consumerConfig() *nats.ConsumerConfig {
+	cfg := &nats.ConsumerConfig{
+		Durable:       s.ConsumerName,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		FilterSubject: fmt.Sprintf("%s.>", s.Prefix),
+		AckWait:       s.AckWait,
+		MaxDeliver:    s.MaxDeliver,
+		MaxAckPending: s.MaxAckPending,
+	}
+
+	if cfg.Durable == "" {
+		cfg.Durable = defaultConsumerName
+	}
+
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = defaultAckWait
+	}
+
+	// with a dead-letter subject the operator enforces MaxDeliver itself, so
+	// messages whose dead letter could not be published are still redelivered
+	if cfg.MaxDeliver <= 0 || s.DeadLetterSubject != "" {
+		cfg.MaxDeliver = -1
+	}
+
+	if cfg.MaxAckPending <= 0 {
+		cfg.MaxAckPending = defaultMaxAckPending
+	}
+
+	return cfg
+}
+
+// ensureConsumer creates the durable pull consumer when it does not exist
+// yet, or updates an existing consumer whose settings have drifted from the
+// configuration
+func (s *Server) ensureConsumer(cfg *nats.ConsumerConfig) error {
+	info, err := s.JetstreamClient.ConsumerInfo(s.StreamName, cfg.Durable)
+	if err != nil {
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			s.Logger.Errorw("unable to retrieve consumer", "consumer", cfg.Durable, "error", err)
+			return err
+		}
+
+		s.Logger.Infow("creating durable consumer", "stream", s.StreamName, "consumer", cfg.Durable)
+
+		if _, err := s.JetstreamClient.AddConsumer(s.StreamName, cfg); err != nil {
+			s.Logger.Errorw("unable to create consumer", "consumer", cfg.Durable, "error", err)
+			return err
+		}
+
+		return nil
+	}
+
+	if info.Config.DeliverSubject != "" {
+		return fmt.Errorf("%w: %s", ErrPushConsumer, cfg.Durable)
+	}
+
+	if info.Config.FilterSubject == cfg.FilterSubject &&
+		info.Config.AckWait == cfg.AckWait &&
+		info.Config.MaxDeliver == cfg.MaxDeliver &&
+		info.Config.MaxAckPending == cfg.MaxAckPending {
+		return nil
+	}
+
+	s.Logger.Infow("updating durable consumer", "stream", s.StreamName, "consumer", cfg.Durable)
+
+	update := info.Config
+	update.FilterSubject = cfg.FilterSubject
+	update.AckWait = cfg.AckWait
+	update.MaxDeliver = cfg.MaxDeliver
+	update.MaxAckPending = cfg.MaxAckPending
+
+	if _, err := s.JetstreamClient.UpdateConsumer(s.StreamName, &update); err != nil {
+		s.Logger.Errorw("unable to update consumer", "consumer", cfg.Durable, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// fetchMessages pulls batches of messages from the durable consumer until
+// ctx is cancelled, the subscription is closed or the server shuts down
+func (s *Server) fetchMessages(ctx context.Context, sub *nats.Subscription) {
+	batch := s.FetchBatch
+	if batch <= 0 {
+		batch = defaultFetchBatch
+	}
+
+	timeout := s.FetchTimeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+
+	for {
+		if ctx.Err() != nil || s.isDraining() || !sub.IsValid() {
+			return
+		}
+
+		// bound the fetch by ctx so it returns as soon as leadership is lost
+		fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+		msgs, err := sub.Fetch(batch, nats.Context(fetchCtx))
+
+		cancel()
+
+		if err != nil {
+			switch {
+			case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+				continue
+			case errors.Is(err, nats.ErrBadSubscription), errors.Is(err, nats.ErrConnectionClosed):
+				return
+			}
+
+			s.Logger.Errorw("unable to fetch messages", "error", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(fetchRetryDelay):
+			}
+
+			continue
+		}
+
+		for _, m := range msgs {
+			s.handleMessage(ctx, m)
+		}
+	}
+}
+
+// inProgressInterval returns how often in-flight messages are marked as in
+// progress, well within the ack wait of the consumer
+func (s *Server) inProgressInterval() time.Duration {
+	ackWait := s.AckWait
+	if ackWait <= 0 {
+		ackWait = defaultAckWait
+	}
+
+	return ackWait / 3 //nolint:gomnd
+}
@@ -0,0 +1,200 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.infratographer.com/x/pubsubx"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func newTestJetstream(t *testing.T, stream string, subjects ...string) (*nats.Conn, nats.JetStreamContext, func()) {
+	t.Helper()
+
+	storeDir, err := os.MkdirTemp("", "test-jetstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := utils.StartNATSServer(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tests only using the key-value store or core nats need no stream
+	if stream != "" {
+		if _, err := js.AddStream(&nats.StreamConfig{Name: stream, Subjects: subjects}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return nc, js, func() {
+		nc.Close()
+		ns.Shutdown()
+		os.RemoveAll(storeDir)
+	}
+}
+
+func TestEnsureConsumer(t *testing.T) {
+	type testCase struct {
+		name        string
+		existing    *nats.ConsumerConfig
+		ackWait     time.Duration
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name:    "create consumer",
+			ackWait: 10 * time.Second,
+		},
+		{
+			name: "update consumer",
+			existing: &nats.ConsumerConfig{
+				Durable:       "lbo-workers",
+				AckPolicy:     nats.AckExplicitPolicy,
+				FilterSubject: "lbo.>",
+				AckWait:       time.Minute,
+			},
+			ackWait: 10 * time.Second,
+		},
+		{
+			name: "push consumer",
+			existing: &nats.ConsumerConfig{
+				Durable:        "lbo-workers",
+				AckPolicy:      nats.AckExplicitPolicy,
+				DeliverSubject: "deliver.lbo",
+			},
+			ackWait:     10 * time.Second,
+			expectError: ErrPushConsumer,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, js, cleanup := newTestJetstream(t, "lbo", "lbo.>")
+			defer cleanup()
+
+			if tcase.existing != nil {
+				if _, err := js.AddConsumer("lbo", tcase.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			srv := Server{
+				Logger:          zap.NewNop().Sugar(),
+				JetstreamClient: js,
+				Prefix:          "lbo",
+				StreamName:      "lbo",
+				ConsumerName:    "lbo-workers",
+				AckWait:         tcase.ackWait,
+				MaxDeliver:      3,
+				MaxAckPending:   20,
+			}
+
+			err := srv.ensureConsumer(srv.consumerConfig())
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+
+			info, err := js.ConsumerInfo("lbo", "lbo-workers")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, "lbo.>", info.Config.FilterSubject)
+			assert.Equal(t, tcase.ackWait, info.Config.AckWait)
+			assert.Equal(t, 3, info.Config.MaxDeliver)
+			assert.Equal(t, 20, info.Config.MaxAckPending)
+			assert.Equal(t, nats.AckExplicitPolicy, info.Config.AckPolicy)
+		})
+	}
+}
+
+func TestRunPullConsumer(t *testing.T) {
+	nc, js, cleanup := newTestJetstream(t, "lbo", "lbo.>")
+	defer cleanup()
+
+	viper.Set("healthcheck-port", "127.0.0.1:0")
+	defer viper.Reset()
+
+	evt, err := json.Marshal(pubsubx.Message{
+		SubjectURN: uuid.NewString(),
+		EventType:  "resize",
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// published before the operator starts so it must be picked up from
+	// the durable consumer
+	if _, err := js.Publish("lbo.events", evt); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Context:         context.TODO(),
+		Logger:          zap.NewNop().Sugar(),
+		JetstreamClient: js,
+		NATSClient:      nc,
+		Prefix:          "lbo",
+		StreamName:      "lbo",
+		ConsumerName:    "lbo-workers",
+		FetchBatch:      5,
+		FetchTimeout:    100 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("lbo", "lbo-workers")
+		if err != nil {
+			return false
+		}
+
+		return info.AckFloor.Consumer == 1 && info.NumAckPending == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+
+	assert.Nil(t, srv.Shutdown(shutdownCtx))
+}
+
+func TestConsumerConfigMaxDeliver(t *testing.T) {
+	srv := Server{MaxDeliver: 3}
+	assert.Equal(t, 3, srv.consumerConfig().MaxDeliver)
+
+	// the operator enforces MaxDeliver itself when it dead-letters messages
+	srv.DeadLetterSubject = "lbo.dlq"
+	assert.Equal(t, -1, srv.consumerConfig().MaxDeliver)
+}
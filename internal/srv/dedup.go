@@ -0,0 +1,194 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+
+	"go.infratographer.com/x/pubsubx"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+const (
+	defaultDedupTTL = 24 * time.Hour
+
+	// latestEventKey is the key under each loadbalancer recording the
+	// timestamp of the newest event applied to it
+	latestEventKey = "latest"
+
+	skipDuplicate = "duplicate"
+	skipStale     = "stale"
+)
+
+// eventRecord identifies an event applied to a loadbalancer in the
+// processed event bucket
+type eventRecord struct {
+	loadBalancerID string
+	eventID        string
+	timestamp      time.Time
+}
+
+// key returns the bucket key recording that the event was applied. The event
+// ID is hashed as bucket keys are limited to a few characters.
+func (r eventRecord) key() string {
+	sum := sha256.Sum256([]byte(r.eventID))
+
+	return r.loadBalancerID + "." + hex.EncodeToString(sum[:])
+}
+
+// latestKey returns the bucket key recording the timestamp of the newest
+// event applied to the loadbalancer
+func (r eventRecord) latestKey() string {
+	return r.loadBalancerID + "." + latestEventKey
+}
+
+// ensureDedupBucket binds the key-value bucket processed events are recorded
+// in, creating it when it does not exist yet. Existing buckets are used as
+// they are.
+func (s *Server) ensureDedupBucket() error {
+	if s.DedupBucket == "" || s.processed != nil {
+		return nil
+	}
+
+	kv, err := s.JetstreamClient.KeyValue(s.DedupBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		s.Logger.Infow("creating processed event bucket", "bucket", s.DedupBucket)
+
+		kv, err = s.JetstreamClient.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      s.DedupBucket,
+			Description: "events applied by the loadbalancer operator",
+			History:     1,
+			TTL:         s.dedupTTL(),
+		})
+	}
+
+	if err != nil {
+		s.Logger.Errorw("unable to bind processed event bucket", "bucket", s.DedupBucket, "error", err)
+		return err
+	}
+
+	s.processed = kv
+
+	return nil
+}
+
+// dedupTTL returns how long processed events are remembered
+func (s *Server) dedupTTL() time.Duration {
+	if s.DedupTTL <= 0 {
+		return defaultDedupTTL
+	}
+
+	return s.DedupTTL
+}
+
+// newEventRecord returns the record of a message in the processed event
+// bucket, false when events are not deduplicated or the message is not a
+// loadbalancer event
+func (s *Server) newEventRecord(m *nats.Msg, msg *pubsubx.Message) (eventRecord, bool) {
+	if s.processed == nil {
+		return eventRecord{}, false
+	}
+
+	switch msg.EventType {
+	case events.EVENTCREATE, events.EVENTUPDATE, events.EVENTDELETE:
+	default:
+		return eventRecord{}, false
+	}
+
+	id, ok := msg.AdditionalData["load_balancer_id"].(string)
+	if !ok {
+		return eventRecord{}, false
+	}
+
+	// invalid ids are left for the handlers to reject
+	lbID, err := uuid.Parse(id)
+	if err != nil || lbID == uuid.Nil {
+		return eventRecord{}, false
+	}
+
+	return eventRecord{
+		loadBalancerID: lbID.String(),
+		eventID:        s.eventID(m),
+		timestamp:      msg.Timestamp,
+	}, true
+}
+
+// eventID returns the ID of an event, which is the Nats-Msg-Id jetstream
+// deduplicates publishes by, the source and id of CloudEvents, or otherwise
+// a digest of the payload so that retried publishes of the same event match
+func (s *Server) eventID(m *nats.Msg) string {
+	if id := m.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+
+	if s.eventFormat(m) == EventFormatCloudEvents {
+		if id := cloudEventID(m); id != "" {
+			return id
+		}
+	}
+
+	sum := sha256.Sum256(m.Data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// skipReason returns why an event should not be applied, either because it
+// already has been or because a newer event has been applied to the same
+// loadbalancer. An empty reason means the event should be processed.
+func (s *Server) skipReason(rec eventRecord) (string, error) {
+	_, err := s.processed.Get(rec.key())
+
+	switch {
+	case err == nil:
+		return skipDuplicate, nil
+	case !errors.Is(err, nats.ErrKeyNotFound):
+		return "", err
+	}
+
+	if rec.timestamp.IsZero() {
+		return "", nil
+	}
+
+	entry, err := s.processed.Get(rec.latestKey())
+
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	latest, err := time.Parse(time.RFC3339Nano, string(entry.Value()))
+	if err != nil {
+		s.Logger.Warnw("ignoring unreadable latest event timestamp", "key", rec.latestKey(), "error", err)
+		return "", nil
+	}
+
+	if rec.timestamp.Before(latest) {
+		return skipStale, nil
+	}
+
+	return "", nil
+}
+
+// recordEvent marks an event as applied. Events for a loadbalancer are
+// processed one at a time and stale events are skipped, so the timestamp of
+// an applied event is always the newest.
+func (s *Server) recordEvent(rec eventRecord) error {
+	if _, err := s.processed.Put(rec.key(), []byte(time.Now().UTC().Format(time.RFC3339Nano))); err != nil {
+		return err
+	}
+
+	if rec.timestamp.IsZero() {
+		return nil
+	}
+
+	_, err := s.processed.Put(rec.latestKey(), []byte(rec.timestamp.UTC().Format(time.RFC3339Nano)))
+
+	return err
+}
@@ -0,0 +1,165 @@
+package srv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/client-go/rest"
+
+	"go.infratographer.com/x/pubsubx"
+)
+
+func TestEventID(t *testing.T) {
+	type testCase struct {
+		name     string
+		header   nats.Header
+		data     string
+		expected string
+	}
+
+	payload := `{"event_type":"create","additional_data":{}}`
+	digest := sha256.Sum256([]byte(payload))
+
+	testCases := []testCase{
+		{
+			name:     "message id",
+			header:   nats.Header{nats.MsgIdHdr: []string{"event-1"}},
+			data:     payload,
+			expected: "event-1",
+		},
+		{
+			name:     "binary cloudevent",
+			header:   nats.Header{"ce-specversion": []string{"1.0"}, "ce-id": []string{"1"}, "ce-source": []string{"loadbalancerapi"}},
+			data:     `{}`,
+			expected: "loadbalancerapi/1",
+		},
+		{
+			name:     "structured cloudevent",
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"create"}`,
+			expected: "loadbalancerapi/1",
+		},
+		{
+			name:     "message id takes precedence",
+			header:   nats.Header{nats.MsgIdHdr: []string{"event-1"}},
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"create"}`,
+			expected: "event-1",
+		},
+		{
+			name:     "payload digest",
+			data:     payload,
+			expected: hex.EncodeToString(digest[:]),
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := &Server{}
+			assert.Equal(t, tcase.expected, srv.eventID(&nats.Msg{Header: tcase.header, Data: []byte(tcase.data)}))
+		})
+	}
+}
+
+func TestRouteMessageDedup(t *testing.T) {
+	_, js, cleanup := newTestJetstream(t, "")
+	defer cleanup()
+
+	srv := &Server{
+		Context:         context.TODO(),
+		Logger:          zap.NewNop().Sugar(),
+		KubeClient:      &rest.Config{Host: "http://127.0.0.1:1", Timeout: time.Second},
+		JetstreamClient: js,
+		DedupBucket:     "test-processed-events",
+		DedupTTL:        time.Hour,
+	}
+
+	if err := srv.ensureDedupBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	lbID := uuid.New()
+	applied := time.Now()
+
+	newMsg := func(eventType string, msgID string, ts time.Time) *nats.Msg {
+		data, err := json.Marshal(pubsubx.Message{
+			SubjectURN:     uuid.NewString(),
+			EventType:      eventType,
+			Timestamp:      ts,
+			AdditionalData: map[string]interface{}{"load_balancer_id": lbID, "location_id": uuid.New()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &nats.Msg{Header: nats.Header{nats.MsgIdHdr: []string{msgID}}, Data: data}
+	}
+
+	// record an event as already applied
+	rec, ok := srv.newEventRecord(newMsg("update", "applied", applied), &pubsubx.Message{
+		EventType:      "update",
+		Timestamp:      applied,
+		AdditionalData: map[string]interface{}{"load_balancer_id": lbID.String()},
+	})
+	if !assert.True(t, ok) {
+		return
+	}
+
+	if err := srv.recordEvent(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name        string
+		msg         *nats.Msg
+		expectSkip  string
+		expectError bool
+	}
+
+	testCases := []testCase{
+		{
+			name:       "duplicate event",
+			msg:        newMsg("update", "applied", applied),
+			expectSkip: skipDuplicate,
+		},
+		{
+			name:       "older event",
+			msg:        newMsg("update", "older", applied.Add(-time.Minute)),
+			expectSkip: skipStale,
+		},
+		{
+			name:        "newer event",
+			msg:         newMsg("update", "newer", applied.Add(time.Minute)),
+			expectError: true,
+		},
+		{
+			name:        "event without timestamp",
+			msg:         newMsg("update", "untimed", time.Time{}),
+			expectError: true,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			skipped := testutil.ToFloat64(eventsSkipped.WithLabelValues(tcase.expectSkip))
+
+			// the cluster is unreachable, so events that are processed fail
+			_, err := srv.routeMessage(context.TODO(), tcase.msg)
+
+			if tcase.expectError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, skipped+1, testutil.ToFloat64(eventsSkipped.WithLabelValues(tcase.expectSkip)))
+		})
+	}
+}
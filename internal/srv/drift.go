@@ -0,0 +1,473 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/resource"
+
+	lbv1alpha1 "go.infratographer.com/loadbalanceroperator/pkg/api/v1alpha1"
+)
+
+const (
+	driftChart    = "chart"
+	driftValues   = "values"
+	driftMissing  = "missing_resource"
+	driftModified = "modified_resource"
+
+	// releasePrefix is the prefix of every release created by newReleaseName
+	releasePrefix = "lb-"
+)
+
+// reconcileDrift checks every deployed loadbalancer release for drift from
+// its desired state on each ReconcileInterval until ctx is cancelled
+func (s *Server) reconcileDrift(ctx context.Context) {
+	if s.ReconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.isDraining() {
+			return
+		}
+
+		if err := s.reconcileReleases(ctx); err != nil {
+			s.Logger.Errorw("unable to reconcile loadbalancer releases", "error", err)
+		}
+	}
+}
+
+// reconcileReleases queues a drift check for every deployed loadbalancer
+// release across all namespaces of every cluster. An unreachable cluster does
+// not stop the remaining clusters from being checked, the first error is
+// returned once all have been visited.
+func (s *Server) reconcileReleases(ctx context.Context) error {
+	var firstErr error
+
+	for _, clusterCtx := range s.clusterContexts(ctx) {
+		if err := s.reconcileClusterReleases(clusterCtx); err != nil {
+			s.Logger.Errorw("unable to list loadbalancer releases", "cluster", s.cluster(clusterCtx).Name, "error", err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// reconcileClusterReleases queues a drift check for every deployed
+// loadbalancer release in the cluster ctx is directed at
+func (s *Server) reconcileClusterReleases(ctx context.Context) error {
+	client, err := s.newHelmClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	lst := action.NewList(client)
+	lst.AllNamespaces = true
+	lst.Filter = "^" + releasePrefix
+	lst.StateMask = action.ListDeployed
+
+	releases, err := lst.Run()
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Debugf("checking %d loadbalancer releases for drift", len(releases))
+
+	for _, rel := range releases {
+		s.enqueueDriftCheck(ctx, rel.Name, rel.Namespace)
+	}
+
+	return nil
+}
+
+// enqueueDriftCheck checks a release for drift on the worker pool, serialized
+// with any events being processed for the same loadbalancer
+func (s *Server) enqueueDriftCheck(ctx context.Context, releaseName string, namespace string) {
+	if !s.startMessage(ctx) {
+		return
+	}
+
+	job := func() {
+		defer s.inFlight.Done()
+
+		if s.stopping(ctx) {
+			return
+		}
+
+		if err := s.repairDrift(ctx, releaseName, namespace); err != nil {
+			s.Logger.Errorw("unable to repair drift", "release", releaseName, "namespace", namespace, "error", err)
+		}
+	}
+
+	if s.pool == nil {
+		job()
+		return
+	}
+
+	s.pool.submit(releaseLoadBalancerID(releaseName), job)
+}
+
+// repairDrift upgrades a deployed release when its chart, values or resources
+// no longer match the desired state
+func (s *Server) repairDrift(ctx context.Context, releaseName string, namespace string) (err error) {
+	ctx, span := tracer.Start(ctx, "repairDrift", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", namespace),
+		attribute.String("loadbalanceroperator.release", releaseName),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	client, err := s.newHelmClient(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	s.chartMu.RLock()
+	defer s.chartMu.RUnlock()
+
+	// the release may have changed since it was listed
+	rel, err := client.Releases.Last(releaseName)
+	if err != nil {
+		return err
+	}
+
+	if rel.Info.Status != release.StatusDeployed {
+		return nil
+	}
+
+	overrides, err := s.desiredOverrides(ctx, rel)
+	if err != nil {
+		return err
+	}
+
+	ch, values, err := s.releaseConfig(ctx, overrides)
+	if err != nil {
+		return err
+	}
+
+	reasons, err := s.detectDrift(client, rel, ch, values)
+	if err != nil {
+		return err
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	for _, reason := range reasons {
+		driftDetected.WithLabelValues(reason).Inc()
+	}
+
+	span.SetAttributes(attribute.StringSlice("loadbalanceroperator.drift", reasons))
+	s.Logger.Warnw("drift detected, upgrading release", "release", releaseName, "namespace", namespace, "drift", reasons)
+
+	err = s.upgradeRelease(client, ch, releaseName, namespace, values)
+	driftRepairs.WithLabelValues(resultLabel(err)).Inc()
+
+	return err
+}
+
+// desiredOverrides returns the overrides a release should be deployed with.
+// They are taken from the LoadBalancer resource when custom resources are
+// enabled, otherwise the overrides recorded for the release are reapplied.
+// Releases deployed before overrides were recorded fall back to reading them
+// from their values.
+func (s *Server) desiredOverrides(ctx context.Context, rel *release.Release) ([]valueSet, error) {
+	overrides, ok, err := recordedOverrides(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		overrides = s.configOverrides(rel.Config)
+	}
+
+	if s.UseCustomResources && s.lbClient != nil {
+		lb := &lbv1alpha1.LoadBalancer{}
+
+		err := s.lbClient.Get(ctx, loadBalancerKey(rel.Namespace, releaseLoadBalancerID(rel.Name)), lb)
+
+		switch {
+		case err == nil:
+			lbdata := loadBalancerData(lb)
+
+			mapped, err := decodeValues(lb.Spec.Values)
+			if err != nil {
+				return nil, err
+			}
+
+			desired := newHelmOverrides(&lbdata)
+
+			// the fetched definition is kept from the release rather than
+			// fetched again on every check
+			for _, override := range overrides {
+				if s.QueryEnabled && override.helmKey == s.queryValuesKey() {
+					desired = append(desired, override)
+				}
+			}
+
+			overrides = append(desired, mapped...)
+		case !apierrors.IsNotFound(err):
+			return nil, err
+		}
+	}
+
+	return overrides, nil
+}
+
+// configOverrides recovers the overrides of a release deployed before they
+// were recorded from its values
+func (s *Server) configOverrides(config map[string]interface{}) []valueSet {
+	overrides := append(releaseOverrides(config), s.ValueMapper.releaseValues(config)...)
+
+	// the parts of v1alpha2 event data without a v1alpha1 equivalent
+	if value, ok := lookupValue(config, s.eventValuesKey()); ok {
+		overrides = append(overrides, valueSet{helmKey: s.eventValuesKey(), data: value})
+	}
+
+	if s.QueryEnabled {
+		if spec, ok := lookupValue(config, s.queryValuesKey()); ok {
+			overrides = append(overrides, valueSet{helmKey: s.queryValuesKey(), data: spec})
+		}
+	}
+
+	return overrides
+}
+
+// detectDrift returns the ways in which a release differs from the desired
+// chart and values and the resources deployed in the cluster
+func (s *Server) detectDrift(client *action.Configuration, rel *release.Release, ch *chart.Chart, values map[string]interface{}) ([]string, error) {
+	reasons := []string{}
+
+	if !chartMatches(rel, ch) {
+		reasons = append(reasons, driftChart)
+	}
+
+	if !valuesEqual(rel.Config, values) {
+		reasons = append(reasons, driftValues)
+	}
+
+	resources, err := client.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return nil, err
+	}
+
+	missing, modified := false, false
+
+	for _, info := range resources {
+		live, err := resource.NewHelper(info.Client, info.Mapping).Get(info.Namespace, info.Name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				s.Logger.Debugw("release resource is missing", "release", rel.Name, "resource", info.ObjectName())
+				missing = true
+
+				continue
+			}
+
+			return nil, err
+		}
+
+		if !objectMatches(info.Object, live) {
+			s.Logger.Debugw("release resource has been modified", "release", rel.Name, "resource", info.ObjectName())
+			modified = true
+		}
+	}
+
+	if missing {
+		reasons = append(reasons, driftMissing)
+	}
+
+	if modified {
+		reasons = append(reasons, driftModified)
+	}
+
+	return reasons, nil
+}
+
+// releaseOverrides recovers the resource overrides a release was deployed
+// with from its values
+func releaseOverrides(config map[string]interface{}) []valueSet {
+	overrides := []valueSet{}
+
+	for _, key := range append(viper.GetStringSlice("helm-cpu-flag"), viper.GetStringSlice("helm-memory-flag")...) {
+		if value, ok := lookupValue(config, key); ok {
+			overrides = append(overrides, valueSet{
+				helmKey: key,
+				value:   fmt.Sprint(value),
+			})
+		}
+	}
+
+	return overrides
+}
+
+// lookupValue returns the value at a dotted path in a set of chart values
+func lookupValue(values map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = values
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// releaseLoadBalancerID returns the loadbalancer ID a release was created
+// for, falling back to the release name when it cannot be recovered
+func releaseLoadBalancerID(releaseName string) string {
+	idLength := len(uuid.Nil.String())
+
+	if strings.HasPrefix(releaseName, releasePrefix) && len(releaseName) >= len(releasePrefix)+idLength {
+		if id, err := uuid.Parse(releaseName[len(releasePrefix) : len(releasePrefix)+idLength]); err == nil {
+			return id.String()
+		}
+	}
+
+	return releaseName
+}
+
+// objectMatches reports whether every field rendered in a release manifest
+// is still set to the same value on the live object. Fields added by the API
+// server, such as defaults and status, are ignored.
+func objectMatches(desired runtime.Object, live runtime.Object) bool {
+	d, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return false
+	}
+
+	l, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return false
+	}
+
+	// status is owned by the cluster and secrets return stringData as data
+	for _, field := range []string{"status", "stringData"} {
+		unstructured.RemoveNestedField(d, field)
+	}
+
+	return fieldsMatch(d, l)
+}
+
+// fieldsMatch reports whether desired is contained in live
+func fieldsMatch(desired interface{}, live interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return len(d) == 0 && live == nil
+		}
+
+		for key, value := range d {
+			lv, ok := l[key]
+			if !ok {
+				if isZero(value) {
+					continue
+				}
+
+				return false
+			}
+
+			if !fieldsMatch(value, lv) {
+				return false
+			}
+		}
+
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok {
+			return len(d) == 0 && live == nil
+		}
+
+		if len(d) != len(l) {
+			return false
+		}
+
+		for i := range d {
+			if !fieldsMatch(d[i], l[i]) {
+				return false
+			}
+		}
+
+		return true
+	case nil:
+		return true
+	default:
+		return scalarsMatch(desired, live)
+	}
+}
+
+// scalarsMatch compares two scalar values, treating resource quantities and
+// numbers of different types as equal when they have the same value
+func scalarsMatch(desired interface{}, live interface{}) bool {
+	if reflect.DeepEqual(desired, live) {
+		return true
+	}
+
+	ds, dok := desired.(string)
+	ls, lok := live.(string)
+
+	if dok && lok {
+		dq, derr := apiresource.ParseQuantity(ds)
+		lq, lerr := apiresource.ParseQuantity(ls)
+
+		return derr == nil && lerr == nil && dq.Cmp(lq) == 0
+	}
+
+	return fmt.Sprint(desired) == fmt.Sprint(live)
+}
+
+// isZero reports whether a rendered value is empty and may be omitted by the
+// API server
+func isZero(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
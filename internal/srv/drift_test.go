@@ -0,0 +1,328 @@
+package srv
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func TestDetectDrift(t *testing.T) {
+	type testCase struct {
+		name         string
+		chartVersion string
+		values       map[string]interface{}
+		expected     []string
+	}
+
+	testDir, err := os.MkdirTemp("", "test-detect-drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := map[string]interface{}{"resources": map[string]interface{}{"cpu": "100m"}}
+
+	testCases := []testCase{
+		{
+			name:     "no drift",
+			values:   current,
+			expected: []string{},
+		},
+		{
+			name:     "values drifted",
+			values:   map[string]interface{}{"resources": map[string]interface{}{"cpu": "200m"}},
+			expected: []string{driftValues},
+		},
+		{
+			name:         "chart drifted",
+			chartVersion: "0.0.0-old",
+			values:       current,
+			expected:     []string{driftChart},
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Logger: zap.NewNop().Sugar(),
+				Chart:  ch,
+			}
+
+			relChart := ch
+			if tcase.chartVersion != "" {
+				relChart = &chart.Chart{Metadata: &chart.Metadata{Name: ch.Metadata.Name, Version: tcase.chartVersion}}
+			}
+
+			rel := &release.Release{
+				Name:      newReleaseName("lb", "test"),
+				Namespace: "test",
+				Version:   1,
+				Chart:     relChart,
+				Config:    current,
+				Info:      &release.Info{Status: release.StatusDeployed},
+			}
+
+			reasons, err := srv.detectDrift(utils.NewTestHelmConfig(), rel, ch, tcase.values)
+			assert.Nil(t, err)
+			assert.Equal(t, tcase.expected, reasons)
+		})
+	}
+}
+
+func TestObjectMatches(t *testing.T) {
+	type testCase struct {
+		name     string
+		desired  map[string]interface{}
+		live     map[string]interface{}
+		expected bool
+	}
+
+	deployment := func(replicas int64, cpu string) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "lb"},
+			"spec": map[string]interface{}{
+				"replicas": replicas,
+				"template": map[string]interface{}{
+					"spec": map[string]interface{}{
+						"containers": []interface{}{
+							map[string]interface{}{
+								"name":      "lb",
+								"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": cpu}},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	defaulted := deployment(2, "500m")
+	defaulted["status"] = map[string]interface{}{"readyReplicas": int64(2)}
+	defaulted["metadata"].(map[string]interface{})["uid"] = "1234"
+	defaulted["spec"].(map[string]interface{})["strategy"] = map[string]interface{}{"type": "RollingUpdate"}
+
+	removedContainer := deployment(2, "500m")
+	removedContainer["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"] = []interface{}{}
+
+	testCases := []testCase{
+		{
+			name:     "identical",
+			desired:  deployment(2, "500m"),
+			live:     deployment(2, "500m"),
+			expected: true,
+		},
+		{
+			name:     "fields added by the cluster",
+			desired:  deployment(2, "500m"),
+			live:     defaulted,
+			expected: true,
+		},
+		{
+			name:     "equivalent quantities",
+			desired:  deployment(2, "0.5"),
+			live:     deployment(2, "500m"),
+			expected: true,
+		},
+		{
+			name:     "modified field",
+			desired:  deployment(2, "500m"),
+			live:     deployment(1, "500m"),
+			expected: false,
+		},
+		{
+			name:     "modified quantity",
+			desired:  deployment(2, "500m"),
+			live:     deployment(2, "1"),
+			expected: false,
+		},
+		{
+			name:     "removed list item",
+			desired:  deployment(2, "500m"),
+			live:     removedContainer,
+			expected: false,
+		},
+		{
+			name: "secret string data",
+			desired: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   map[string]interface{}{"name": "lb", "labels": map[string]interface{}{}},
+				"stringData": map[string]interface{}{"key": "value"},
+			},
+			live: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   map[string]interface{}{"name": "lb"},
+				"data":       map[string]interface{}{"key": "dmFsdWU="},
+			},
+			expected: true,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			desired := &unstructured.Unstructured{Object: tcase.desired}
+			live := &unstructured.Unstructured{Object: tcase.live}
+
+			assert.Equal(t, tcase.expected, objectMatches(desired, live))
+		})
+	}
+}
+
+func TestReleaseOverrides(t *testing.T) {
+	viper.Set("helm-cpu-flag", []string{"resources.limits.cpu", "resources.requests.cpu"})
+	viper.Set("helm-memory-flag", []string{"resources.limits.memory"})
+
+	defer viper.Reset()
+
+	config := map[string]interface{}{
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{
+				"cpu":    "500m",
+				"memory": "1Gi",
+			},
+		},
+		"replicas": 2,
+	}
+
+	assert.ElementsMatch(t, []valueSet{
+		{helmKey: "resources.limits.cpu", value: "500m"},
+		{helmKey: "resources.limits.memory", value: "1Gi"},
+	}, releaseOverrides(config))
+}
+
+func TestDesiredOverrides(t *testing.T) {
+	viper.Set("helm-cpu-flag", []string{"resources.limits.cpu"})
+	viper.Set("helm-memory-flag", []string{"resources.limits.memory"})
+
+	defer viper.Reset()
+
+	srv := &Server{
+		Logger: zap.NewNop().Sugar(),
+		values: map[string]interface{}{
+			"replicas": 1,
+			"resources": map[string]interface{}{
+				"limits": map[string]interface{}{"cpu": "1", "memory": "2Gi"},
+			},
+		},
+	}
+
+	// deployed when the values file set replicas to 2 and the memory limit
+	// to 1Gi, with only the cpu limit set by the event
+	config := map[string]interface{}{
+		"replicas": 2,
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "500m", "memory": "1Gi"},
+		},
+		"event": map[string]interface{}{
+			"labels": map[string]interface{}{"tier": "edge"},
+		},
+	}
+
+	recorded, err := recordOverrides(&chart.Chart{Metadata: &chart.Metadata{Name: "lb"}}, []valueSet{
+		{helmKey: "resources.limits.cpu", value: "500m"},
+		{helmKey: "resources.limits.memory", value: ""},
+		{helmKey: "event", data: map[string]interface{}{
+			"labels": map[string]interface{}{"tier": "edge"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name     string
+		release  *release.Release
+		expected map[string]interface{}
+	}
+
+	testCases := []testCase{
+		{
+			name:    "recorded overrides are applied to the current values",
+			release: &release.Release{Chart: recorded, Config: config},
+			expected: map[string]interface{}{
+				"replicas": 1,
+				"resources": map[string]interface{}{
+					"limits": map[string]interface{}{"cpu": "500m", "memory": "2Gi"},
+				},
+				"event": map[string]interface{}{
+					"labels": map[string]interface{}{"tier": "edge"},
+				},
+			},
+		},
+		{
+			name:    "overrides are read from the values of releases without a record",
+			release: &release.Release{Config: config},
+			expected: map[string]interface{}{
+				"replicas": 1,
+				"resources": map[string]interface{}{
+					"limits": map[string]interface{}{"cpu": "500m", "memory": "1Gi"},
+				},
+				"event": map[string]interface{}{
+					"labels": map[string]interface{}{"tier": "edge"},
+				},
+			},
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			overrides, err := srv.desiredOverrides(context.Background(), tcase.release)
+			assert.Nil(t, err)
+
+			values, err := srv.newHelmValues(context.Background(), overrides)
+			assert.Nil(t, err)
+			assert.True(t, valuesEqual(tcase.expected, values), values)
+		})
+	}
+}
+
+func TestReleaseLoadBalancerID(t *testing.T) {
+	type testCase struct {
+		name        string
+		releaseName string
+		expected    string
+	}
+
+	testCases := []testCase{
+		{
+			name:        "truncated release name",
+			releaseName: newReleaseName("7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43", "a-very-long-namespace-name-for-testing"),
+			expected:    "7f4f0f8e-2d9c-4f5a-9a43-2c7a6f0f1f43",
+		},
+		{
+			name:        "not a loadbalancer release",
+			releaseName: "lb-example",
+			expected:    "lb-example",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, releaseLoadBalancerID(tcase.releaseName))
+		})
+	}
+}
@@ -1,8 +1,61 @@
 package srv
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrPortsRequired is returned when a healthcheck port has not been provided
 	ErrPortsRequired = errors.New("no ports provided")
+	// ErrInvalidEvent is returned when an event cannot be processed and will
+	// never succeed on redelivery
+	ErrInvalidEvent = errors.New("invalid event")
+	// ErrPushConsumer is returned when the configured consumer exists as a
+	// push consumer and cannot be pulled from
+	ErrPushConsumer = errors.New("consumer exists as a push consumer")
+	// ErrLeaseNamespace is returned when leader election is enabled without
+	// a namespace to hold the lease in
+	ErrLeaseNamespace = errors.New("leader election requires a lease namespace")
+	// ErrLeaseWaitTimeout is returned when the leader lease could not be
+	// acquired within LeaseWaitTimeout
+	ErrLeaseWaitTimeout = errors.New("timed out waiting for the leader lease")
+	// ErrFleetUpgradeHalted is returned when a fleet upgrade stops after more
+	// releases failed than allowed
+	ErrFleetUpgradeHalted = errors.New("fleet upgrade halted")
+	// ErrUnknownLocation is returned when an event is for a location that no
+	// cluster has been configured for
+	ErrUnknownLocation = errors.New("no cluster configured for location")
+	// ErrClusterConfig is returned when a cluster has no configuration to
+	// connect to it with
+	ErrClusterConfig = errors.New("cluster has no kubernetes configuration")
+	// ErrQueryFailed is returned when the loadbalancer definition could not
+	// be fetched from its QueryURL and the request may succeed when retried
+	ErrQueryFailed = errors.New("unable to fetch loadbalancer definition")
+	// ErrNamespaceTerminating is returned when a loadbalancer is deployed to
+	// a namespace that is still being removed, the event is retried
+	ErrNamespaceTerminating = errors.New("namespace is being terminated")
+	// ErrQueryURLNotAllowed is returned when the QueryURL of an event is not
+	// under one of the allowed urls, the event is never retried
+	ErrQueryURLNotAllowed = fmt.Errorf("%w: query url is not allowed", ErrInvalidEvent)
+	// ErrInvalidValueMapping is returned when a value mapping cannot be used
+	// or a value cannot be converted to the type of its mapping
+	ErrInvalidValueMapping = errors.New("invalid value mapping")
+	// ErrValueKeyNotAllowed is returned when a value mapping sets a chart
+	// values key that is not in the allowed keys
+	ErrValueKeyNotAllowed = errors.New("chart values key is not allowed")
+	// ErrLoadBalancerIDRequired is returned when an event has no loadbalancer ID
+	ErrLoadBalancerIDRequired = errors.New("load balancer id is required")
+	// ErrLocationIDRequired is returned when an event deploying a loadbalancer
+	// has no location ID
+	ErrLocationIDRequired = errors.New("location id is required")
+	// ErrResourceRequired is returned when an event deploying a loadbalancer
+	// has no CPU or memory
+	ErrResourceRequired = errors.New("resource quantity is required")
+	// ErrInvalidQuantity is returned when the CPU or memory of an event is not
+	// a kubernetes resource quantity
+	ErrInvalidQuantity = errors.New("invalid resource quantity")
+	// ErrQuantityOutOfBounds is returned when the CPU or memory of an event is
+	// outside of the configured bounds
+	ErrQuantityOutOfBounds = errors.New("resource quantity out of bounds")
 )
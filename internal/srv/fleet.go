@@ -0,0 +1,371 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+const (
+	defaultFleetBatchSize = 5
+	defaultFleetTimeout   = 5 * time.Minute
+
+	fleetUpgraded   = "upgraded"
+	fleetSkipped    = "skipped"
+	fleetFailed     = "failed"
+	fleetRolledBack = "rolled_back"
+	fleetPending    = "pending"
+)
+
+// FleetUpgradeOptions controls how UpgradeFleet rolls out the loaded chart
+type FleetUpgradeOptions struct {
+	// BatchSize is the number of releases upgraded at the same time
+	BatchSize int
+	// MaxFailures is the number of failed releases tolerated before the
+	// upgrade is halted
+	MaxFailures int
+	// Rollback rolls the failed releases of the halting batch back to the
+	// revision they were on before the upgrade
+	Rollback bool
+	// Timeout is how long each release is given to become ready
+	Timeout time.Duration
+}
+
+// FleetUpgradeResult lists the releases, as namespace/name, by the outcome
+// of a fleet upgrade
+type FleetUpgradeResult struct {
+	Upgraded   []string
+	Skipped    []string
+	Failed     []string
+	RolledBack []string
+	// Pending releases were not attempted because the upgrade was halted
+	Pending []string
+}
+
+// helmClientFunc returns the helm configuration for the cluster and namespace
+// of a release
+type helmClientFunc func(rel *release.Release) (*action.Configuration, error)
+
+// UpgradeFleet upgrades every loadbalancer release to the loaded chart and
+// values in batches, waiting for each batch to become ready before moving
+// on. Releases that already match are skipped. Once more than MaxFailures
+// releases have failed the upgrade halts with ErrFleetUpgradeHalted.
+func (s *Server) UpgradeFleet(ctx context.Context, opts FleetUpgradeOptions) (*FleetUpgradeResult, error) {
+	if s.UseCustomResources && s.lbClient == nil {
+		lbClient, err := newLoadBalancerClient(s.KubeClient)
+		if err != nil {
+			s.Logger.Errorw("unable to create loadbalancer resource client", "error", err)
+			return nil, err
+		}
+
+		s.lbClient = lbClient
+	}
+
+	if _, err := s.reloadChart(); err != nil {
+		s.Logger.Errorw("unable to load chart", "error", err)
+		return nil, err
+	}
+
+	return s.upgradeDeployedReleases(ctx, opts)
+}
+
+// upgradeDeployedReleases upgrades the loadbalancer releases of every cluster
+// to the loaded chart and values in batches as described by UpgradeFleet
+func (s *Server) upgradeDeployedReleases(ctx context.Context, opts FleetUpgradeOptions) (*FleetUpgradeResult, error) {
+	releases := []*release.Release{}
+	clusters := map[*release.Release]context.Context{}
+
+	for _, clusterCtx := range s.clusterContexts(ctx) {
+		client, err := s.newHelmClient(clusterCtx, "")
+		if err != nil {
+			return nil, err
+		}
+
+		lst := action.NewList(client)
+		lst.AllNamespaces = true
+		lst.Filter = "^" + releasePrefix
+		lst.StateMask = action.ListDeployed | action.ListFailed
+
+		listed, err := lst.Run()
+		if err != nil {
+			s.Logger.Errorw("unable to list loadbalancer releases", "error", err)
+			return nil, err
+		}
+
+		for _, rel := range listed {
+			clusters[rel] = clusterCtx
+		}
+
+		releases = append(releases, listed...)
+	}
+
+	return s.upgradeReleases(ctx, releases, opts, func(rel *release.Release) (*action.Configuration, error) {
+		return s.newHelmClient(clusters[rel], rel.Namespace)
+	})
+}
+
+// upgradeReleases upgrades releases in batches as described by UpgradeFleet
+func (s *Server) upgradeReleases(ctx context.Context, releases []*release.Release, opts FleetUpgradeOptions, clientFor helmClientFunc) (*FleetUpgradeResult, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultFleetBatchSize
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultFleetTimeout
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		return releaseRef(releases[i]) < releaseRef(releases[j])
+	})
+
+	result := &FleetUpgradeResult{}
+	batches := (len(releases) + opts.BatchSize - 1) / opts.BatchSize
+
+	s.Logger.Infow("starting fleet upgrade", "releases", len(releases), "batches", batches, "batch_size", opts.BatchSize)
+	fleetUpgradeRemaining.Set(float64(len(releases)))
+
+	for start := 0; start < len(releases); start += opts.BatchSize {
+		end := start + opts.BatchSize
+		if end > len(releases) {
+			end = len(releases)
+		}
+
+		batch := start/opts.BatchSize + 1
+
+		if err := ctx.Err(); err != nil {
+			result.Pending = append(result.Pending, releaseRefs(releases[start:])...)
+			return result, err
+		}
+
+		s.Logger.Infow("upgrading batch", "batch", batch, "batches", batches, "releases", releaseRefs(releases[start:end]))
+
+		outcomes := s.upgradeBatch(ctx, releases[start:end], opts, clientFor)
+		failed := []*release.Release{}
+
+		for i, outcome := range outcomes {
+			rel := releases[start+i]
+
+			switch outcome {
+			case fleetUpgraded:
+				result.Upgraded = append(result.Upgraded, releaseRef(rel))
+			case fleetSkipped:
+				result.Skipped = append(result.Skipped, releaseRef(rel))
+			case fleetPending:
+				result.Pending = append(result.Pending, releaseRef(rel))
+			default:
+				result.Failed = append(result.Failed, releaseRef(rel))
+				failed = append(failed, rel)
+			}
+		}
+
+		fleetUpgradeRemaining.Set(float64(len(releases) - end))
+
+		if err := ctx.Err(); err != nil {
+			result.Pending = append(result.Pending, releaseRefs(releases[end:])...)
+			return result, err
+		}
+
+		s.Logger.Infow("batch complete", "batch", batch, "batches", batches,
+			"upgraded", len(result.Upgraded), "skipped", len(result.Skipped), "failed", len(result.Failed))
+
+		if len(result.Failed) <= opts.MaxFailures {
+			continue
+		}
+
+		if opts.Rollback {
+			for _, rel := range failed {
+				if err := s.rollbackFleetRelease(clientFor, rel, opts.Timeout); err != nil {
+					s.Logger.Errorw("unable to roll back release", "release", rel.Name, "namespace", rel.Namespace, "error", err)
+					continue
+				}
+
+				result.RolledBack = append(result.RolledBack, releaseRef(rel))
+			}
+		}
+
+		result.Pending = append(result.Pending, releaseRefs(releases[end:])...)
+
+		s.Logger.Errorw("halting fleet upgrade", "batch", batch, "failed", result.Failed, "max_failures", opts.MaxFailures)
+
+		return result, fmt.Errorf("%w: %d releases failed", ErrFleetUpgradeHalted, len(result.Failed))
+	}
+
+	s.Logger.Infow("fleet upgrade complete", "upgraded", len(result.Upgraded), "skipped", len(result.Skipped), "failed", len(result.Failed))
+
+	return result, nil
+}
+
+// upgradeBatch upgrades a batch of releases concurrently and returns the
+// outcome of each. Within the operator every release is upgraded on the
+// worker pool, serialized with events for the same loadbalancer, and releases
+// whose upgrade has not started once leadership is lost are left pending.
+func (s *Server) upgradeBatch(ctx context.Context, releases []*release.Release, opts FleetUpgradeOptions, clientFor helmClientFunc) []string {
+	outcomes := make([]string, len(releases))
+
+	var wg sync.WaitGroup
+
+	for i, rel := range releases {
+		i, rel := i, rel
+
+		wg.Add(1)
+
+		upgrade := func() {
+			defer wg.Done()
+
+			outcome, current, err := s.upgradeFleetRelease(ctx, clientFor, rel, opts.Timeout)
+			if err != nil {
+				s.Logger.Errorw("unable to upgrade release", "release", rel.Name, "namespace", rel.Namespace, "error", err)
+			}
+
+			// failed releases are rolled back to the revision the upgrade
+			// started from rather than the one that was listed
+			if current != nil {
+				releases[i] = current
+			}
+
+			fleetUpgradeReleases.WithLabelValues(outcome).Inc()
+			outcomes[i] = outcome
+		}
+
+		if s.pool == nil {
+			go upgrade()
+			continue
+		}
+
+		if !s.startMessage(ctx) {
+			outcomes[i] = fleetPending
+
+			wg.Done()
+
+			continue
+		}
+
+		s.pool.submit(releaseLoadBalancerID(rel.Name), func() {
+			defer s.inFlight.Done()
+
+			if s.stopping(ctx) {
+				outcomes[i] = fleetPending
+
+				wg.Done()
+
+				return
+			}
+
+			upgrade()
+		})
+	}
+
+	wg.Wait()
+
+	return outcomes
+}
+
+// upgradeFleetRelease upgrades a single release and waits for it to become
+// ready, skipping releases that already match the loaded chart and values.
+// The release is read again first, as it may have been changed or removed
+// since it was listed, and the release the upgrade started from is returned.
+func (s *Server) upgradeFleetRelease(ctx context.Context, clientFor helmClientFunc, rel *release.Release, timeout time.Duration) (string, *release.Release, error) {
+	client, err := clientFor(rel)
+	if err != nil {
+		return fleetFailed, nil, err
+	}
+
+	rel, err = client.Releases.Last(rel.Name)
+	if err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return fleetSkipped, nil, nil
+		}
+
+		return fleetFailed, nil, err
+	}
+
+	if rel.Info.Status != release.StatusDeployed && rel.Info.Status != release.StatusFailed {
+		s.Logger.Debugw("release no longer deployed", "release", rel.Name, "namespace", rel.Namespace, "status", rel.Info.Status.String())
+		return fleetSkipped, rel, nil
+	}
+
+	overrides, err := s.desiredOverrides(ctx, rel)
+	if err != nil {
+		return fleetFailed, rel, err
+	}
+
+	// the lock is only held to prepare the release, a reload swaps the chart
+	// rather than changing it so the copy stays valid during the upgrade
+	s.chartMu.RLock()
+	ch, values, err := s.releaseConfig(ctx, overrides)
+	s.chartMu.RUnlock()
+
+	if err != nil {
+		return fleetFailed, rel, err
+	}
+
+	if rel.Info.Status == release.StatusDeployed && releaseMatches(rel, ch, values) {
+		s.Logger.Debugw("release already up to date", "release", rel.Name, "namespace", rel.Namespace)
+		return fleetSkipped, rel, nil
+	}
+
+	hc := action.NewUpgrade(client)
+	hc.Namespace = rel.Namespace
+	hc.Wait = true
+	hc.Timeout = timeout
+
+	start := time.Now()
+	_, err = hc.RunWithContext(ctx, rel.Name, ch, values)
+	helmOperationDuration.WithLabelValues("upgrade", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		return fleetFailed, rel, err
+	}
+
+	s.Logger.Infow("release upgraded", "release", rel.Name, "namespace", rel.Namespace)
+
+	return fleetUpgraded, rel, nil
+}
+
+// rollbackFleetRelease returns a release to the revision it was on before the
+// fleet upgrade
+func (s *Server) rollbackFleetRelease(clientFor helmClientFunc, rel *release.Release, timeout time.Duration) error {
+	client, err := clientFor(rel)
+	if err != nil {
+		return err
+	}
+
+	rb := action.NewRollback(client)
+	rb.Version = rel.Version
+	rb.Timeout = timeout
+
+	start := time.Now()
+	err = rb.Run(rel.Name)
+	helmOperationDuration.WithLabelValues("rollback", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		return err
+	}
+
+	fleetUpgradeReleases.WithLabelValues(fleetRolledBack).Inc()
+	s.Logger.Infow("release rolled back", "release", rel.Name, "namespace", rel.Namespace, "revision", rel.Version)
+
+	return nil
+}
+
+// releaseRef identifies a release across namespaces
+func releaseRef(rel *release.Release) string {
+	return rel.Namespace + "/" + rel.Name
+}
+
+func releaseRefs(releases []*release.Release) []string {
+	refs := make([]string, 0, len(releases))
+
+	for _, rel := range releases {
+		refs = append(refs, releaseRef(rel))
+	}
+
+	return refs
+}
@@ -0,0 +1,254 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func TestUpgradeReleases(t *testing.T) {
+	type testCase struct {
+		name          string
+		upToDate      []string
+		changed       []string
+		removed       []string
+		failing       []string
+		opts          FleetUpgradeOptions
+		workers       int
+		cancelled     bool
+		expectErr     error
+		expectResult  *FleetUpgradeResult
+		expectStatus  map[string]release.Status
+		expectVersion map[string]int
+	}
+
+	testDir, err := os.MkdirTemp("", "test-upgrade-releases")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces := []string{"ns-a", "ns-b", "ns-c", "ns-d", "ns-e"}
+
+	testCases := []testCase{
+		{
+			name:     "all releases upgraded in batches",
+			upToDate: []string{"ns-b"},
+			opts:     FleetUpgradeOptions{BatchSize: 2},
+			expectResult: &FleetUpgradeResult{
+				Upgraded: []string{"ns-a/lb-a", "ns-c/lb-c", "ns-d/lb-d", "ns-e/lb-e"},
+				Skipped:  []string{"ns-b/lb-b"},
+			},
+			expectVersion: map[string]int{"ns-a": 2, "ns-b": 1, "ns-e": 2},
+		},
+		{
+			name:     "operator upgrades releases on the worker pool",
+			upToDate: []string{"ns-b"},
+			opts:     FleetUpgradeOptions{BatchSize: 2},
+			workers:  2,
+			expectResult: &FleetUpgradeResult{
+				Upgraded: []string{"ns-a/lb-a", "ns-c/lb-c", "ns-d/lb-d", "ns-e/lb-e"},
+				Skipped:  []string{"ns-b/lb-b"},
+			},
+			expectVersion: map[string]int{"ns-a": 2, "ns-b": 1, "ns-e": 2},
+		},
+		{
+			name:      "releases are left pending once leadership is lost",
+			opts:      FleetUpgradeOptions{BatchSize: 2},
+			workers:   2,
+			cancelled: true,
+			expectErr: context.Canceled,
+			expectResult: &FleetUpgradeResult{
+				Pending: []string{"ns-a/lb-a", "ns-b/lb-b", "ns-c/lb-c", "ns-d/lb-d", "ns-e/lb-e"},
+			},
+			expectVersion: map[string]int{"ns-a": 1, "ns-e": 1},
+		},
+		{
+			name:    "releases changed since they were listed are read again",
+			changed: []string{"ns-b"},
+			removed: []string{"ns-c"},
+			opts:    FleetUpgradeOptions{BatchSize: 2},
+			expectResult: &FleetUpgradeResult{
+				Upgraded: []string{"ns-a/lb-a", "ns-d/lb-d", "ns-e/lb-e"},
+				Skipped:  []string{"ns-b/lb-b", "ns-c/lb-c"},
+			},
+			expectVersion: map[string]int{"ns-a": 2, "ns-b": 2},
+		},
+		{
+			name:    "failures within the threshold continue",
+			failing: []string{"ns-a"},
+			opts:    FleetUpgradeOptions{BatchSize: 2, MaxFailures: 1},
+			expectResult: &FleetUpgradeResult{
+				Upgraded: []string{"ns-b/lb-b", "ns-c/lb-c", "ns-d/lb-d", "ns-e/lb-e"},
+				Failed:   []string{"ns-a/lb-a"},
+			},
+			expectStatus: map[string]release.Status{"ns-a": release.StatusFailed},
+		},
+		{
+			name:      "crossing the threshold halts",
+			failing:   []string{"ns-c"},
+			opts:      FleetUpgradeOptions{BatchSize: 2},
+			expectErr: ErrFleetUpgradeHalted,
+			expectResult: &FleetUpgradeResult{
+				Upgraded: []string{"ns-a/lb-a", "ns-b/lb-b", "ns-d/lb-d"},
+				Failed:   []string{"ns-c/lb-c"},
+				Pending:  []string{"ns-e/lb-e"},
+			},
+			expectStatus:  map[string]release.Status{"ns-c": release.StatusFailed},
+			expectVersion: map[string]int{"ns-e": 1},
+		},
+		{
+			name:      "failed releases are rolled back when halting",
+			failing:   []string{"ns-a", "ns-b"},
+			opts:      FleetUpgradeOptions{BatchSize: 2, MaxFailures: 1, Rollback: true},
+			expectErr: ErrFleetUpgradeHalted,
+			expectResult: &FleetUpgradeResult{
+				Failed:     []string{"ns-a/lb-a", "ns-b/lb-b"},
+				RolledBack: []string{"ns-a/lb-a", "ns-b/lb-b"},
+				Pending:    []string{"ns-c/lb-c", "ns-d/lb-d", "ns-e/lb-e"},
+			},
+			expectStatus:  map[string]release.Status{"ns-a": release.StatusDeployed, "ns-b": release.StatusDeployed},
+			expectVersion: map[string]int{"ns-a": 3, "ns-b": 3},
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Logger: zap.NewNop().Sugar(),
+				Chart:  ch,
+				values: map[string]interface{}{},
+			}
+
+			if tcase.workers > 0 {
+				srv.pool = newWorkerPool(tcase.workers)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if tcase.cancelled {
+				cancel()
+			}
+
+			clients := map[string]*action.Configuration{}
+			releases := []*release.Release{}
+
+			for _, ns := range namespaces {
+				client := utils.NewTestHelmConfig()
+
+				for _, failing := range tcase.failing {
+					if failing == ns {
+						client.KubeClient = &kubefake.FailingKubeClient{
+							PrintingKubeClient: kubefake.PrintingKubeClient{Out: io.Discard},
+							WaitError:          errors.New("not ready"), //nolint:goerr113
+						}
+					}
+				}
+
+				config := map[string]interface{}{"replicas": 2}
+
+				for _, upToDate := range tcase.upToDate {
+					if upToDate == ns {
+						config = nil
+					}
+				}
+
+				rel := &release.Release{
+					Name:      fmt.Sprintf("lb-%s", ns[len(ns)-1:]),
+					Namespace: ns,
+					Version:   1,
+					Chart:     ch,
+					Config:    config,
+					Info:      &release.Info{Status: release.StatusDeployed},
+				}
+
+				if err := client.Releases.Create(rel); err != nil {
+					t.Fatal(err)
+				}
+
+				clients[ns] = client
+				releases = append(releases, rel)
+
+				for _, changed := range tcase.changed {
+					if changed == ns {
+						rel.Info.Status = release.StatusSuperseded
+
+						updated := *rel
+						updated.Version = 2
+						updated.Config = nil
+						updated.Info = &release.Info{Status: release.StatusDeployed}
+
+						if err := client.Releases.Create(&updated); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				for _, removed := range tcase.removed {
+					if removed == ns {
+						if _, err := client.Releases.Delete(rel.Name, rel.Version); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+
+			// releases are upgraded in name order regardless of listing order
+			releases[0], releases[4] = releases[4], releases[0]
+
+			result, err := srv.upgradeReleases(ctx, releases, tcase.opts, func(rel *release.Release) (*action.Configuration, error) {
+				return clients[rel.Namespace], nil
+			})
+
+			if tcase.expectErr != nil {
+				assert.ErrorIs(t, err, tcase.expectErr)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, tcase.expectResult, result)
+
+			for ns, status := range tcase.expectStatus {
+				last, err := clients[ns].Releases.Last(fmt.Sprintf("lb-%s", ns[len(ns)-1:]))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, status, last.Info.Status, ns)
+			}
+
+			for ns, version := range tcase.expectVersion {
+				last, err := clients[ns].Releases.Last(fmt.Sprintf("lb-%s", ns[len(ns)-1:]))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				assert.Equal(t, version, last.Version, ns)
+			}
+		})
+	}
+}
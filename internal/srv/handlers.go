@@ -1,57 +1,355 @@
 package srv
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"go.infratographer.com/x/pubsubx"
 
 	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+	eventsv1alpha2 "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha2"
 )
 
+const (
+	readHeaderTimeout     = 10 * time.Second
+	defaultEventValuesKey = "event"
+)
+
+// valueSet sets helmKey in the chart values, either to value parsed as a
+// helm --set value or, when data is set, to data as is
 type valueSet struct {
 	helmKey string
 	value   string
+	data    interface{}
 }
 
-// MessageHandler handles the routing of events from specified queues
+// MessageHandler handles the routing of events from specified queues.
+// Messages are processed by the worker pool, serialized per loadbalancer.
 func (s *Server) MessageHandler(m *nats.Msg) {
-	msg := pubsubx.Message{}
-	if err := json.Unmarshal(m.Data, &msg); err != nil {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s.handleMessage(ctx, m)
+}
+
+// handleMessage processes a message received under ctx on the worker pool.
+// When ctx is cancelled, because shutdown has begun or leadership was lost,
+// messages that have not started processing are returned for redelivery.
+func (s *Server) handleMessage(ctx context.Context, m *nats.Msg) {
+	if s.isOperatorSubject(m.Subject) {
+		s.Logger.Debugw("skipping message published by the operator", "subject", m.Subject)
+		s.acknowledge(m, "", nil)
+
+		return
+	}
+
+	if !s.startMessage(ctx) {
+		s.Logger.Debugw("no longer processing, returning message for redelivery", "subject", m.Subject)
+		s.returnMessage(m)
+
+		return
+	}
+
+	if s.pool == nil {
+		defer s.inFlight.Done()
+
+		s.processMessage(ctx, m)
+
+		return
+	}
+
+	stop := s.keepInProgress(m)
+
+	s.pool.submit(s.messageKey(m), func() {
+		defer s.inFlight.Done()
+		defer stop()
+
+		// messages queued behind a busy loadbalancer may only get their turn
+		// once shutdown has begun or leadership has been lost
+		if s.stopping(ctx) {
+			s.Logger.Debugw("no longer processing, returning queued message for redelivery", "subject", m.Subject)
+			s.returnMessage(m)
+
+			return
+		}
+
+		s.processMessage(ctx, m)
+	})
+}
+
+// processMessage routes a message to its handler and acknowledges the result
+func (s *Server) processMessage(ctx context.Context, m *nats.Msg) {
+	messagesInFlight.Inc()
+	defer messagesInFlight.Dec()
+
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(m.Header))
+
+	ctx, span := tracer.Start(ctx, "MessageHandler",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination", m.Subject),
+		),
+	)
+	defer span.End()
+
+	handler, err := s.routeMessage(ctx, m)
+	handlerResults.WithLabelValues(eventTypeLabel(handler), resultLabel(err)).Inc()
+
+	span.SetAttributes(attribute.String("loadbalanceroperator.handler", handler))
+	recordSpanError(span, err)
+
+	s.acknowledge(m, handler, err)
+}
+
+// returnMessage hands a message back to jetstream for immediate redelivery
+func (s *Server) returnMessage(m *nats.Msg) {
+	if err := m.Nak(); err != nil {
+		s.Logger.Errorw("unable to acknowledge message", "subject", m.Subject, "error", err)
+	}
+}
+
+// isOperatorSubject reports whether a subject is one the operator publishes
+// to itself, such as the dead-letter or status subjects
+func (s *Server) isOperatorSubject(subject string) bool {
+	if s.DeadLetterSubject != "" && subject == s.DeadLetterSubject {
+		return true
+	}
+
+	return s.StatusSubject != "" && strings.HasPrefix(subject, s.StatusSubject+".")
+}
+
+// routeMessage dispatches a message to the handler for its event type,
+// returning the name of the handler alongside any processing error
+func (s *Server) routeMessage(ctx context.Context, m *nats.Msg) (string, error) {
+	msg, err := s.decodeMessage(m)
+	if err != nil {
 		s.Logger.Errorw("Unable to process data in message: %s", "error", err)
+		messagesReceived.WithLabelValues(eventTypeInvalid).Inc()
+
+		return eventTypeInvalid, err
+	}
+
+	messagesReceived.WithLabelValues(eventTypeLabel(msg.EventType)).Inc()
+
+	rec, dedup := s.newEventRecord(m, &msg)
+	if dedup {
+		reason, err := s.skipReason(rec)
+		if err != nil {
+			s.Logger.Errorw("unable to look up processed event", "load_balancer_id", rec.loadBalancerID, "error", err)
+			return msg.EventType, err
+		}
+
+		if reason != "" {
+			s.Logger.Infow("skipping event", "reason", reason, "event_type", msg.EventType, "load_balancer_id", rec.loadBalancerID, "timestamp", msg.Timestamp)
+			eventsSkipped.WithLabelValues(reason).Inc()
+
+			return msg.EventType, nil
+		}
 	}
 
 	switch msg.EventType {
-	case events.EVENTCREATE:
-		if err := s.createMessageHandler(&msg); err != nil {
-			s.Logger.Errorw("unable to process create: %s", "error", err)
+	case events.EVENTCREATE, events.EVENTUPDATE:
+		if err := s.deployMessageHandler(ctx, &msg, msg.EventType == events.EVENTUPDATE); err != nil {
+			s.Logger.Errorw("unable to process "+msg.EventType, "error", err)
+			return msg.EventType, err
 		}
-	case events.EVENTUPDATE:
-		err := s.updateMessageHandler(&msg)
-		if err != nil {
-			s.Logger.Errorw("unable to process update", "error", err.Error())
+	case events.EVENTDELETE:
+		if err := s.deleteMessageHandler(ctx, &msg); err != nil {
+			s.Logger.Errorw("unable to process delete", "error", err)
+			return msg.EventType, err
 		}
 	default:
 		s.Logger.Debug("This is some other set of queues that we don't know about.")
 	}
+
+	// the event has been applied, failing to record it only risks applying
+	// it again
+	if dedup {
+		if err := s.recordEvent(rec); err != nil {
+			s.Logger.Errorw("unable to record processed event", "load_balancer_id", rec.loadBalancerID, "error", err)
+		}
+	}
+
+	return msg.EventType, nil
 }
 
-func (s *Server) createMessageHandler(m *pubsubx.Message) error {
+// deployMessageHandler validates the loadbalancer data of a create or update
+// event and deploys it, reporting its progress as status events. The release
+// is upgraded when update is set and installed otherwise.
+func (s *Server) deployMessageHandler(ctx context.Context, m *pubsubx.Message, update bool) (err error) {
+	ctx, span := tracer.Start(ctx, "deployMessageHandler", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", m.SubjectURN),
+		attribute.Bool("loadbalanceroperator.update", update),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	lbdata := events.LoadBalancerData{}
+
+	mapped, err := s.parseLBData(ctx, &m.AdditionalData, &lbdata)
+	if err != nil {
+		s.Logger.Errorw("handler unable to parse loadbalancer data", "error", err)
+		return err
+	}
+
+	if err := s.validateLBData(&lbdata); err != nil {
+		s.rejectLBData(ctx, m, &lbdata, err)
+		return err
+	}
+
+	values, err := s.ValueMapper.Map(m.AdditionalData)
+	if err != nil {
+		s.Logger.Errorw("handler unable to map loadbalancer values", "error", err)
+		return err
+	}
+
+	mapped = append(mapped, values...)
+
+	span.SetAttributes(attribute.String("loadbalanceroperator.load_balancer_id", lbdata.LoadBalancerID.String()))
+
+	ctx, err = s.locationContext(ctx, lbdata.LocationID)
+	if err != nil {
+		s.Logger.Errorw("handler unable to route loadbalancer", "location_id", lbdata.LocationID, "error", err)
+		s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
+		return err
+	}
+
+	s.publishStatus(ctx, m, &lbdata, events.STATUSPROVISIONING, nil)
+
+	// the namespace must not be removed for another loadbalancer before the
+	// release is installed in it
+	err = s.lockNamespace(ctx, m.SubjectURN, false, func(ctx context.Context) error {
+		if err := s.CreateNamespace(ctx, m.SubjectURN); err != nil {
+			s.Logger.Errorw("handler unable to create required namespace", "error", err)
+			return err
+		}
+
+		if err := s.deployLoadBalancer(ctx, m.SubjectURN, &lbdata, mapped, update); err != nil {
+			s.Logger.Errorw("handler unable to deploy loadbalancer", "update", update, "error", err)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+		return err
+	}
+
+	s.publishStatus(ctx, m, &lbdata, events.STATUSREADY, nil)
+
+	return nil
+}
+
+func (s *Server) deleteMessageHandler(ctx context.Context, m *pubsubx.Message) (err error) {
+	ctx, span := tracer.Start(ctx, "deleteMessageHandler", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", m.SubjectURN),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
 	lbdata := events.LoadBalancerData{}
 
-	if err := s.parseLBData(&m.AdditionalData, &lbdata); err != nil {
+	if _, err := s.parseLBData(ctx, &m.AdditionalData, &lbdata); err != nil {
 		s.Logger.Errorw("handler unable to parse loadbalancer data", "error", err)
 		return err
 	}
 
-	if err := s.CreateNamespace(m.SubjectURN); err != nil {
-		s.Logger.Errorw("handler unable to create required namespace", "error", err)
+	if err := validateLoadBalancerRef(&lbdata); err != nil {
+		s.rejectLBData(ctx, m, &lbdata, err)
+		return err
+	}
+
+	span.SetAttributes(attribute.String("loadbalanceroperator.load_balancer_id", lbdata.LoadBalancerID.String()))
+
+	ctx, err = s.locationContext(ctx, lbdata.LocationID)
+	if err != nil {
+		s.Logger.Errorw("handler unable to route loadbalancer", "location_id", lbdata.LocationID, "error", err)
+		s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
 		return err
 	}
 
+	if s.UseCustomResources {
+		if err := s.deleteLoadBalancer(ctx, loadBalancerKey(m.SubjectURN, lbdata.LoadBalancerID.String())); err != nil {
+			s.Logger.Errorw("handler unable to delete loadbalancer resource", "error", err)
+			s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
+			return err
+		}
+	}
+
+	if err := s.removeDeployment(ctx, lbdata.LoadBalancerID.String(), m.SubjectURN); err != nil {
+		s.Logger.Errorw("handler unable to delete loadbalancer", "error", err)
+		s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
+		return err
+	}
+
+	if err := s.DeleteNamespace(ctx, m.SubjectURN); err != nil {
+		s.Logger.Errorw("handler unable to remove namespace", "error", err)
+		s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
+		return err
+	}
+
+	// the namespace holding the loadbalancer resource is separate from the
+	// one in the location's cluster
+	if s.UseCustomResources && len(s.Locations) > 0 {
+		if err := s.DeleteNamespace(s.homeContext(ctx), m.SubjectURN); err != nil {
+			s.Logger.Errorw("handler unable to remove loadbalancer resource namespace", "error", err)
+			s.publishStatus(ctx, m, &lbdata, events.STATUSFAILED, err)
+
+			return err
+		}
+	}
+
+	s.publishStatus(ctx, m, &lbdata, events.STATUSDELETED, nil)
+
+	return nil
+}
+
+// rejectLBData reports loadbalancer data that failed validation, publishing
+// the reason as a failed status when the loadbalancer is known
+func (s *Server) rejectLBData(ctx context.Context, m *pubsubx.Message, lbdata *events.LoadBalancerData, err error) {
+	s.Logger.Errorw("handler received invalid loadbalancer data", "error", err)
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		validationFailures.WithLabelValues(validationErr.Field).Inc()
+	}
+
+	if lbdata.LoadBalancerID != uuid.Nil {
+		s.publishStatus(ctx, m, lbdata, events.STATUSFAILED, err)
+	}
+}
+
+// newHelmOverrides maps the resources requested for a loadbalancer onto the
+// helm values configured via the helm-cpu-flag and helm-memory-flag settings
+func newHelmOverrides(lbdata *events.LoadBalancerData) []valueSet {
 	overrides := []valueSet{}
 	for _, cpuFlag := range viper.GetStringSlice("helm-cpu-flag") {
 		overrides = append(overrides, valueSet{
@@ -67,16 +365,7 @@ func (s *Server) createMessageHandler(m *pubsubx.Message) error {
 		})
 	}
 
-	if err := s.newDeployment(lbdata.LoadBalancerID.String(), m.SubjectURN, overrides); err != nil {
-		s.Logger.Errorw("handler unable to create loadbalancer", "error", err)
-		return err
-	}
-
-	return nil
-}
-
-func (s *Server) updateMessageHandler(m *pubsubx.Message) error {
-	return nil
+	return overrides
 }
 
 // ExposeEndpoint exposes a specified port for various checks
@@ -85,44 +374,154 @@ func (s *Server) ExposeEndpoint(subscription *nats.Subscription, port string) er
 		return ErrPortsRequired
 	}
 
+	checkConfig := http.NewServeMux()
+	checkConfig.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	checkConfig.Handle("/metrics", promhttp.Handler())
+	checkConfig.HandleFunc("/chart", s.chartHandler)
+	checkConfig.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case s.isDraining():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("503 - Shutting down"))
+		case !subscription.IsValid():
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("500 - Queue subscription is inactive"))
+		default:
+			s.clusterReadiness(w)
+		}
+	})
+
+	s.healthServer = &http.Server{
+		Handler:           checkConfig,
+		Addr:              port,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
 	go func() {
 		s.Logger.Infof("Starting endpoints on %s", port)
 
-		checkConfig := http.NewServeMux()
-		checkConfig.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-			_, _ = w.Write([]byte("ok"))
-		})
-		checkConfig.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-			if !subscription.IsValid() {
-				w.WriteHeader(http.StatusInternalServerError)
-				_, _ = w.Write([]byte("500 - Queue subscription is inactive"))
-			} else {
-				_, _ = w.Write([]byte("ok"))
-			}
-		})
-
-		checks := http.Server{
-			Handler: checkConfig,
-			Addr:    port,
+		if err := s.healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Errorw("healthcheck endpoints stopped", "error", err)
 		}
-
-		_ = checks.ListenAndServe()
 	}()
 
 	return nil
 }
 
-func (s *Server) parseLBData(data *map[string]interface{}, lbdata *events.LoadBalancerData) error {
+// clusterReadiness reports ready while at least one cluster is reachable,
+// listing any clusters that failed their last health check
+func (s *Server) clusterReadiness(w http.ResponseWriter) {
+	registry := s.clusterRegistry()
+	degraded := registry.Degraded()
+
+	switch {
+	case len(degraded) == 0:
+		_, _ = w.Write([]byte("ok"))
+	case len(degraded) == len(registry.List()):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("503 - No clusters reachable: " + strings.Join(degraded, ", ")))
+	default:
+		_, _ = w.Write([]byte("ok - Degraded clusters: " + strings.Join(degraded, ", ")))
+	}
+}
+
+// parseLBData parses the loadbalancer data of an event according to its
+// schema_version, converting it to v1alpha1. The chart values set from the
+// parts of newer schemas that have no v1alpha1 equivalent are returned.
+func (s *Server) parseLBData(ctx context.Context, data *map[string]interface{}, lbdata *events.LoadBalancerData) (_ []valueSet, err error) {
+	_, span := tracer.Start(ctx, "parseLBData")
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
 	d, err := json.Marshal(data)
 	if err != nil {
 		s.Logger.Errorw("unable to load data from event", "error", err.Error())
-		return err
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
 	}
 
-	if err := json.Unmarshal(d, &lbdata); err != nil {
-		s.Logger.Errorw("unable to parse event data", "error", err.Error())
-		return err
+	version := schemaVersion(*data)
+	span.SetAttributes(attribute.String("loadbalanceroperator.schema_version", version))
+
+	switch version {
+	case events.SchemaVersion:
+		if err := json.Unmarshal(d, &lbdata); err != nil {
+			s.Logger.Errorw("unable to parse event data", "error", err.Error())
+			return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+
+		return nil, nil
+	case eventsv1alpha2.SchemaVersion:
+		v2data := eventsv1alpha2.LoadBalancerData{}
+		if err := json.Unmarshal(d, &v2data); err != nil {
+			s.Logger.Errorw("unable to parse event data", "error", err.Error())
+			return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+		}
+
+		*lbdata = v2data.ConvertToV1alpha1()
+
+		return s.schemaValues(&v2data)
+	default:
+		s.Logger.Errorw("unsupported event schema", "schema_version", version)
+		return nil, fmt.Errorf("%w: unsupported schema_version %q", ErrInvalidEvent, version)
 	}
+}
 
-	return nil
+// schemaVersion returns the schema_version of the loadbalancer data of an
+// event, v1alpha1 when it has none
+func schemaVersion(data map[string]interface{}) string {
+	version, ok := data["schema_version"].(string)
+	if !ok || version == "" {
+		return events.SchemaVersion
+	}
+
+	return version
+}
+
+// schemaValues returns the chart values set from the labels, ports,
+// listeners and backend pools of v1alpha2 loadbalancer data, which are
+// placed under the EventValuesKey as they appear in the event
+func (s *Server) schemaValues(lbdata *eventsv1alpha2.LoadBalancerData) ([]valueSet, error) {
+	parts := map[string]interface{}{}
+
+	if len(lbdata.Labels) > 0 {
+		parts["labels"] = lbdata.Labels
+	}
+
+	if len(lbdata.Ports) > 0 {
+		parts["ports"] = lbdata.Ports
+	}
+
+	if len(lbdata.Listeners) > 0 {
+		parts["listeners"] = lbdata.Listeners
+	}
+
+	if len(lbdata.BackendPools) > 0 {
+		parts["backend_pools"] = lbdata.BackendPools
+	}
+
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	value, err := normalizeJSON(parts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	return []valueSet{{helmKey: s.eventValuesKey(), data: value}}, nil
+}
+
+// eventValuesKey returns the chart values key the parts of the event data
+// without a v1alpha1 equivalent are placed under
+func (s *Server) eventValuesKey() string {
+	if s.EventValuesKey == "" {
+		return defaultEventValuesKey
+	}
+
+	return s.EventValuesKey
 }
@@ -1,10 +1,12 @@
 package srv
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
 	"github.com/stretchr/testify/assert"
@@ -12,6 +14,7 @@ import (
 	"go.infratographer.com/x/pubsubx"
 
 	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+	eventsv1alpha2 "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha2"
 )
 
 var (
@@ -64,7 +67,7 @@ func TestParseLBData(t *testing.T) {
 				Logger: zap.NewNop().Sugar(),
 			}
 			msg.AdditionalData = tcase.data
-			err := srv.parseLBData(&tcase.data, &lbData)
+			_, err := srv.parseLBData(context.TODO(), &tcase.data, &lbData)
 
 			if tcase.expectError {
 				assert.NotNil(t, err)
@@ -75,3 +78,225 @@ func TestParseLBData(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLBDataSchemaVersions(t *testing.T) {
+	lbID := uuid.New()
+	locationID := uuid.New()
+
+	type testCase struct {
+		name         string
+		data         map[string]interface{}
+		valuesKey    string
+		expectError  error
+		expectValues []valueSet
+	}
+
+	testCases := []testCase{
+		{
+			name: "no schema version",
+			data: map[string]interface{}{
+				"load_balancer_id": lbID.String(),
+				"location_id":      locationID.String(),
+				"resources":        map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+			},
+		},
+		{
+			name: "v1alpha1",
+			data: map[string]interface{}{
+				"schema_version":   events.SchemaVersion,
+				"load_balancer_id": lbID.String(),
+				"location_id":      locationID.String(),
+				"resources":        map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+			},
+		},
+		{
+			name: "v1alpha2 without routing",
+			data: map[string]interface{}{
+				"schema_version":   eventsv1alpha2.SchemaVersion,
+				"load_balancer_id": lbID.String(),
+				"location_id":      locationID.String(),
+				"resources":        map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+			},
+		},
+		{
+			name:      "v1alpha2",
+			valuesKey: "loadBalancer.routing",
+			data: map[string]interface{}{
+				"schema_version":   eventsv1alpha2.SchemaVersion,
+				"load_balancer_id": lbID.String(),
+				"location_id":      locationID.String(),
+				"resources":        map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+				"labels":           map[string]interface{}{"tier": "edge"},
+				"ports":            []interface{}{map[string]interface{}{"name": "https", "number": 443, "protocol": "tcp"}},
+				"listeners": []interface{}{map[string]interface{}{
+					"name":         "https",
+					"port":         "https",
+					"backend_pool": "web",
+					"tls":          map[string]interface{}{"certificate_secret": "web-tls"},
+				}},
+				"backend_pools": []interface{}{map[string]interface{}{
+					"name":         "web",
+					"backends":     []interface{}{map[string]interface{}{"address": "10.0.0.1", "port": 8443}},
+					"health_check": map[string]interface{}{"protocol": "http", "path": "/healthz"},
+				}},
+			},
+			expectValues: []valueSet{{
+				helmKey: "loadBalancer.routing",
+				data: map[string]interface{}{
+					"labels": map[string]interface{}{"tier": "edge"},
+					"ports": []interface{}{
+						map[string]interface{}{"name": "https", "number": float64(443), "protocol": "tcp"},
+					},
+					"listeners": []interface{}{map[string]interface{}{
+						"name":         "https",
+						"port":         "https",
+						"backend_pool": "web",
+						"tls":          map[string]interface{}{"certificate_secret": "web-tls"},
+					}},
+					"backend_pools": []interface{}{map[string]interface{}{
+						"name":         "web",
+						"backends":     []interface{}{map[string]interface{}{"address": "10.0.0.1", "port": float64(8443)}},
+						"health_check": map[string]interface{}{"protocol": "http", "path": "/healthz"},
+					}},
+				},
+			}},
+		},
+		{
+			name: "unsupported schema version",
+			data: map[string]interface{}{
+				"schema_version":   "v2",
+				"load_balancer_id": lbID.String(),
+			},
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name: "invalid v1alpha2 data",
+			data: map[string]interface{}{
+				"schema_version":   eventsv1alpha2.SchemaVersion,
+				"load_balancer_id": lbID.String(),
+				"ports":            "443",
+			},
+			expectError: ErrInvalidEvent,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := &Server{
+				Logger:         zap.NewNop().Sugar(),
+				EventValuesKey: tcase.valuesKey,
+			}
+
+			lbData := events.LoadBalancerData{}
+			values, err := srv.parseLBData(context.TODO(), &tcase.data, &lbData)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tcase.expectValues, values)
+			assert.Equal(t, lbID, lbData.LoadBalancerID)
+			assert.Equal(t, locationID, lbData.LocationID)
+			assert.Equal(t, events.LoadBalancerResources{CPU: "100m", Memory: "128Mi"}, lbData.Resources)
+		})
+	}
+}
+
+func TestConvertV1alpha1(t *testing.T) {
+	v1data := events.LoadBalancerData{
+		SchemaVersion:  events.SchemaVersion,
+		LoadBalancerID: uuid.New(),
+		LocationID:     uuid.New(),
+		Resources:      events.LoadBalancerResources{CPU: "100m", Memory: "128Mi"},
+		QueryURL:       "https://example.com/lb",
+	}
+
+	v2data := eventsv1alpha2.ConvertFromV1alpha1(&v1data)
+	assert.Equal(t, eventsv1alpha2.SchemaVersion, v2data.SchemaVersion)
+	assert.Equal(t, v1data, v2data.ConvertToV1alpha1())
+}
+
+func TestNewHelmOverrides(t *testing.T) {
+	type testCase struct {
+		name      string
+		cpuFlags  []string
+		memFlags  []string
+		resources events.LoadBalancerResources
+		expected  []valueSet
+	}
+
+	testCases := []testCase{
+		{
+			name:      "no flags",
+			resources: events.LoadBalancerResources{CPU: "100m", Memory: "128Mi"},
+			expected:  []valueSet{},
+		},
+		{
+			name:      "cpu and memory flags",
+			cpuFlags:  []string{"resources.limits.cpu", "resources.requests.cpu"},
+			memFlags:  []string{"resources.limits.memory"},
+			resources: events.LoadBalancerResources{CPU: "100m", Memory: "128Mi"},
+			expected: []valueSet{
+				{helmKey: "resources.limits.cpu", value: "100m"},
+				{helmKey: "resources.requests.cpu", value: "100m"},
+				{helmKey: "resources.limits.memory", value: "128Mi"},
+			},
+		},
+	}
+
+	for _, tcase := range testCases {
+		viper.Reset()
+		t.Run(tcase.name, func(t *testing.T) {
+			viper.Set("helm-cpu-flag", tcase.cpuFlags)
+			viper.Set("helm-memory-flag", tcase.memFlags)
+
+			overrides := newHelmOverrides(&events.LoadBalancerData{Resources: tcase.resources})
+			assert.Equal(t, tcase.expected, overrides)
+		})
+	}
+}
+
+func TestIsOperatorSubject(t *testing.T) {
+	type testCase struct {
+		name     string
+		subject  string
+		expected bool
+	}
+
+	testCases := []testCase{
+		{
+			name:     "event subject",
+			subject:  "lbo.events.create",
+			expected: false,
+		},
+		{
+			name:     "dead-letter subject",
+			subject:  "lbo.dlq",
+			expected: true,
+		},
+		{
+			name:     "status subject",
+			subject:  "lbo.status." + uuid.NewString(),
+			expected: true,
+		},
+		{
+			name:     "status subject prefix only",
+			subject:  "lbo.statuses",
+			expected: false,
+		},
+	}
+
+	srv := &Server{
+		Logger:            zap.NewNop().Sugar(),
+		DeadLetterSubject: "lbo.dlq",
+		StatusSubject:     "lbo.status",
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, srv.isOperatorSubject(tcase.subject))
+		})
+	}
+}
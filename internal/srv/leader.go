@@ -0,0 +1,221 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseName     = "loadbalanceroperator"
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+// leaderElectionConfig returns the lease based leader election configuration
+// for this replica. run is called with a context that is cancelled as soon as
+// leadership is lost, and losing it waits for the work started under that
+// context to finish.
+func (s *Server) leaderElectionConfig(client kubernetes.Interface, run func(context.Context)) (leaderelection.LeaderElectionConfig, error) {
+	if s.LeaseNamespace == "" {
+		return leaderelection.LeaderElectionConfig{}, ErrLeaseNamespace
+	}
+
+	name := s.LeaseName
+	if name == "" {
+		name = defaultLeaseName
+	}
+
+	identity := s.LeaseIdentity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return leaderelection.LeaderElectionConfig{}, err
+		}
+
+		identity = hostname
+	}
+
+	leaseDuration := s.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = defaultLeaseDuration
+	}
+
+	renewDeadline := s.RenewDeadline
+	if renewDeadline <= 0 {
+		renewDeadline = defaultRenewDeadline
+	}
+
+	retryPeriod := s.RetryPeriod
+	if retryPeriod <= 0 {
+		retryPeriod = defaultRetryPeriod
+	}
+
+	return leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: s.LeaseNamespace,
+			},
+			Client: client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: identity,
+			},
+		},
+		Name:            name,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				s.Logger.Infow("acquired leader lease, processing messages", "lease", name, "identity", identity)
+				isLeader.Set(1)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				// the context run was given has been cancelled, so no new
+				// work starts. Work already running must finish before this
+				// replica stops reporting itself as the leader or campaigns
+				// again, otherwise it would deploy alongside the next leader.
+				s.Logger.Infow("lost leader lease, waiting for in-flight work", "lease", name, "identity", identity)
+				s.waitForInFlight()
+
+				s.Logger.Infow("released leader lease, no longer processing messages", "lease", name, "identity", identity)
+				isLeader.Set(0)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					s.Logger.Infow("following leader", "lease", name, "leader", leader)
+				}
+			},
+		},
+	}, nil
+}
+
+// campaign competes for the leader lease until ctx is cancelled, calling run
+// whenever this replica becomes the leader. Leadership that is lost is
+// campaigned for again so a replica can take over once more after a
+// transient API server failure.
+func (s *Server) campaign(ctx context.Context, client kubernetes.Interface, run func(context.Context)) error {
+	cfg, err := s.leaderElectionConfig(client, run)
+	if err != nil {
+		return err
+	}
+
+	// validate the configuration before campaigning in the background
+	if _, err := leaderelection.NewLeaderElector(cfg); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			elector, err := leaderelection.NewLeaderElector(cfg)
+			if err != nil {
+				s.Logger.Errorw("unable to create leader elector", "error", err)
+				return
+			}
+
+			elector.Run(ctx)
+
+			if ctx.Err() != nil || s.isDraining() {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// RunLeading runs fn once this process holds the leader lease the operator
+// processes messages under, so fn never changes loadbalancers alongside the
+// leader. fn's context is cancelled if the lease is lost, and the lease is
+// released once fn has returned. When LeaseWaitTimeout is set and the lease
+// has not been acquired within it ErrLeaseWaitTimeout is returned without
+// running fn. Without leader election there is no lease to hold and fn is run
+// straight away.
+func (s *Server) RunLeading(ctx context.Context, client kubernetes.Interface, fn func(context.Context) error) error {
+	if !s.LeaderElection {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		started  bool
+		stopped  bool
+		timedOut bool
+		runErr   error
+		done     = make(chan struct{})
+	)
+
+	cfg, err := s.leaderElectionConfig(client, func(leaderCtx context.Context) {
+		mu.Lock()
+		if stopped || timedOut {
+			mu.Unlock()
+			return
+		}
+
+		started = true
+		mu.Unlock()
+
+		defer close(done)
+		defer cancel()
+
+		runErr = fn(leaderCtx)
+	})
+	if err != nil {
+		return err
+	}
+
+	elector, err := leaderelection.NewLeaderElector(cfg)
+	if err != nil {
+		return err
+	}
+
+	if s.LeaseWaitTimeout > 0 {
+		// only acquiring the lease is bounded, fn runs for as long as it needs
+		timer := time.AfterFunc(s.LeaseWaitTimeout, func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if !started {
+				timedOut = true
+
+				cancel()
+			}
+		})
+
+		defer timer.Stop()
+	}
+
+	elector.Run(ctx)
+
+	mu.Lock()
+	stopped = true
+	wasStarted := started
+	wasTimedOut := timedOut
+	mu.Unlock()
+
+	if wasTimedOut {
+		return fmt.Errorf("%w: %s", ErrLeaseWaitTimeout, s.LeaseWaitTimeout)
+	}
+
+	if !wasStarted {
+		return ctx.Err()
+	}
+
+	<-done
+
+	return runErr
+}
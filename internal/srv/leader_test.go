@@ -0,0 +1,330 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLeaderElectionConfig(t *testing.T) {
+	type testCase struct {
+		name        string
+		srv         *Server
+		expectLease string
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name:        "missing namespace",
+			srv:         &Server{},
+			expectError: ErrLeaseNamespace,
+		},
+		{
+			name:        "defaults",
+			srv:         &Server{LeaseNamespace: "lbo"},
+			expectLease: defaultLeaseName,
+		},
+		{
+			name: "configured",
+			srv: &Server{
+				LeaseName:      "lbo-lease",
+				LeaseNamespace: "lbo",
+				LeaseIdentity:  "replica-a",
+				LeaseDuration:  time.Minute,
+				RenewDeadline:  30 * time.Second,
+				RetryPeriod:    5 * time.Second,
+			},
+			expectLease: "lbo-lease",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			tcase.srv.Logger = zap.NewNop().Sugar()
+
+			cfg, err := tcase.srv.leaderElectionConfig(fake.NewSimpleClientset(), func(context.Context) {})
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tcase.expectLease, cfg.Name)
+			assert.True(t, cfg.ReleaseOnCancel)
+			assert.NotEmpty(t, cfg.Lock.Identity())
+
+			if tcase.srv.LeaseIdentity != "" {
+				assert.Equal(t, tcase.srv.LeaseIdentity, cfg.Lock.Identity())
+				assert.Equal(t, tcase.srv.LeaseDuration, cfg.LeaseDuration)
+			}
+		})
+	}
+}
+
+func TestCampaign(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	newCandidate := func(identity string) *Server {
+		return &Server{
+			Logger:         zap.NewNop().Sugar(),
+			LeaseNamespace: "lbo",
+			LeaseIdentity:  identity,
+			LeaseDuration:  time.Second,
+			RenewDeadline:  500 * time.Millisecond,
+			RetryPeriod:    100 * time.Millisecond,
+		}
+	}
+
+	var leadingA, leadingB int32
+
+	lead := func(leading *int32) func(context.Context) {
+		return func(ctx context.Context) {
+			atomic.StoreInt32(leading, 1)
+			<-ctx.Done()
+			atomic.StoreInt32(leading, 0)
+		}
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+
+	if err := newCandidate("replica-a").campaign(ctxA, client, lead(&leadingA)); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&leadingA) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	if err := newCandidate("replica-b").campaign(ctxB, client, lead(&leadingB)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the standby replica must not process messages while the lease is held
+	assert.Never(t, func() bool {
+		return atomic.LoadInt32(&leadingB) == 1
+	}, 1500*time.Millisecond, 50*time.Millisecond)
+
+	cancelA()
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&leadingA) == 0 && atomic.LoadInt32(&leadingB) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLostLeadershipWaitsForInFlightWork(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	// renewals fail once the api server becomes unreachable
+	var unreachable int32
+
+	client.PrependReactor("update", "leases", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unreachable) == 1 {
+			return true, nil, errors.New("api server unreachable") //nolint:goerr113
+		}
+
+		return false, nil, nil
+	})
+
+	srv := &Server{
+		Logger:         zap.NewNop().Sugar(),
+		LeaseNamespace: "lbo",
+		LeaseIdentity:  "replica-a",
+		LeaseDuration:  time.Second,
+		RenewDeadline:  500 * time.Millisecond,
+		RetryPeriod:    100 * time.Millisecond,
+		pool:           newWorkerPool(2),
+	}
+
+	leaderCtx := make(chan context.Context, 1)
+	running := make(chan struct{})
+	finish := make(chan struct{})
+
+	var queuedRan int32
+
+	run := func(ctx context.Context) {
+		leaderCtx <- ctx
+
+		// a helm operation in progress and a job queued behind it for the
+		// same loadbalancer
+		if !srv.startMessage(ctx) {
+			return
+		}
+
+		srv.pool.submit("lb", func() {
+			defer srv.inFlight.Done()
+
+			close(running)
+			<-finish
+		})
+
+		if !srv.startMessage(ctx) {
+			return
+		}
+
+		srv.pool.submit("lb", func() {
+			defer srv.inFlight.Done()
+
+			if !srv.stopping(ctx) {
+				atomic.StoreInt32(&queuedRan, 1)
+			}
+		})
+
+		<-ctx.Done()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.campaign(ctx, client, run); err != nil {
+		t.Fatal(err)
+	}
+
+	var lost context.Context
+
+	select {
+	case lost = <-leaderCtx:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica never became the leader")
+	}
+
+	<-running
+
+	atomic.StoreInt32(&unreachable, 1)
+
+	select {
+	case <-lost.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership was not lost")
+	}
+
+	// no new work starts once leadership is lost
+	assert.False(t, srv.startMessage(lost))
+
+	// the replica keeps reporting itself as the leader until the running
+	// operation has finished
+	assert.Never(t, func() bool {
+		return testutil.ToFloat64(isLeader) == 0
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	close(finish)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(isLeader) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queuedRan), "queued work ran after leadership was lost")
+}
+
+func TestRunLeading(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	newCandidate := func(identity string) *Server {
+		return &Server{
+			Logger:         zap.NewNop().Sugar(),
+			LeaderElection: true,
+			LeaseNamespace: "lbo",
+			LeaseIdentity:  identity,
+			LeaseDuration:  time.Second,
+			RenewDeadline:  500 * time.Millisecond,
+			RetryPeriod:    100 * time.Millisecond,
+		}
+	}
+
+	// without leader election fn runs straight away
+	var ran int32
+
+	err := (&Server{Logger: zap.NewNop().Sugar()}).RunLeading(context.Background(), client, func(context.Context) error {
+		atomic.StoreInt32(&ran, 1)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ran))
+
+	atomic.StoreInt32(&ran, 0)
+
+	var operatorLeading int32
+
+	operatorCtx, stopOperator := context.WithCancel(context.Background())
+	defer stopOperator()
+
+	if err := newCandidate("operator").campaign(operatorCtx, client, func(ctx context.Context) {
+		atomic.StoreInt32(&operatorLeading, 1)
+		<-ctx.Done()
+		atomic.StoreInt32(&operatorLeading, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&operatorLeading) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// nothing runs while the operator holds the lease
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), time.Second)
+	defer cancelWait()
+
+	err = newCandidate("upgrade").RunLeading(waitCtx, client, func(context.Context) error {
+		atomic.StoreInt32(&ran, 1)
+		return nil
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ran))
+
+	// and waiting for the lease gives up after LeaseWaitTimeout
+	bounded := newCandidate("upgrade")
+	bounded.LeaseWaitTimeout = 500 * time.Millisecond
+
+	err = bounded.RunLeading(context.Background(), client, func(context.Context) error {
+		atomic.StoreInt32(&ran, 1)
+		return nil
+	})
+
+	assert.ErrorIs(t, err, ErrLeaseWaitTimeout)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ran))
+
+	// once the operator steps down the lease is taken over
+	stopOperator()
+
+	errUpgrade := errors.New("upgrade failed") //nolint:goerr113
+
+	err = newCandidate("upgrade").RunLeading(context.Background(), client, func(context.Context) error {
+		atomic.StoreInt32(&ran, 1)
+		return errUpgrade
+	})
+
+	assert.ErrorIs(t, err, errUpgrade)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ran))
+
+	// and released again when the upgrade returns
+	var nextLeading int32
+
+	nextCtx, cancelNext := context.WithCancel(context.Background())
+	defer cancelNext()
+
+	if err := newCandidate("operator").campaign(nextCtx, client, func(ctx context.Context) {
+		atomic.StoreInt32(&nextLeading, 1)
+		<-ctx.Done()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&nextLeading) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,48 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// homeContext returns ctx directed at the operator's own cluster, which
+// LoadBalancer resources are recorded in
+func (s *Server) homeContext(ctx context.Context) context.Context {
+	return withCluster(ctx, s.home())
+}
+
+// locationContext returns ctx directed at the cluster serving a location.
+// Without any configured locations every loadbalancer is deployed to the
+// operator's own cluster, otherwise locations without a cluster are rejected
+// with ErrUnknownLocation.
+func (s *Server) locationContext(ctx context.Context, location uuid.UUID) (context.Context, error) {
+	if len(s.Locations) == 0 {
+		return ctx, nil
+	}
+
+	cluster, ok := s.Locations[strings.ToLower(location.String())]
+	if !ok {
+		return ctx, fmt.Errorf("%w: %s", ErrUnknownLocation, location)
+	}
+
+	return withCluster(ctx, cluster), nil
+}
+
+// clusterContexts returns ctx directed at each cluster loadbalancers may be
+// deployed to
+func (s *Server) clusterContexts(ctx context.Context) []context.Context {
+	if len(s.Locations) == 0 {
+		return []context.Context{ctx}
+	}
+
+	contexts := []context.Context{}
+
+	for _, cluster := range s.clusterRegistry().List() {
+		contexts = append(contexts, withCluster(ctx, cluster))
+	}
+
+	return contexts
+}
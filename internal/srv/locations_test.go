@@ -0,0 +1,86 @@
+package srv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+func TestLocationContext(t *testing.T) {
+	type testCase struct {
+		name          string
+		locations     map[string]*Cluster
+		location      uuid.UUID
+		expectCluster string
+		expectError   error
+	}
+
+	edge := NewCluster("edge", &rest.Config{Host: "https://edge.example.com"})
+	location := uuid.New()
+
+	testCases := []testCase{
+		{
+			name:          "no locations configured",
+			location:      location,
+			expectCluster: defaultClusterName,
+		},
+		{
+			name:          "known location",
+			locations:     map[string]*Cluster{location.String(): edge},
+			location:      location,
+			expectCluster: "edge",
+		},
+		{
+			name:          "unknown location",
+			locations:     map[string]*Cluster{location.String(): edge},
+			location:      uuid.New(),
+			expectCluster: defaultClusterName,
+			expectError:   ErrUnknownLocation,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := &Server{
+				KubeClient: &rest.Config{Host: "https://home.example.com"},
+				Locations:  tcase.locations,
+			}
+
+			ctx, err := srv.locationContext(context.Background(), tcase.location)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				assert.True(t, isPermanentError(err))
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, tcase.expectCluster, srv.cluster(ctx).Name)
+		})
+	}
+}
+
+func TestClusterContexts(t *testing.T) {
+	srv := &Server{KubeClient: &rest.Config{Host: "https://home.example.com"}}
+	assert.Len(t, srv.clusterContexts(context.Background()), 1)
+
+	edge := NewCluster("edge", &rest.Config{Host: "https://edge.example.com"})
+	core := NewCluster("core", &rest.Config{Host: "https://core.example.com"})
+
+	srv.Clusters = NewClusterRegistry(edge, core)
+	srv.Locations = map[string]*Cluster{
+		uuid.NewString(): edge,
+		uuid.NewString(): edge,
+		uuid.NewString(): core,
+	}
+
+	names := []string{}
+	for _, ctx := range srv.clusterContexts(context.Background()) {
+		names = append(names, srv.cluster(ctx).Name)
+	}
+
+	assert.Equal(t, []string{"core", "edge"}, names)
+}
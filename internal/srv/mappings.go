@@ -0,0 +1,334 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+const (
+	// MappingTypeJSON sets the mapped value as it appears in the event
+	MappingTypeJSON = "json"
+	// MappingTypeString coerces the mapped value to a string
+	MappingTypeString = "string"
+	// MappingTypeInt coerces the mapped value to an integer
+	MappingTypeInt = "int"
+	// MappingTypeFloat coerces the mapped value to a floating point number
+	MappingTypeFloat = "float"
+	// MappingTypeBool coerces the mapped value to a boolean
+	MappingTypeBool = "bool"
+
+	// maxExactInteger is the largest integer a float64 holds exactly
+	maxExactInteger = 1 << 53
+)
+
+// ValueMapping sets a chart value from a field of the data of an event
+type ValueMapping struct {
+	// Path is a JSONPath expression into the additional data of an event,
+	// such as {.replicas}. The braces and leading dot may be left out.
+	Path string `mapstructure:"path"`
+	// Key is the dotted chart values key that is set
+	Key string `mapstructure:"key"`
+	// Type is the type the value is coerced to, json when empty
+	Type string `mapstructure:"type"`
+	// Default is used when Path matches nothing. The key is left unset when
+	// there is no default.
+	Default interface{} `mapstructure:"default"`
+}
+
+// ValueMapper sets chart values from the data of events according to a set
+// of mappings
+type ValueMapper struct {
+	mappings []valueMapping
+}
+
+// valueMapping is a ValueMapping with its path parsed
+type valueMapping struct {
+	ValueMapping
+	path *jsonpath.JSONPath
+}
+
+// NewValueMapper returns a mapper for mappings. Every mapping must set a key
+// covered by allowedKeys, either the key itself or one of its parents.
+func NewValueMapper(mappings []ValueMapping, allowedKeys []string) (*ValueMapper, error) {
+	m := &ValueMapper{}
+
+	for _, mapping := range mappings {
+		if mapping.Type == "" {
+			mapping.Type = MappingTypeJSON
+		}
+
+		if !validValueKey(mapping.Key) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidValueMapping, mapping.Key)
+		}
+
+		if !keyAllowed(mapping.Key, allowedKeys) {
+			return nil, fmt.Errorf("%w: %s", ErrValueKeyNotAllowed, mapping.Key)
+		}
+
+		path := jsonpath.New(mapping.Key).AllowMissingKeys(true)
+		if err := path.Parse(relaxedPath(mapping.Path)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidValueMapping, mapping.Key, err)
+		}
+
+		if mapping.Default != nil {
+			def, err := coerceValue(mapping.Default, mapping.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s default: %s", ErrInvalidValueMapping, mapping.Key, err)
+			}
+
+			mapping.Default = def
+		}
+
+		m.mappings = append(m.mappings, valueMapping{ValueMapping: mapping, path: path})
+	}
+
+	return m, nil
+}
+
+// relaxedPath wraps a JSONPath expression in braces and adds its leading dot
+// when they were left out, so replicas, .replicas and {.replicas} are the same
+func relaxedPath(path string) string {
+	if strings.HasPrefix(path, "{") {
+		return path
+	}
+
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "[") {
+		path = "." + path
+	}
+
+	return "{" + path + "}"
+}
+
+// validValueKey reports whether key is a dotted chart values key without
+// empty parts
+func validValueKey(key string) bool {
+	for _, part := range strings.Split(key, ".") {
+		if part == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keyAllowed reports whether key is one of allowedKeys or nested under one
+func keyAllowed(key string, allowedKeys []string) bool {
+	for _, allowed := range allowedKeys {
+		if key == allowed || strings.HasPrefix(key, allowed+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Map returns the chart values set by the mappings for the additional data
+// of an event. Values that cannot be coerced to the type of their mapping
+// wrap ErrInvalidEvent.
+func (m *ValueMapper) Map(data map[string]interface{}) ([]valueSet, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	overrides := []valueSet{}
+
+	for _, mapping := range m.mappings {
+		value, ok, err := mapping.find(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidEvent, mapping.Key, err)
+		}
+
+		if !ok {
+			if mapping.Default == nil {
+				continue
+			}
+
+			value = mapping.Default
+		}
+
+		overrides = append(overrides, valueSet{helmKey: mapping.Key, data: value})
+	}
+
+	return overrides, nil
+}
+
+// find returns the value matched by the mapping's path, coerced to its type
+func (m *valueMapping) find(data map[string]interface{}) (interface{}, bool, error) {
+	results, err := m.path.FindResults(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches := []interface{}{}
+
+	for _, result := range results {
+		for _, value := range result {
+			if value.IsValid() && value.CanInterface() && value.Interface() != nil {
+				matches = append(matches, value.Interface())
+			}
+		}
+	}
+
+	var value interface{}
+
+	switch {
+	case len(matches) == 0:
+		return nil, false, nil
+	case len(matches) == 1:
+		value = matches[0]
+	case m.Type == MappingTypeJSON:
+		value = matches
+	default:
+		return nil, false, fmt.Errorf("%w: %d values matched %s", ErrInvalidValueMapping, len(matches), m.Path)
+	}
+
+	value, err = coerceValue(value, m.Type)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+// coerceValue converts a value decoded from JSON or YAML to typ
+func coerceValue(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case MappingTypeJSON:
+		return normalizeJSON(value)
+	case MappingTypeString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case bool, int, int64, float64:
+			return fmt.Sprint(v), nil
+		}
+	case MappingTypeInt:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) <= maxExactInteger {
+				return int64(v), nil
+			}
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		}
+	case MappingTypeFloat:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+	case MappingTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidValueMapping, typ)
+	}
+
+	return nil, fmt.Errorf("%w: cannot convert %v to %s", ErrInvalidValueMapping, value, typ)
+}
+
+// normalizeJSON round trips a value through JSON so maps read from YAML
+// match those decoded from events
+func normalizeJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
+
+// releaseValues returns the mapped values of a release so they are kept when
+// it is redeployed without the event that set them
+func (m *ValueMapper) releaseValues(config map[string]interface{}) []valueSet {
+	if m == nil {
+		return nil
+	}
+
+	overrides := []valueSet{}
+
+	for _, mapping := range m.mappings {
+		if value, ok := lookupValue(config, mapping.Key); ok && value != nil {
+			overrides = append(overrides, valueSet{helmKey: mapping.Key, data: value})
+		}
+	}
+
+	return overrides
+}
+
+// encodeValues records mapped values in a LoadBalancer spec, keyed by their
+// chart values key
+func encodeValues(overrides []valueSet) (*runtime.RawExtension, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+
+	values := map[string]interface{}{}
+	for _, override := range overrides {
+		values[override.helmKey] = override.data
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: data}, nil
+}
+
+// decodeValues returns the mapped values recorded in a LoadBalancer spec,
+// ordered by key
+func decodeValues(raw *runtime.RawExtension) ([]valueSet, error) {
+	if raw == nil || len(raw.Raw) == 0 {
+		return nil, nil
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(raw.Raw, &values); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidValueMapping, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		// a null value sets nothing, leaving the key as in the loaded values
+		if value == nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	overrides := make([]valueSet, 0, len(keys))
+	for _, key := range keys {
+		overrides = append(overrides, valueSet{helmKey: key, data: values[key]})
+	}
+
+	return overrides, nil
+}
@@ -0,0 +1,275 @@
+package srv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestNewValueMapper(t *testing.T) {
+	type testCase struct {
+		name        string
+		mappings    []ValueMapping
+		allowedKeys []string
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name:        "allowed key",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt}},
+			allowedKeys: []string{"replicaCount"},
+		},
+		{
+			name:        "nested under allowed key",
+			mappings:    []ValueMapping{{Path: ".annotations", Key: "service.annotations"}},
+			allowedKeys: []string{"service"},
+		},
+		{
+			name:        "key not allowed",
+			mappings:    []ValueMapping{{Path: "{.image}", Key: "image.repository"}},
+			allowedKeys: []string{"replicaCount", "image.tag"},
+			expectError: ErrValueKeyNotAllowed,
+		},
+		{
+			name:        "no allowed keys",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "replicaCount"}},
+			expectError: ErrValueKeyNotAllowed,
+		},
+		{
+			name:        "prefix of allowed key is not a parent",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "replicaCountMax"}},
+			allowedKeys: []string{"replicaCount"},
+			expectError: ErrValueKeyNotAllowed,
+		},
+		{
+			name:        "empty key part",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "service..port"}},
+			allowedKeys: []string{"service"},
+			expectError: ErrInvalidValueMapping,
+		},
+		{
+			name:        "invalid path",
+			mappings:    []ValueMapping{{Path: "{.replicas[}", Key: "replicaCount"}},
+			allowedKeys: []string{"replicaCount"},
+			expectError: ErrInvalidValueMapping,
+		},
+		{
+			name:        "unknown type",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "replicaCount", Type: "uint", Default: 1}},
+			allowedKeys: []string{"replicaCount"},
+			expectError: ErrInvalidValueMapping,
+		},
+		{
+			name:        "invalid default",
+			mappings:    []ValueMapping{{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt, Default: "many"}},
+			allowedKeys: []string{"replicaCount"},
+			expectError: ErrInvalidValueMapping,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			mapper, err := NewValueMapper(tcase.mappings, tcase.allowedKeys)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				assert.Nil(t, mapper)
+			} else {
+				assert.Nil(t, err)
+				assert.Len(t, mapper.mappings, len(tcase.mappings))
+			}
+		})
+	}
+}
+
+func TestValueMapperMap(t *testing.T) {
+	type testCase struct {
+		name         string
+		mapping      ValueMapping
+		data         map[string]interface{}
+		expectError  error
+		expectValues []valueSet
+	}
+
+	testCases := []testCase{
+		{
+			name:         "int from number",
+			mapping:      ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt},
+			data:         map[string]interface{}{"replicas": float64(3)},
+			expectValues: []valueSet{{helmKey: "replicaCount", data: int64(3)}},
+		},
+		{
+			name:         "int from string",
+			mapping:      ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt},
+			data:         map[string]interface{}{"replicas": "3"},
+			expectValues: []valueSet{{helmKey: "replicaCount", data: int64(3)}},
+		},
+		{
+			name:        "int from fraction",
+			mapping:     ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt},
+			data:        map[string]interface{}{"replicas": 2.5},
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:         "string from number",
+			mapping:      ValueMapping{Path: "{.ports[0].number}", Key: "service.port", Type: MappingTypeString},
+			data:         map[string]interface{}{"ports": []interface{}{map[string]interface{}{"number": float64(443)}}},
+			expectValues: []valueSet{{helmKey: "service.port", data: "443"}},
+		},
+		{
+			name:         "bool from string",
+			mapping:      ValueMapping{Path: "features.proxyProtocol", Key: "proxyProtocol", Type: MappingTypeBool},
+			data:         map[string]interface{}{"features": map[string]interface{}{"proxyProtocol": "true"}},
+			expectValues: []valueSet{{helmKey: "proxyProtocol", data: true}},
+		},
+		{
+			name:        "bool from map",
+			mapping:     ValueMapping{Path: "{.features}", Key: "proxyProtocol", Type: MappingTypeBool},
+			data:        map[string]interface{}{"features": map[string]interface{}{"proxyProtocol": true}},
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:         "float from number",
+			mapping:      ValueMapping{Path: "{.weight}", Key: "weight", Type: MappingTypeFloat},
+			data:         map[string]interface{}{"weight": 0.5},
+			expectValues: []valueSet{{helmKey: "weight", data: 0.5}},
+		},
+		{
+			name:    "json map",
+			mapping: ValueMapping{Path: "{.annotations}", Key: "service.annotations"},
+			data:    map[string]interface{}{"annotations": map[string]interface{}{"example.com/tier": "edge"}},
+			expectValues: []valueSet{{
+				helmKey: "service.annotations",
+				data:    map[string]interface{}{"example.com/tier": "edge"},
+			}},
+		},
+		{
+			name:         "json list of matches",
+			mapping:      ValueMapping{Path: "{.ports[*].number}", Key: "ports"},
+			data:         map[string]interface{}{"ports": []interface{}{map[string]interface{}{"number": float64(80)}, map[string]interface{}{"number": float64(443)}}},
+			expectValues: []valueSet{{helmKey: "ports", data: []interface{}{float64(80), float64(443)}}},
+		},
+		{
+			name:        "several matches for a scalar",
+			mapping:     ValueMapping{Path: "{.ports[*].number}", Key: "port", Type: MappingTypeInt},
+			data:        map[string]interface{}{"ports": []interface{}{map[string]interface{}{"number": float64(80)}, map[string]interface{}{"number": float64(443)}}},
+			expectError: ErrInvalidEvent,
+		},
+		{
+			name:         "missing with default",
+			mapping:      ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt, Default: 2},
+			data:         map[string]interface{}{},
+			expectValues: []valueSet{{helmKey: "replicaCount", data: int64(2)}},
+		},
+		{
+			name:         "null with default",
+			mapping:      ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt, Default: 2},
+			data:         map[string]interface{}{"replicas": nil},
+			expectValues: []valueSet{{helmKey: "replicaCount", data: int64(2)}},
+		},
+		{
+			name:         "missing without default",
+			mapping:      ValueMapping{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt},
+			data:         map[string]interface{}{},
+			expectValues: []valueSet{},
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			mapper, err := NewValueMapper([]ValueMapping{tcase.mapping}, []string{tcase.mapping.Key})
+			assert.Nil(t, err)
+
+			values, err := mapper.Map(tcase.data)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+				assert.True(t, isPermanentError(err))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tcase.expectValues, values)
+			}
+		})
+	}
+}
+
+func TestValueMapperNil(t *testing.T) {
+	var mapper *ValueMapper
+
+	values, err := mapper.Map(map[string]interface{}{"replicas": float64(3)})
+	assert.Nil(t, err)
+	assert.Empty(t, values)
+	assert.Empty(t, mapper.releaseValues(map[string]interface{}{"replicaCount": float64(3)}))
+}
+
+func TestMappedValues(t *testing.T) {
+	mapper, err := NewValueMapper([]ValueMapping{
+		{Path: "{.replicas}", Key: "replicaCount", Type: MappingTypeInt},
+		{Path: "{.annotations}", Key: "service.annotations"},
+	}, []string{"replicaCount", "service"})
+	assert.Nil(t, err)
+
+	mapped, err := mapper.Map(map[string]interface{}{
+		"replicas":    float64(3),
+		"annotations": map[string]interface{}{"example.com/tier": "edge"},
+	})
+	assert.Nil(t, err)
+
+	srv := &Server{values: map[string]interface{}{"replicaCount": 1}}
+
+	vals, err := srv.newHelmValues(context.Background(), mapped)
+	assert.Nil(t, err)
+	assert.True(t, valuesEqual(map[string]interface{}{
+		"replicaCount": 3,
+		"service": map[string]interface{}{
+			"annotations": map[string]interface{}{"example.com/tier": "edge"},
+		},
+	}, vals))
+
+	// the values are kept from the release when redeploying it
+	assert.ElementsMatch(t, mapped, mapper.releaseValues(vals))
+
+	// and recorded in LoadBalancer resources
+	raw, err := encodeValues(mapped)
+	assert.Nil(t, err)
+
+	decoded, err := decodeValues(raw)
+	assert.Nil(t, err)
+
+	redeployed, err := srv.newHelmValues(context.Background(), decoded)
+	assert.Nil(t, err)
+	assert.True(t, valuesEqual(vals, redeployed))
+
+	raw, err = encodeValues(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, raw)
+
+	decoded, err = decodeValues(raw)
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+}
+
+func TestNullMappedValues(t *testing.T) {
+	mapper, err := NewValueMapper([]ValueMapping{
+		{Path: "{.replicas}", Key: "replicaCount"},
+	}, []string{"replicaCount"})
+	assert.Nil(t, err)
+
+	srv := &Server{values: map[string]interface{}{"replicaCount": 1}}
+
+	// a null recorded in a LoadBalancer resource leaves the key unset
+	decoded, err := decodeValues(&runtime.RawExtension{Raw: []byte(`{"replicaCount":null}`)})
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+
+	// as does a null kept in a release
+	assert.Empty(t, mapper.releaseValues(map[string]interface{}{"replicaCount": nil}))
+
+	// and an override without a value
+	vals, err := srv.newHelmValues(context.Background(), []valueSet{{helmKey: "replicaCount"}})
+	assert.Nil(t, err)
+	assert.True(t, valuesEqual(map[string]interface{}{"replicaCount": 1}, vals))
+}
@@ -0,0 +1,141 @@
+package srv
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+const (
+	metricsNamespace = "loadbalanceroperator"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+
+	// eventTypeInvalid labels messages that could not be decoded
+	eventTypeInvalid = "invalid"
+	// eventTypeOther labels messages with an event type the operator does not
+	// handle, keeping the label cardinality bounded
+	eventTypeOther = "other"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Number of messages received, by event type.",
+	}, []string{"event_type"})
+
+	eventsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_skipped_total",
+		Help:      "Number of events skipped as duplicates of applied events or older than the last applied event, by reason.",
+	}, []string{"reason"})
+
+	validationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "validation_failures_total",
+		Help:      "Number of events rejected for invalid loadbalancer data, by field.",
+	}, []string{"field"})
+
+	handlerResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_results_total",
+		Help:      "Number of messages processed by each handler, by result.",
+	}, []string{"handler", "result"})
+
+	helmOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "helm_operation_duration_seconds",
+		Help:      "Duration of helm install, upgrade and uninstall operations.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "result"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_duration_seconds",
+		Help:      "Duration of requests for load balancer definitions from their QueryURL, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	namespaceApplyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespace_apply_duration_seconds",
+		Help:      "Duration of applying load balancer namespaces.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	messagesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_in_flight",
+		Help:      "Number of messages currently being processed.",
+	})
+
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this replica holds the leader lease and is processing messages.",
+	})
+
+	driftDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_detected_total",
+		Help:      "Number of times a deployed release was found to have drifted, by reason.",
+	}, []string{"reason"})
+
+	driftRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_repairs_total",
+		Help:      "Number of upgrades made to repair drifted releases, by result.",
+	}, []string{"result"})
+
+	chartReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "chart_reloads_total",
+		Help:      "Number of times the chart and values were reloaded, by result.",
+	}, []string{"result"})
+
+	chartLoaded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "chart_info",
+		Help:      "The chart currently used to deploy loadbalancers.",
+	}, []string{"name", "version", "digest"})
+
+	clusterHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cluster_healthy",
+		Help:      "Whether the last health check of a cluster succeeded.",
+	}, []string{"cluster"})
+
+	fleetUpgradeReleases = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fleet_upgrade_releases_total",
+		Help:      "Number of releases handled by fleet upgrades, by outcome.",
+	}, []string{"outcome"})
+
+	fleetUpgradeRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "fleet_upgrade_remaining_releases",
+		Help:      "Number of releases the running fleet upgrade has yet to attempt.",
+	})
+)
+
+// eventTypeLabel bounds the event type label to the types the operator handles
+func eventTypeLabel(eventType string) string {
+	switch eventType {
+	case events.EVENTCREATE, events.EVENTUPDATE, events.EVENTDELETE, eventTypeInvalid:
+		return eventType
+	default:
+		return eventTypeOther
+	}
+}
+
+// resultLabel returns the result label for an error
+func resultLabel(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+
+	return resultSuccess
+}
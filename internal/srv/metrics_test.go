@@ -0,0 +1,106 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"go.infratographer.com/x/pubsubx"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func TestEventTypeLabel(t *testing.T) {
+	type testCase struct {
+		name      string
+		eventType string
+		expected  string
+	}
+
+	testCases := []testCase{
+		{
+			name:      "create",
+			eventType: events.EVENTCREATE,
+			expected:  events.EVENTCREATE,
+		},
+		{
+			name:      "delete",
+			eventType: events.EVENTDELETE,
+			expected:  events.EVENTDELETE,
+		},
+		{
+			name:      "invalid",
+			eventType: eventTypeInvalid,
+			expected:  eventTypeInvalid,
+		},
+		{
+			name:      "unknown",
+			eventType: uuid.NewString(),
+			expected:  eventTypeOther,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, eventTypeLabel(tcase.eventType))
+		})
+	}
+}
+
+func TestMessageHandlerMetrics(t *testing.T) {
+	type testCase struct {
+		name      string
+		data      []byte
+		eventType string
+		result    string
+	}
+
+	unknown, err := json.Marshal(pubsubx.Message{
+		SubjectURN: uuid.NewString(),
+		EventType:  "resize",
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name:      "invalid message",
+			data:      []byte("not json"),
+			eventType: eventTypeInvalid,
+			result:    resultFailure,
+		},
+		{
+			name:      "unknown event type",
+			data:      unknown,
+			eventType: eventTypeOther,
+			result:    resultSuccess,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Context: context.TODO(),
+				Logger:  zap.NewNop().Sugar(),
+			}
+
+			received := testutil.ToFloat64(messagesReceived.WithLabelValues(tcase.eventType))
+			results := testutil.ToFloat64(handlerResults.WithLabelValues(tcase.eventType, tcase.result))
+
+			srv.MessageHandler(&nats.Msg{Subject: "lbo.events", Data: tcase.data})
+
+			assert.Equal(t, received+1, testutil.ToFloat64(messagesReceived.WithLabelValues(tcase.eventType)))
+			assert.Equal(t, results+1, testutil.ToFloat64(handlerResults.WithLabelValues(tcase.eventType, tcase.result)))
+			assert.Equal(t, float64(0), testutil.ToFloat64(messagesInFlight))
+		})
+	}
+}
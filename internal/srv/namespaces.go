@@ -0,0 +1,89 @@
+package srv
+
+import (
+	"context"
+	"sync"
+)
+
+// namespaceLocks serializes removing a namespace against deploying into it.
+// Deploys share the lock of their namespace while removing it takes the lock
+// exclusively, so a namespace is never deleted between being ensured and a
+// release being installed in it.
+type namespaceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*namespaceLock
+}
+
+// namespaceLock is the lock of a single namespace, counting the deploys and
+// removals holding or waiting for it so idle locks can be dropped
+type namespaceLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// acquire locks key, exclusively when exclusive is set, and returns the
+// function releasing it
+func (l *namespaceLocks) acquire(key string, exclusive bool) func() {
+	l.mu.Lock()
+
+	if l.locks == nil {
+		l.locks = map[string]*namespaceLock{}
+	}
+
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &namespaceLock{}
+		l.locks[key] = lock
+	}
+
+	lock.refs++
+	l.mu.Unlock()
+
+	if exclusive {
+		lock.Lock()
+	} else {
+		lock.RLock()
+	}
+
+	return func() {
+		if exclusive {
+			lock.Unlock()
+		} else {
+			lock.RUnlock()
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// heldNamespacesKey is the context key holding the namespace locks already
+// held by a request
+type heldNamespacesKey struct{}
+
+// lockNamespace runs fn holding the lock of namespace in the cluster ctx is
+// directed at, exclusively when exclusive is set. A lock already held by ctx
+// is not taken again, so deploys may nest.
+func (s *Server) lockNamespace(ctx context.Context, namespace string, exclusive bool, fn func(context.Context) error) error {
+	key := s.cluster(ctx).Name + "/" + namespace
+
+	held, _ := ctx.Value(heldNamespacesKey{}).(map[string]bool)
+	if held[key] {
+		return fn(ctx)
+	}
+
+	release := s.namespaceLocks.acquire(key, exclusive)
+	defer release()
+
+	nested := map[string]bool{key: true}
+	for k := range held {
+		nested[k] = true
+	}
+
+	return fn(context.WithValue(ctx, heldNamespacesKey{}, nested))
+}
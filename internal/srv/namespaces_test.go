@@ -0,0 +1,78 @@
+package srv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/client-go/rest"
+)
+
+func TestLockNamespace(t *testing.T) {
+	srv := &Server{
+		Logger:     zap.NewNop().Sugar(),
+		KubeClient: &rest.Config{Host: "http://127.0.0.1:1"},
+	}
+
+	deploying := make(chan struct{})
+	finishDeploy := make(chan struct{})
+	deployDone := make(chan struct{})
+
+	go func() {
+		defer close(deployDone)
+
+		_ = srv.lockNamespace(context.Background(), "tenant", false, func(ctx context.Context) error {
+			// nested deploys reuse the lock already held
+			return srv.lockNamespace(ctx, "tenant", false, func(context.Context) error {
+				close(deploying)
+				<-finishDeploy
+
+				return nil
+			})
+		})
+	}()
+
+	<-deploying
+
+	// deploys to the same namespace run alongside each other
+	assert.Nil(t, srv.lockNamespace(context.Background(), "tenant", false, func(context.Context) error { return nil }))
+
+	removed := make(chan struct{})
+	removeDone := make(chan struct{})
+
+	go func() {
+		defer close(removeDone)
+
+		_ = srv.lockNamespace(context.Background(), "tenant", true, func(context.Context) error {
+			close(removed)
+			return nil
+		})
+	}()
+
+	// other namespaces are not held up
+	assert.Nil(t, srv.lockNamespace(context.Background(), "other", true, func(context.Context) error { return nil }))
+
+	select {
+	case <-removed:
+		t.Fatal("namespace removed while a loadbalancer was being deployed to it")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(finishDeploy)
+	<-deployDone
+
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("namespace not removed once the deploy finished")
+	}
+
+	<-removeDone
+
+	srv.namespaceLocks.mu.Lock()
+	defer srv.namespaceLocks.mu.Unlock()
+
+	assert.Empty(t, srv.namespaceLocks.locks)
+}
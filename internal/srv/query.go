@@ -0,0 +1,220 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+const (
+	defaultQueryTimeout   = 10 * time.Second
+	defaultQueryValuesKey = "loadBalancer"
+	queryRetryDelay       = 500 * time.Millisecond
+
+	// maxSpecSize bounds the loadbalancer definition read from a QueryURL
+	maxSpecSize = 1 << 20
+	// maxQueryRedirects bounds the redirects followed for a QueryURL
+	maxQueryRedirects = 10
+)
+
+// queryOverrides returns the value overrides for a loadbalancer, including
+// its full definition fetched from QueryURL when fetching is enabled
+func (s *Server) queryOverrides(ctx context.Context, lbdata *events.LoadBalancerData) ([]valueSet, error) {
+	overrides := newHelmOverrides(lbdata)
+
+	if !s.QueryEnabled || lbdata.QueryURL == "" {
+		return overrides, nil
+	}
+
+	spec, err := s.fetchLoadBalancerSpec(ctx, lbdata.QueryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(overrides, valueSet{helmKey: s.queryValuesKey(), data: spec}), nil
+}
+
+// queryValuesKey returns the chart values key the fetched definition is
+// placed under
+func (s *Server) queryValuesKey() string {
+	if s.QueryValuesKey == "" {
+		return defaultQueryValuesKey
+	}
+
+	return s.QueryValuesKey
+}
+
+// fetchLoadBalancerSpec GETs the loadbalancer definition from queryURL,
+// retrying network errors and server errors up to QueryRetries times. Client
+// errors and definitions that are not JSON objects are permanent and wrap
+// ErrInvalidEvent.
+func (s *Server) fetchLoadBalancerSpec(ctx context.Context, queryURL string) (spec map[string]interface{}, err error) {
+	ctx, span := tracer.Start(ctx, "fetchLoadBalancerSpec", trace.WithSpanKind(trace.SpanKindClient))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	u, err := url.Parse(queryURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid query url %q", ErrInvalidEvent, queryURL)
+	}
+
+	span.SetAttributes(attribute.String("http.url", u.Redacted()))
+
+	// the query token must only ever be sent to the configured services
+	if !s.queryURLAllowed(u) {
+		return nil, fmt.Errorf("%w: %s", ErrQueryURLNotAllowed, u.Redacted())
+	}
+
+	delay := queryRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		spec, err = s.getLoadBalancerSpec(ctx, u.String())
+		queryDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+
+		if err == nil || isPermanentError(err) || attempt >= s.QueryRetries {
+			return spec, err
+		}
+
+		s.Logger.Warnw("unable to fetch loadbalancer definition, retrying", "url", u.Redacted(), "attempt", attempt+1, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// getLoadBalancerSpec makes a single request for a loadbalancer definition
+func (s *Server) getLoadBalancerSpec(ctx context.Context, queryURL string) (map[string]interface{}, error) {
+	timeout := s.QueryTimeout
+	if timeout <= 0 {
+		timeout = defaultQueryTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	token, err := s.queryToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := http.Client{}
+	if s.QueryClient != nil {
+		client = *s.QueryClient
+	}
+
+	// redirects are held to the allowed urls as well
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !s.queryURLAllowed(req.URL) {
+			return fmt.Errorf("%w: redirected to %s", ErrQueryURLNotAllowed, req.URL.Redacted())
+		}
+
+		if len(via) >= maxQueryRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrQueryFailed, maxQueryRedirects)
+		}
+
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSpecSize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusRequestTimeout:
+		return nil, fmt.Errorf("%w: %s", ErrQueryFailed, resp.Status)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return nil, fmt.Errorf("%w: loadbalancer definition request rejected: %s", ErrInvalidEvent, resp.Status)
+	}
+
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal(body, &spec); err != nil {
+		return nil, fmt.Errorf("%w: invalid loadbalancer definition: %s", ErrInvalidEvent, err)
+	}
+
+	return spec, nil
+}
+
+// queryURLAllowed reports whether u is under one of the QueryAllowedURLs,
+// matching the scheme and host exactly and the path on whole segments. URLs
+// carrying credentials are never allowed.
+func (s *Server) queryURLAllowed(u *url.URL) bool {
+	if u.User != nil {
+		return false
+	}
+
+	// requests for /api/../admin must not pass as being under /api
+	p := path.Clean("/" + u.Path)
+
+	for _, base := range s.QueryAllowedURLs {
+		if !strings.EqualFold(u.Scheme, base.Scheme) || !strings.EqualFold(u.Host, base.Host) {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(path.Clean("/"+base.Path), "/")
+		if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryToken returns the bearer token sent with QueryURL requests. The token
+// file is read on every request so rotated tokens are picked up.
+func (s *Server) queryToken() (string, error) {
+	if s.QueryTokenFile == "" {
+		return s.QueryToken, nil
+	}
+
+	token, err := os.ReadFile(s.QueryTokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
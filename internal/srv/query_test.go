@@ -0,0 +1,243 @@
+package srv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/release"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func TestFetchLoadBalancerSpec(t *testing.T) {
+	type testCase struct {
+		name          string
+		path          string
+		failures      int32
+		retries       int
+		expectSpec    map[string]interface{}
+		expectError   error
+		expectPerm    bool
+		expectAttempt int32
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := `{"ports":[{"name":"http","port":80,"pools":["web"]}],"tls":{"enabled":true}}`
+
+	testCases := []testCase{
+		{
+			name:          "definition fetched",
+			path:          "/lb",
+			expectAttempt: 1,
+			expectSpec: map[string]interface{}{
+				"ports": []interface{}{map[string]interface{}{"name": "http", "port": float64(80), "pools": []interface{}{"web"}}},
+				"tls":   map[string]interface{}{"enabled": true},
+			},
+		},
+		{
+			name:          "server errors are retried",
+			path:          "/lb",
+			failures:      2,
+			retries:       2,
+			expectAttempt: 3,
+			expectSpec: map[string]interface{}{
+				"ports": []interface{}{map[string]interface{}{"name": "http", "port": float64(80), "pools": []interface{}{"web"}}},
+				"tls":   map[string]interface{}{"enabled": true},
+			},
+		},
+		{
+			name:          "retries exhausted",
+			path:          "/lb",
+			failures:      2,
+			retries:       1,
+			expectAttempt: 2,
+			expectError:   ErrQueryFailed,
+		},
+		{
+			name:          "missing definition",
+			path:          "/missing",
+			retries:       2,
+			expectAttempt: 1,
+			expectError:   ErrInvalidEvent,
+			expectPerm:    true,
+		},
+		{
+			name:          "invalid definition",
+			path:          "/invalid",
+			expectAttempt: 1,
+			expectError:   ErrInvalidEvent,
+			expectPerm:    true,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			var attempts int32
+
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := atomic.AddInt32(&attempts, 1)
+
+				switch {
+				case r.Header.Get("Authorization") != "Bearer secret":
+					w.WriteHeader(http.StatusUnauthorized)
+				case attempt <= tcase.failures:
+					w.WriteHeader(http.StatusServiceUnavailable)
+				case r.URL.Path == "/lb":
+					_, _ = w.Write([]byte(spec))
+				case r.URL.Path == "/invalid":
+					_, _ = w.Write([]byte("[]"))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer api.Close()
+
+			srv := &Server{
+				Logger:           zap.NewNop().Sugar(),
+				QueryAllowedURLs: []*url.URL{mustParseURL(t, api.URL)},
+				QueryTokenFile:   tokenFile,
+				QueryRetries:     tcase.retries,
+			}
+
+			spec, err := srv.fetchLoadBalancerSpec(context.Background(), api.URL+tcase.path)
+
+			if tcase.expectError != nil {
+				assert.ErrorIs(t, err, tcase.expectError)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, tcase.expectPerm, isPermanentError(err))
+			assert.Equal(t, tcase.expectSpec, spec)
+			assert.Equal(t, tcase.expectAttempt, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func TestFetchLoadBalancerSpecInvalidURL(t *testing.T) {
+	srv := &Server{Logger: zap.NewNop().Sugar()}
+
+	for _, queryURL := range []string{"ftp://example.com/lb", "/lb", "://"} {
+		_, err := srv.fetchLoadBalancerSpec(context.Background(), queryURL)
+		assert.ErrorIs(t, err, ErrInvalidEvent, queryURL)
+	}
+}
+
+func TestFetchLoadBalancerSpecNotAllowed(t *testing.T) {
+	var requests int32
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if r.URL.Path == "/lbs/redirect" {
+			http.Redirect(w, r, "/internal/metadata", http.StatusFound)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"replicas":2}`))
+	}))
+	defer api.Close()
+
+	srv := &Server{
+		Logger:           zap.NewNop().Sugar(),
+		QueryAllowedURLs: []*url.URL{mustParseURL(t, api.URL+"/lbs/")},
+		QueryToken:       "secret",
+	}
+
+	apiURL := mustParseURL(t, api.URL)
+
+	for _, queryURL := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		api.URL + "/internal/metadata",
+		api.URL + "/lbs/../internal/metadata",
+		api.URL + "/lbsadmin",
+		"https://" + apiURL.Host + "/lbs/1",
+		"http://user:pass@" + apiURL.Host + "/lbs/1",
+	} {
+		_, err := srv.fetchLoadBalancerSpec(context.Background(), queryURL)
+		assert.ErrorIs(t, err, ErrQueryURLNotAllowed, queryURL)
+		assert.True(t, isPermanentError(err), queryURL)
+	}
+
+	// rejected urls are never requested
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	spec, err := srv.fetchLoadBalancerSpec(context.Background(), api.URL+"/lbs/1")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"replicas": float64(2)}, spec)
+
+	_, err = srv.fetchLoadBalancerSpec(context.Background(), api.URL+"/lbs/redirect")
+	assert.ErrorIs(t, err, ErrQueryURLNotAllowed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// nothing is allowed until urls are configured
+	srv.QueryAllowedURLs = nil
+
+	_, err = srv.fetchLoadBalancerSpec(context.Background(), api.URL+"/lbs/1")
+	assert.ErrorIs(t, err, ErrQueryURLNotAllowed)
+}
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestQueryOverrides(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"replicas":2}`))
+	}))
+	defer api.Close()
+
+	lbdata := &events.LoadBalancerData{LoadBalancerID: uuid.New(), QueryURL: api.URL}
+
+	srv := &Server{
+		Logger:           zap.NewNop().Sugar(),
+		QueryAllowedURLs: []*url.URL{mustParseURL(t, api.URL)},
+		values:           map[string]interface{}{},
+	}
+
+	overrides, err := srv.queryOverrides(context.Background(), lbdata)
+	assert.Nil(t, err)
+	assert.Equal(t, newHelmOverrides(lbdata), overrides)
+
+	srv.QueryEnabled = true
+	srv.QueryValuesKey = "config.loadBalancer"
+
+	overrides, err = srv.queryOverrides(context.Background(), lbdata)
+	assert.Nil(t, err)
+
+	vals, err := srv.newHelmValues(context.Background(), overrides)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"loadBalancer": map[string]interface{}{"replicas": float64(2)},
+	}, vals["config"])
+
+	// the definition is carried over from the release when checking drift
+	rel := &release.Release{Config: vals}
+
+	recovered, err := srv.desiredOverrides(context.Background(), rel)
+	assert.Nil(t, err)
+
+	desired, err := srv.newHelmValues(context.Background(), recovered)
+	assert.Nil(t, err)
+	assert.True(t, valuesEqual(vals, desired))
+}
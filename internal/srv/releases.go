@@ -0,0 +1,272 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// overridesAnnotation is the chart annotation recording the overrides a
+// release was deployed with
+const overridesAnnotation = "loadbalanceroperator.infratographer.com/overrides"
+
+// recordedOverride is an override as recorded by recordOverrides
+type recordedOverride struct {
+	Key   string      `json:"key"`
+	Value string      `json:"value,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// releaseConfig returns the chart and values a release is deployed with for
+// a set of overrides. It must be called with chartMu held.
+func (s *Server) releaseConfig(ctx context.Context, overrides []valueSet) (*chart.Chart, map[string]interface{}, error) {
+	values, err := s.newHelmValues(ctx, overrides)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, err := recordOverrides(s.Chart, overrides)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ch, values, nil
+}
+
+// recordOverrides returns a copy of ch whose metadata records the overrides
+// a release is deployed with. Released values hold the overrides merged with
+// the values file, so the record is what allows the overrides to be applied
+// again on top of a changed values file.
+func recordOverrides(ch *chart.Chart, overrides []valueSet) (*chart.Chart, error) {
+	recorded := []recordedOverride{}
+
+	for _, override := range overrides {
+		if override.data == nil && override.value == "" {
+			continue
+		}
+
+		recorded = append(recorded, recordedOverride{Key: override.helmKey, Value: override.value, Data: override.data})
+	}
+
+	d, err := json.Marshal(recorded)
+	if err != nil {
+		return nil, err
+	}
+
+	return annotateChart(ch, overridesAnnotation, string(d)), nil
+}
+
+// recordedOverrides returns the overrides recorded by recordOverrides for a
+// release. The boolean is false for releases deployed before overrides were
+// recorded.
+func recordedOverrides(rel *release.Release) ([]valueSet, bool, error) {
+	if rel.Chart == nil || rel.Chart.Metadata == nil {
+		return nil, false, nil
+	}
+
+	raw, ok := rel.Chart.Metadata.Annotations[overridesAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+
+	recorded := []recordedOverride{}
+	if err := json.Unmarshal([]byte(raw), &recorded); err != nil {
+		return nil, false, err
+	}
+
+	overrides := make([]valueSet, 0, len(recorded))
+	for _, override := range recorded {
+		overrides = append(overrides, valueSet{helmKey: override.Key, value: override.Value, data: override.Data})
+	}
+
+	return overrides, true, nil
+}
+
+// deployRelease brings a release in line with the provided chart and values. Missing
+// releases are installed, releases stuck in a pending or uninstalling state
+// are recovered and everything else is upgraded. When force is false a
+// deployed release whose chart and values already match is left untouched,
+// so redelivered events do not produce new revisions.
+func (s *Server) deployRelease(client *action.Configuration, ch *chart.Chart, releaseName string, namespace string, values map[string]interface{}, force bool) error {
+	last, err := client.Releases.Last(releaseName)
+	if err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return s.installRelease(client, ch, releaseName, namespace, values)
+		}
+
+		s.Logger.Errorw("unable to retrieve release", "release", releaseName, "error", err)
+
+		return err
+	}
+
+	switch {
+	case last.Info.Status.IsPending(), last.Info.Status == release.StatusUninstalling, last.Info.Status == release.StatusUninstalled:
+		s.Logger.Warnw("recovering release", "release", releaseName, "namespace", namespace, "status", last.Info.Status.String())
+
+		return s.recoverRelease(client, ch, last, namespace, values)
+	case !force && last.Info.Status == release.StatusDeployed && releaseMatches(last, ch, values):
+		s.Logger.Infof("%s is already deployed to %s with matching values, skipping", releaseName, namespace)
+
+		return nil
+	default:
+		return s.upgradeRelease(client, ch, releaseName, namespace, values)
+	}
+}
+
+// recoverRelease returns a release that is stuck mid-operation to a state
+// that can be upgraded. Releases that have been deployed before are rolled
+// back to their last deployed revision, anything else is removed and
+// installed from scratch.
+func (s *Server) recoverRelease(client *action.Configuration, ch *chart.Chart, last *release.Release, namespace string, values map[string]interface{}) error {
+	deployed, err := client.Releases.Deployed(last.Name)
+	if err != nil && !errors.Is(err, driver.ErrNoDeployedReleases) {
+		s.Logger.Errorw("unable to retrieve deployed release", "release", last.Name, "error", err)
+		return err
+	}
+
+	if deployed == nil || last.Info.Status == release.StatusUninstalling || last.Info.Status == release.StatusUninstalled {
+		if err := s.uninstallRelease(client, last.Name, namespace); err != nil {
+			return err
+		}
+
+		return s.installRelease(client, ch, last.Name, namespace, values)
+	}
+
+	rb := action.NewRollback(client)
+	rb.Version = deployed.Version
+
+	start := time.Now()
+	err = rb.Run(last.Name)
+	helmOperationDuration.WithLabelValues("rollback", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.Logger.Errorf("unable to roll back %s in %s", last.Name, namespace)
+		return err
+	}
+
+	return s.upgradeRelease(client, ch, last.Name, namespace, values)
+}
+
+func (s *Server) installRelease(client *action.Configuration, ch *chart.Chart, releaseName string, namespace string, values map[string]interface{}) error {
+	hc := action.NewInstall(client)
+	hc.ReleaseName = releaseName
+	hc.Namespace = namespace
+
+	start := time.Now()
+	_, err := hc.Run(ch, values)
+	helmOperationDuration.WithLabelValues("install", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.Logger.Errorf("unable to deploy %s to %s", releaseName, namespace)
+		return err
+	}
+
+	s.Logger.Infof("%s deployed to %s successfully", releaseName, namespace)
+
+	return nil
+}
+
+func (s *Server) upgradeRelease(client *action.Configuration, ch *chart.Chart, releaseName string, namespace string, values map[string]interface{}) error {
+	hc := action.NewUpgrade(client)
+	hc.Namespace = namespace
+
+	start := time.Now()
+	_, err := hc.Run(releaseName, ch, values)
+	helmOperationDuration.WithLabelValues("upgrade", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.Logger.Errorf("unable to upgrade %s in %s", releaseName, namespace)
+		return err
+	}
+
+	s.Logger.Infof("%s upgraded in %s successfully", releaseName, namespace)
+
+	return nil
+}
+
+func (s *Server) uninstallRelease(client *action.Configuration, releaseName string, namespace string) error {
+	hc := action.NewUninstall(client)
+
+	start := time.Now()
+	_, err := hc.Run(releaseName)
+	helmOperationDuration.WithLabelValues("uninstall", resultLabel(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.Logger.Errorf("unable to uninstall %s from %s", releaseName, namespace)
+		return err
+	}
+
+	s.Logger.Infof("%s uninstalled from %s successfully", releaseName, namespace)
+
+	return nil
+}
+
+// releaseMatches reports whether a release was deployed from ch with the
+// provided values. The recorded overrides are only compared for releases
+// that record them, so releases deployed before they were recorded are not
+// all upgraded at once.
+func releaseMatches(rel *release.Release, ch *chart.Chart, values map[string]interface{}) bool {
+	if !chartMatches(rel, ch) || !valuesEqual(rel.Config, values) {
+		return false
+	}
+
+	recorded, ok := rel.Chart.Metadata.Annotations[overridesAnnotation]
+
+	return !ok || recorded == ch.Metadata.Annotations[overridesAnnotation]
+}
+
+// chartMatches reports whether a release was deployed from ch. Besides the
+// name and version the chart digest recorded by annotateChart must match, so
+// releases of a chart changed without a version bump are upgraded.
+func chartMatches(rel *release.Release, ch *chart.Chart) bool {
+	if rel.Chart == nil || rel.Chart.Metadata == nil || ch == nil || ch.Metadata == nil {
+		return false
+	}
+
+	return rel.Chart.Metadata.Name == ch.Metadata.Name &&
+		rel.Chart.Metadata.Version == ch.Metadata.Version &&
+		rel.Chart.Metadata.Annotations[chartDigestAnnotation] == ch.Metadata.Annotations[chartDigestAnnotation]
+}
+
+// valuesEqual compares two sets of chart values. Values are normalized
+// through JSON first since released values are decoded from storage, which
+// changes their types (all numbers become float64 for example).
+func valuesEqual(a, b map[string]interface{}) bool {
+	na, err := normalizeValues(a)
+	if err != nil {
+		return false
+	}
+
+	nb, err := normalizeValues(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(na, nb)
+}
+
+func normalizeValues(values map[string]interface{}) (map[string]interface{}, error) {
+	normalized := map[string]interface{}{}
+
+	if len(values) == 0 {
+		return normalized, nil
+	}
+
+	d, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(d, &normalized); err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,232 @@
+package srv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/release"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func TestDeployRelease(t *testing.T) {
+	type existingRelease struct {
+		status       release.Status
+		chartVersion string
+		chartDigest  string
+		values       map[string]interface{}
+	}
+
+	type testCase struct {
+		name          string
+		existing      []existingRelease
+		values        map[string]interface{}
+		force         bool
+		expectVersion int
+		expectStatus  release.Status
+	}
+
+	testDir, err := os.MkdirTemp("", "test-deploy-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(testDir)
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loader.Load(chartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := annotateChart(loaded, chartDigestAnnotation, digestChart(loaded))
+
+	current := map[string]interface{}{"replicas": 2, "resources": map[string]interface{}{"cpu": "100m"}}
+	changed := map[string]interface{}{"replicas": 3, "resources": map[string]interface{}{"cpu": "100m"}}
+
+	testCases := []testCase{
+		{
+			name:          "missing release is installed",
+			values:        current,
+			expectVersion: 1,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "matching release is left untouched",
+			existing:      []existingRelease{{status: release.StatusDeployed, values: current}},
+			values:        current,
+			expectVersion: 1,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "matching release is upgraded when forced",
+			existing:      []existingRelease{{status: release.StatusDeployed, values: current}},
+			values:        current,
+			force:         true,
+			expectVersion: 2,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "changed values are upgraded",
+			existing:      []existingRelease{{status: release.StatusDeployed, values: current}},
+			values:        changed,
+			expectVersion: 2,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "changed chart version is upgraded",
+			existing:      []existingRelease{{status: release.StatusDeployed, values: current, chartVersion: "0.0.0-old"}},
+			values:        current,
+			expectVersion: 2,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "changed chart contents are upgraded",
+			existing:      []existingRelease{{status: release.StatusDeployed, values: current, chartDigest: "sha256:previous"}},
+			values:        current,
+			expectVersion: 2,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "failed release is upgraded",
+			existing:      []existingRelease{{status: release.StatusFailed, values: current}},
+			values:        current,
+			expectVersion: 2,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name:          "pending install is reinstalled",
+			existing:      []existingRelease{{status: release.StatusPendingInstall, values: current}},
+			values:        current,
+			expectVersion: 1,
+			expectStatus:  release.StatusDeployed,
+		},
+		{
+			name: "pending upgrade is rolled back and upgraded",
+			existing: []existingRelease{
+				{status: release.StatusDeployed, values: current},
+				{status: release.StatusPendingUpgrade, values: changed},
+			},
+			values:        changed,
+			expectVersion: 4,
+			expectStatus:  release.StatusDeployed,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Logger: zap.NewNop().Sugar(),
+				Chart:  ch,
+			}
+
+			client := utils.NewTestHelmConfig()
+			releaseName := newReleaseName("lb", "test")
+
+			for i, existing := range tcase.existing {
+				relChart := ch
+				if existing.chartVersion != "" {
+					relChart = &chart.Chart{Metadata: &chart.Metadata{Name: ch.Metadata.Name, Version: existing.chartVersion}}
+				}
+
+				if existing.chartDigest != "" {
+					relChart = annotateChart(loaded, chartDigestAnnotation, existing.chartDigest)
+				}
+
+				rel := &release.Release{
+					Name:      releaseName,
+					Namespace: "test",
+					Version:   i + 1,
+					Chart:     relChart,
+					Config:    existing.values,
+					Info:      &release.Info{Status: existing.status},
+				}
+
+				if err := client.Releases.Create(rel); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := srv.deployRelease(client, ch, releaseName, "test", tcase.values, tcase.force)
+			assert.Nil(t, err)
+
+			last, err := client.Releases.Last(releaseName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tcase.expectVersion, last.Version)
+			assert.Equal(t, tcase.expectStatus, last.Info.Status)
+			assert.True(t, valuesEqual(tcase.values, last.Config))
+		})
+	}
+}
+
+func TestRecordOverrides(t *testing.T) {
+	ch := &chart.Chart{Metadata: &chart.Metadata{Name: "lb", Annotations: map[string]string{"existing": "kept"}}}
+
+	overrides := []valueSet{
+		{helmKey: "resources.limits.cpu", value: "500m"},
+		{helmKey: "resources.limits.memory", value: ""},
+		{helmKey: "service.enabled", data: false},
+		{helmKey: "event", data: map[string]interface{}{"labels": map[string]interface{}{"tier": "edge"}}},
+	}
+
+	recorded, err := recordOverrides(ch, overrides)
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", recorded.Metadata.Annotations["existing"])
+	assert.NotContains(t, ch.Metadata.Annotations, overridesAnnotation)
+
+	got, ok, err := recordedOverrides(&release.Release{Chart: recorded})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []valueSet{overrides[0], overrides[2], overrides[3]}, got)
+
+	_, ok, err = recordedOverrides(&release.Release{Chart: ch})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestValuesEqual(t *testing.T) {
+	type testCase struct {
+		name     string
+		a        map[string]interface{}
+		b        map[string]interface{}
+		expected bool
+	}
+
+	testCases := []testCase{
+		{
+			name:     "empty and nil",
+			a:        map[string]interface{}{},
+			b:        nil,
+			expected: true,
+		},
+		{
+			name:     "numeric types differ",
+			a:        map[string]interface{}{"replicas": 2},
+			b:        map[string]interface{}{"replicas": float64(2)},
+			expected: true,
+		},
+		{
+			name:     "nested values differ",
+			a:        map[string]interface{}{"resources": map[string]interface{}{"cpu": "100m"}},
+			b:        map[string]interface{}{"resources": map[string]interface{}{"cpu": "200m"}},
+			expected: false,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, valuesEqual(tcase.a, tcase.b))
+		})
+	}
+}
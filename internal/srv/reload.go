@@ -0,0 +1,401 @@
+package srv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+const (
+	// reloadDebounce is how long to wait for file changes to settle before
+	// reloading, ConfigMap updates touch several files at once
+	reloadDebounce = 2 * time.Second
+
+	// chartDigestAnnotation is the chart annotation recording the digest of
+	// the chart a release was deployed from
+	chartDigestAnnotation = "loadbalanceroperator.infratographer.com/chart-digest"
+)
+
+// chartConfig is a chart and the values file it is deployed with
+type chartConfig struct {
+	chart        *chart.Chart
+	values       map[string]interface{}
+	chartDigest  string
+	valuesDigest string
+}
+
+// chartInfo describes the loaded chart on the chart endpoint
+type chartInfo struct {
+	Name         string    `json:"name"`
+	Version      string    `json:"version"`
+	Digest       string    `json:"digest"`
+	ValuesDigest string    `json:"values_digest"`
+	LoadedAt     time.Time `json:"loaded_at"`
+}
+
+// loadChartConfig loads the chart from ChartPath, or uses the chart the
+// server was created with when there is no path to reload from, along with
+// the values file and checks that the chart renders with those values
+func (s *Server) loadChartConfig() (*chartConfig, error) {
+	s.chartMu.RLock()
+	ch := s.Chart
+	s.chartMu.RUnlock()
+
+	if s.ChartPath != "" {
+		loaded, err := loader.Load(s.ChartPath)
+		if err != nil {
+			return nil, err
+		}
+
+		ch = loaded
+	}
+
+	vals := map[string]interface{}{}
+
+	if s.ValuesPath != "" {
+		valOpts := &values.Options{
+			ValueFiles: []string{s.ValuesPath},
+		}
+
+		merged, err := valOpts.MergeValues(getter.All(&cli.EnvSettings{}))
+		if err != nil {
+			return nil, err
+		}
+
+		vals = merged
+	}
+
+	if ch != nil {
+		if err := validateChart(ch, vals); err != nil {
+			return nil, err
+		}
+	}
+
+	valuesDigest, err := digestValues(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	chartDigest := digestChart(ch)
+
+	return &chartConfig{
+		chart:        annotateChart(ch, chartDigestAnnotation, chartDigest),
+		values:       vals,
+		chartDigest:  chartDigest,
+		valuesDigest: valuesDigest,
+	}, nil
+}
+
+// annotateChart returns a copy of ch whose metadata carries an additional
+// annotation. Releases store the metadata of the chart they were deployed
+// from, so the digest recorded this way tells them apart from releases of a
+// chart with the same name and version but different contents.
+func annotateChart(ch *chart.Chart, key string, value string) *chart.Chart {
+	if ch == nil || ch.Metadata == nil {
+		return ch
+	}
+
+	metadata := *ch.Metadata
+	metadata.Annotations = map[string]string{}
+
+	for k, v := range ch.Metadata.Annotations {
+		metadata.Annotations[k] = v
+	}
+
+	metadata.Annotations[key] = value
+
+	annotated := *ch
+	annotated.Metadata = &metadata
+
+	return &annotated
+}
+
+// validateChart checks that a chart is well formed and that its templates
+// render with the provided values. Templates are rendered the way helm lint
+// does, so values the chart marks as required but which are only set for
+// each loadbalancer do not fail the check.
+func validateChart(ch *chart.Chart, vals map[string]interface{}) error {
+	if err := ch.Validate(); err != nil {
+		return err
+	}
+
+	renderVals, err := chartutil.ToRenderValues(ch, vals, chartutil.ReleaseOptions{
+		Name:      "lb-validate",
+		Namespace: "default",
+		IsInstall: true,
+	}, chartutil.DefaultCapabilities)
+	if err != nil {
+		return err
+	}
+
+	_, err = engine.Engine{LintMode: true}.Render(ch, renderVals)
+
+	return err
+}
+
+// reloadChart loads the chart and values and swaps them in once every
+// deployment using the previous ones has finished. It reports whether
+// anything changed. When loading or validation fails the previous chart and
+// values are kept.
+func (s *Server) reloadChart() (bool, error) {
+	cfg, err := s.loadChartConfig()
+	if err != nil {
+		chartReloads.WithLabelValues(resultFailure).Inc()
+		return false, err
+	}
+
+	s.chartMu.Lock()
+	defer s.chartMu.Unlock()
+
+	if s.values != nil && cfg.chartDigest == s.chartDigest && cfg.valuesDigest == s.valuesDigest {
+		return false, nil
+	}
+
+	s.Chart = cfg.chart
+	s.values = cfg.values
+	s.chartDigest = cfg.chartDigest
+	s.valuesDigest = cfg.valuesDigest
+	s.chartLoadedAt = time.Now().UTC()
+
+	chartReloads.WithLabelValues(resultSuccess).Inc()
+
+	chartLoaded.Reset()
+
+	if cfg.chart != nil && cfg.chart.Metadata != nil {
+		chartLoaded.WithLabelValues(cfg.chart.Metadata.Name, cfg.chart.Metadata.Version, cfg.chartDigest).Set(1)
+
+		s.Logger.Infow("loaded chart", "chart", cfg.chart.Metadata.Name, "version", cfg.chart.Metadata.Version,
+			"digest", cfg.chartDigest, "values_digest", cfg.valuesDigest)
+	}
+
+	return true, nil
+}
+
+// watchChart reloads the chart and values whenever their files change. Both
+// the files and their parent directories are watched since ConfigMap mounts
+// are updated by swapping a symlink. When UpgradeOnReload is set and this
+// replica is processing messages, the change is rolled out to the deployed
+// releases by upgradeOnReload without waiting for the next reconcile.
+func (s *Server) watchChart(ctx context.Context) error {
+	targets := map[string]bool{}
+	dirs := map[string]bool{}
+
+	for _, path := range []string{s.ChartPath, s.ValuesPath} {
+		if path == "" {
+			continue
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		targets[filepath.Base(abs)] = true
+		dirs[filepath.Dir(abs)] = true
+	}
+
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var reload <-chan time.Time
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// ..data is the symlink swapped when a ConfigMap mount changes
+				if name := filepath.Base(event.Name); targets[name] || name == "..data" {
+					reload = time.After(reloadDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				s.Logger.Errorw("error watching chart files", "error", err)
+			case <-reload:
+				reload = nil
+
+				changed, err := s.reloadChart()
+				if err != nil {
+					s.Logger.Errorw("unable to reload chart, keeping the current chart", "error", err)
+					continue
+				}
+
+				if changed && s.UpgradeOnReload && s.isLeading() {
+					s.notifyReloaded()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// notifyReloaded wakes upgradeOnReload, a rollout already waiting to start
+// picks up the latest chart and values
+func (s *Server) notifyReloaded() {
+	if s.reloaded == nil {
+		return
+	}
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// upgradeOnReload rolls every reloaded chart and values out to the deployed
+// releases until ctx is cancelled. Releases are upgraded in batches of
+// ReloadUpgrade as a fleet upgrade is, so a broken chart halts the rollout
+// rather than reaching every loadbalancer at once.
+func (s *Server) upgradeOnReload(ctx context.Context) {
+	if !s.UpgradeOnReload || s.reloaded == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.reloaded:
+		}
+
+		if s.isDraining() {
+			return
+		}
+
+		s.Logger.Info("chart changed, upgrading deployed loadbalancers")
+
+		if _, err := s.upgradeDeployedReleases(ctx, s.ReloadUpgrade); err != nil {
+			s.Logger.Errorw("unable to upgrade deployed loadbalancers", "error", err)
+		}
+	}
+}
+
+// loadedChart returns information about the loaded chart
+func (s *Server) loadedChart() chartInfo {
+	s.chartMu.RLock()
+	defer s.chartMu.RUnlock()
+
+	info := chartInfo{
+		Digest:       s.chartDigest,
+		ValuesDigest: s.valuesDigest,
+		LoadedAt:     s.chartLoadedAt,
+	}
+
+	if s.Chart != nil && s.Chart.Metadata != nil {
+		info.Name = s.Chart.Metadata.Name
+		info.Version = s.Chart.Metadata.Version
+	}
+
+	return info
+}
+
+// chartHandler serves information about the loaded chart
+func (s *Server) chartHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.loadedChart())
+}
+
+// isLeading reports whether this replica is currently processing messages
+func (s *Server) isLeading() bool {
+	return atomic.LoadInt32(&s.leading) == 1
+}
+
+// digestChart returns a digest of the contents of a chart and of its
+// dependencies, so changes to a subchart change the digest of its parent
+func digestChart(ch *chart.Chart) string {
+	if ch == nil {
+		return ""
+	}
+
+	h := sha256.New()
+
+	// templates can refer to any of the metadata, such as the app version
+	if d, err := json.Marshal(ch.Metadata); err == nil {
+		writeDigestPart(h, "Chart.yaml", d)
+	}
+
+	for _, files := range [][]*chart.File{ch.Templates, ch.Files} {
+		sorted := append([]*chart.File{}, files...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+		for _, f := range sorted {
+			writeDigestPart(h, f.Name, f.Data)
+		}
+	}
+
+	// map keys are sorted when encoding, so equal values encode the same
+	if d, err := json.Marshal(ch.Values); err == nil {
+		writeDigestPart(h, "values.yaml", d)
+	}
+
+	writeDigestPart(h, "values.schema.json", ch.Schema)
+
+	deps := append([]*chart.Chart{}, ch.Dependencies()...)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].ChartFullPath() < deps[j].ChartFullPath() })
+
+	for _, dep := range deps {
+		writeDigestPart(h, dep.ChartFullPath(), []byte(digestChart(dep)))
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// writeDigestPart adds a named part to a digest, length prefixed so that
+// adjacent parts cannot run into each other
+func writeDigestPart(h hash.Hash, name string, data []byte) {
+	fmt.Fprintf(h, "%d:%s%d:", len(name), name, len(data))
+	h.Write(data)
+}
+
+// digestValues returns a digest of a set of chart values
+func digestValues(vals map[string]interface{}) (string, error) {
+	d, err := json.Marshal(vals)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(d)
+
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
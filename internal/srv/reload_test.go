@@ -0,0 +1,278 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"go.infratographer.com/loadbalanceroperator/internal/utils"
+)
+
+func newReloadTestDir(t *testing.T) (string, string, string) {
+	t.Helper()
+
+	testDir, err := os.MkdirTemp("", "test-reload-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chartPath, err := utils.CreateTestChart(testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valuesPath, err := utils.CreateTestValues(testDir, "replicas: 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testDir, chartPath, valuesPath
+}
+
+func TestReloadChart(t *testing.T) {
+	testDir, chartPath, valuesPath := newReloadTestDir(t)
+	defer os.RemoveAll(testDir)
+
+	srv := &Server{
+		Logger:     zap.NewNop().Sugar(),
+		ChartPath:  chartPath,
+		ValuesPath: valuesPath,
+	}
+
+	changed, err := srv.reloadChart()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	loaded := srv.loadedChart()
+	assert.Equal(t, "lb-dummy", loaded.Name)
+	assert.NotEmpty(t, loaded.Version)
+	assert.NotEmpty(t, loaded.Digest)
+	assert.NotEmpty(t, loaded.ValuesDigest)
+
+	// releases record the digest of the chart they are deployed from
+	assert.Equal(t, loaded.Digest, srv.Chart.Metadata.Annotations[chartDigestAnnotation])
+
+	changed, err = srv.reloadChart()
+	assert.Nil(t, err)
+	assert.False(t, changed, "unchanged files should not be reloaded")
+
+	if _, err := utils.CreateTestValues(testDir, "replicas: 3\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err = srv.reloadChart()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, loaded.Digest, srv.loadedChart().Digest)
+	assert.NotEqual(t, loaded.ValuesDigest, srv.loadedChart().ValuesDigest)
+
+	// a chart that does not render is rejected and the previous one is kept
+	broken := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: "v2", Name: "lb-dummy", Version: "0.2.0"},
+		Templates: []*chart.File{
+			{Name: "templates/broken.yaml", Data: []byte("{{ .Values.missing.field }}")},
+		},
+	}
+
+	brokenPath, err := chartutil.Save(broken, testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.ChartPath = brokenPath
+
+	changed, err = srv.reloadChart()
+	assert.NotNil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, loaded.Version, srv.loadedChart().Version)
+
+	// values only set for each loadbalancer are not required to load a chart
+	required := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: "v2", Name: "lb-dummy", Version: "0.3.0"},
+		Templates: []*chart.File{
+			{Name: "templates/required.yaml", Data: []byte(`id: {{ required "an id is required" .Values.loadBalancerID }}`)},
+		},
+	}
+
+	requiredPath, err := chartutil.Save(required, testDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.ChartPath = requiredPath
+
+	changed, err = srv.reloadChart()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "0.3.0", srv.loadedChart().Version)
+}
+
+func TestDigestChart(t *testing.T) {
+	newChart := func(template string, replicas int, subchartTemplate string) *chart.Chart {
+		subchart := &chart.Chart{
+			Metadata:  &chart.Metadata{APIVersion: "v2", Name: "sub", Version: "0.1.0"},
+			Templates: []*chart.File{{Name: "templates/sub.yaml", Data: []byte(subchartTemplate)}},
+		}
+
+		ch := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "lb-dummy", Version: "0.1.0"},
+			Templates: []*chart.File{
+				{Name: "templates/a.yaml", Data: []byte(template)},
+				{Name: "templates/b.yaml", Data: []byte("b: true")},
+			},
+			Values: map[string]interface{}{"replicas": replicas},
+		}
+
+		ch.AddDependency(subchart)
+
+		return ch
+	}
+
+	type testCase struct {
+		name    string
+		chart   *chart.Chart
+		changed bool
+	}
+
+	base := digestChart(newChart("a: true", 1, "sub: true"))
+
+	reordered := newChart("a: true", 1, "sub: true")
+	reordered.Templates[0], reordered.Templates[1] = reordered.Templates[1], reordered.Templates[0]
+
+	testCases := []testCase{
+		{
+			name:  "same contents",
+			chart: newChart("a: true", 1, "sub: true"),
+		},
+		{
+			name:  "templates in a different order",
+			chart: reordered,
+		},
+		{
+			name:    "template changed",
+			chart:   newChart("a: false", 1, "sub: true"),
+			changed: true,
+		},
+		{
+			name:    "values changed",
+			chart:   newChart("a: true", 2, "sub: true"),
+			changed: true,
+		},
+		{
+			name:    "subchart template changed",
+			chart:   newChart("a: true", 1, "sub: false"),
+			changed: true,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.changed, digestChart(tcase.chart) != base)
+		})
+	}
+}
+
+func TestNewHelmValuesLoaded(t *testing.T) {
+	testDir, chartPath, valuesPath := newReloadTestDir(t)
+	defer os.RemoveAll(testDir)
+
+	srv := &Server{
+		Logger:     zap.NewNop().Sugar(),
+		ChartPath:  chartPath,
+		ValuesPath: valuesPath,
+	}
+
+	if _, err := srv.reloadChart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the values file is only read again on reload
+	if err := os.Remove(valuesPath); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := srv.newHelmValues(context.TODO(), []valueSet{{helmKey: "resources.cpu", value: "500m"}})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), values["replicas"])
+	assert.Equal(t, map[string]interface{}{"cpu": "500m"}, values["resources"])
+
+	_, overridden := srv.values["resources"]
+	assert.False(t, overridden, "overrides must not modify the loaded values")
+}
+
+func TestWatchChart(t *testing.T) {
+	testDir, chartPath, valuesPath := newReloadTestDir(t)
+	defer os.RemoveAll(testDir)
+
+	srv := &Server{
+		Logger:     zap.NewNop().Sugar(),
+		ChartPath:  chartPath,
+		ValuesPath: valuesPath,
+	}
+
+	if _, err := srv.reloadChart(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.watchChart(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := srv.loadedChart().ValuesDigest
+
+	// replace the values file the way a ConfigMap update does, by renaming
+	// a new file over it
+	tmp := filepath.Join(testDir, "values.yaml.tmp")
+	if err := os.WriteFile(tmp, []byte("replicas: 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(tmp, valuesPath); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return srv.loadedChart().ValuesDigest != digest
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestChartHandler(t *testing.T) {
+	testDir, chartPath, valuesPath := newReloadTestDir(t)
+	defer os.RemoveAll(testDir)
+
+	srv := &Server{
+		Logger:     zap.NewNop().Sugar(),
+		ChartPath:  chartPath,
+		ValuesPath: valuesPath,
+	}
+
+	if _, err := srv.reloadChart(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.chartHandler(rec, httptest.NewRequest(http.MethodGet, "/chart", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	info := chartInfo{}
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, srv.loadedChart(), info)
+}
@@ -0,0 +1,422 @@
+package srv
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	lbv1alpha1 "go.infratographer.com/loadbalanceroperator/pkg/api/v1alpha1"
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+// watchRetryDelay is how long to wait before listing LoadBalancer resources
+// again after the watch failed
+const watchRetryDelay = time.Second
+
+// newLoadBalancerClient returns a client for the LoadBalancer custom resource
+func newLoadBalancerClient(config *rest.Config) (client.WithWatch, error) {
+	scheme := runtime.NewScheme()
+
+	if err := lbv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return client.NewWithWatch(config, client.Options{Scheme: scheme})
+}
+
+// loadBalancerKey returns the name of the LoadBalancer resource for a
+// loadbalancer deployed in namespace
+func loadBalancerKey(namespace string, id string) types.NamespacedName {
+	return types.NamespacedName{Namespace: namespace, Name: id}
+}
+
+// loadBalancerData returns the event data equivalent to a LoadBalancer spec
+func loadBalancerData(lb *lbv1alpha1.LoadBalancer) events.LoadBalancerData {
+	return events.LoadBalancerData{
+		LoadBalancerID: lb.Spec.LoadBalancerID,
+		LocationID:     lb.Spec.LocationID,
+		Resources: events.LoadBalancerResources{
+			CPU:    lb.Spec.Resources.CPU,
+			Memory: lb.Spec.Resources.Memory,
+		},
+		QueryURL: lb.Spec.QueryURL,
+	}
+}
+
+// deployLoadBalancer deploys the loadbalancer described by an event along
+// with the values mapped from its data. When custom resources are enabled the
+// LoadBalancer resource is written first and the release is driven from it,
+// otherwise helm is called directly.
+func (s *Server) deployLoadBalancer(ctx context.Context, namespace string, lbdata *events.LoadBalancerData, mapped []valueSet, update bool) error {
+	if !s.UseCustomResources {
+		overrides, err := s.queryOverrides(ctx, lbdata)
+		if err != nil {
+			return err
+		}
+
+		overrides = append(overrides, mapped...)
+
+		if update {
+			return s.updateDeployment(ctx, lbdata.LoadBalancerID.String(), namespace, overrides)
+		}
+
+		return s.newDeployment(ctx, lbdata.LoadBalancerID.String(), namespace, overrides)
+	}
+
+	key, err := s.applyLoadBalancer(ctx, namespace, lbdata, mapped)
+	if err != nil {
+		return err
+	}
+
+	return s.syncLoadBalancer(ctx, key, update)
+}
+
+// applyLoadBalancer creates or updates the LoadBalancer resource for a
+// loadbalancer with the data received in an event
+func (s *Server) applyLoadBalancer(ctx context.Context, namespace string, lbdata *events.LoadBalancerData, mapped []valueSet) (types.NamespacedName, error) {
+	key := loadBalancerKey(namespace, lbdata.LoadBalancerID.String())
+
+	values, err := encodeValues(mapped)
+	if err != nil {
+		return key, err
+	}
+
+	// the handler only created the namespace in the location's cluster
+	if len(s.Locations) > 0 {
+		err := s.lockNamespace(s.homeContext(ctx), namespace, false, func(homeCtx context.Context) error {
+			if err := s.CreateNamespace(homeCtx, namespace); err != nil {
+				return err
+			}
+
+			return s.writeLoadBalancer(ctx, key, lbdata, values)
+		})
+
+		return key, err
+	}
+
+	return key, s.writeLoadBalancer(ctx, key, lbdata, values)
+}
+
+// writeLoadBalancer creates or updates the LoadBalancer resource key
+func (s *Server) writeLoadBalancer(ctx context.Context, key types.NamespacedName, lbdata *events.LoadBalancerData, values *runtime.RawExtension) error {
+	lb := &lbv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+		},
+	}
+
+	result, err := controllerutil.CreateOrUpdate(ctx, s.lbClient, lb, func() error {
+		lb.Spec = lbv1alpha1.LoadBalancerSpec{
+			LoadBalancerID: lbdata.LoadBalancerID,
+			LocationID:     lbdata.LocationID,
+			Resources: lbv1alpha1.LoadBalancerResources{
+				CPU:    lbdata.Resources.CPU,
+				Memory: lbdata.Resources.Memory,
+			},
+			QueryURL: lbdata.QueryURL,
+			Values:   values,
+		}
+
+		controllerutil.AddFinalizer(lb, lbv1alpha1.Finalizer)
+
+		return nil
+	})
+	if err != nil {
+		s.Logger.Errorw("unable to write loadbalancer resource", "loadbalancer", key, "error", err)
+		return err
+	}
+
+	s.Logger.Debugw("wrote loadbalancer resource", "loadbalancer", key, "result", result)
+
+	return nil
+}
+
+// deleteLoadBalancer removes the LoadBalancer resource for a loadbalancer and
+// uninstalls its release. Resources that do not exist are ignored.
+func (s *Server) deleteLoadBalancer(ctx context.Context, key types.NamespacedName) error {
+	lb := &lbv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+		},
+	}
+
+	if err := s.lbClient.Delete(ctx, lb); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		s.Logger.Errorw("unable to delete loadbalancer resource", "loadbalancer", key, "error", err)
+
+		return err
+	}
+
+	return s.syncLoadBalancer(ctx, key, false)
+}
+
+// syncLoadBalancer drives the helm release of a LoadBalancer resource to the
+// state described by its spec and records the result in its status. A
+// resource that is being deleted has its release uninstalled and its
+// finalizer removed. When force is set the release is upgraded even if it
+// already matches the spec.
+func (s *Server) syncLoadBalancer(ctx context.Context, key types.NamespacedName, force bool) (err error) {
+	ctx, span := tracer.Start(ctx, "syncLoadBalancer", trace.WithAttributes(
+		attribute.String("loadbalanceroperator.namespace", key.Namespace),
+		attribute.String("loadbalanceroperator.load_balancer_id", key.Name),
+	))
+
+	defer func() {
+		recordSpanError(span, err)
+		span.End()
+	}()
+
+	lb := &lbv1alpha1.LoadBalancer{}
+	if err := s.lbClient.Get(ctx, key, lb); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		s.Logger.Errorw("unable to retrieve loadbalancer resource", "loadbalancer", key, "error", err)
+
+		return err
+	}
+
+	ctx, err = s.locationContext(ctx, lb.Spec.LocationID)
+	if err != nil {
+		s.Logger.Errorw("unable to route loadbalancer resource", "loadbalancer", key, "location_id", lb.Spec.LocationID, "error", err)
+
+		if lb.DeletionTimestamp.IsZero() {
+			_ = s.updateLoadBalancerStatus(ctx, lb, err)
+		}
+
+		return err
+	}
+
+	if !lb.DeletionTimestamp.IsZero() {
+		return s.finalizeLoadBalancer(ctx, lb)
+	}
+
+	if controllerutil.AddFinalizer(lb, lbv1alpha1.Finalizer) {
+		if err := s.lbClient.Update(ctx, lb); err != nil {
+			s.Logger.Errorw("unable to add finalizer to loadbalancer resource", "loadbalancer", key, "error", err)
+			return err
+		}
+	}
+
+	lbdata := loadBalancerData(lb)
+
+	// resources may be written without going through event validation
+	var overrides []valueSet
+
+	err = s.validateLBData(&lbdata)
+	if err == nil {
+		overrides, err = s.queryOverrides(ctx, &lbdata)
+	}
+
+	if err == nil {
+		var mapped []valueSet
+
+		mapped, err = decodeValues(lb.Spec.Values)
+		overrides = append(overrides, mapped...)
+	}
+
+	if err != nil {
+		s.Logger.Errorw("unable to prepare loadbalancer deployment", "loadbalancer", key, "error", err)
+	} else {
+		err = s.lockNamespace(ctx, lb.Namespace, false, func(ctx context.Context) error {
+			// resources written outside of events have no namespace in the
+			// location's cluster yet
+			if len(s.Locations) > 0 {
+				if err := s.CreateNamespace(ctx, lb.Namespace); err != nil {
+					return err
+				}
+			}
+
+			if force {
+				return s.updateDeployment(ctx, lb.Name, lb.Namespace, overrides)
+			}
+
+			return s.newDeployment(ctx, lb.Name, lb.Namespace, overrides)
+		})
+	}
+
+	if statusErr := s.updateLoadBalancerStatus(ctx, lb, err); statusErr != nil && err == nil {
+		return statusErr
+	}
+
+	return err
+}
+
+// updateLoadBalancerStatus records the result of deploying a LoadBalancer in
+// its status, skipping the write when nothing has changed
+func (s *Server) updateLoadBalancerStatus(ctx context.Context, lb *lbv1alpha1.LoadBalancer, deployErr error) error {
+	status := lb.Status.DeepCopy()
+	status.ObservedGeneration = lb.Generation
+	status.ReleaseName = newReleaseName(lb.Name, lb.Namespace)
+
+	condition := metav1.Condition{
+		Type:               lbv1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: lb.Generation,
+		Reason:             lbv1alpha1.ReasonDeployed,
+		Message:            "release deployed",
+	}
+
+	if deployErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = lbv1alpha1.ReasonDeployFailed
+		condition.Message = deployErr.Error()
+	}
+
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	if equality.Semantic.DeepEqual(&lb.Status, status) {
+		return nil
+	}
+
+	lb.Status = *status
+
+	if err := s.lbClient.Status().Update(ctx, lb); err != nil {
+		s.Logger.Errorw("unable to update loadbalancer status", "loadbalancer", client.ObjectKeyFromObject(lb), "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// finalizeLoadBalancer uninstalls the release of a LoadBalancer resource that
+// is being deleted and then releases its finalizer
+func (s *Server) finalizeLoadBalancer(ctx context.Context, lb *lbv1alpha1.LoadBalancer) error {
+	if !controllerutil.ContainsFinalizer(lb, lbv1alpha1.Finalizer) {
+		return nil
+	}
+
+	if err := s.removeDeployment(ctx, lb.Name, lb.Namespace); err != nil {
+		return err
+	}
+
+	controllerutil.RemoveFinalizer(lb, lbv1alpha1.Finalizer)
+
+	if err := s.lbClient.Update(ctx, lb); err != nil && !apierrors.IsNotFound(err) {
+		s.Logger.Errorw("unable to remove finalizer from loadbalancer resource", "loadbalancer", client.ObjectKeyFromObject(lb), "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// watchLoadBalancers syncs LoadBalancer resources that are created, have
+// their spec changed or are deleted outside of events until ctx is cancelled
+func (s *Server) watchLoadBalancers(ctx context.Context) {
+	for ctx.Err() == nil && !s.isDraining() {
+		if err := s.watchLoadBalancersOnce(ctx); err != nil {
+			s.Logger.Errorw("unable to watch loadbalancer resources", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+// watchLoadBalancersOnce syncs every existing LoadBalancer resource and then
+// watches for changes until the watch is closed
+func (s *Server) watchLoadBalancersOnce(ctx context.Context) error {
+	list := &lbv1alpha1.LoadBalancerList{}
+	if err := s.lbClient.List(ctx, list); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		s.enqueueSync(ctx, &list.Items[i])
+	}
+
+	w, err := s.lbClient.Watch(ctx, &lbv1alpha1.LoadBalancerList{}, &client.ListOptions{
+		Raw: &metav1.ListOptions{ResourceVersion: list.ResourceVersion},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+
+			if event.Type == watch.Error {
+				return apierrors.FromObject(event.Object)
+			}
+
+			lb, ok := event.Object.(*lbv1alpha1.LoadBalancer)
+			if !ok || !needsSync(event.Type, lb) {
+				continue
+			}
+
+			s.enqueueSync(ctx, lb)
+		}
+	}
+}
+
+// needsSync reports whether a watch event requires the LoadBalancer to be
+// synced. Status updates written by the operator itself do not change the
+// generation and are skipped.
+func needsSync(eventType watch.EventType, lb *lbv1alpha1.LoadBalancer) bool {
+	switch eventType {
+	case watch.Added:
+		return true
+	case watch.Modified:
+		return !lb.DeletionTimestamp.IsZero() || lb.Generation != lb.Status.ObservedGeneration
+	default:
+		return false
+	}
+}
+
+// enqueueSync syncs a LoadBalancer on the worker pool, serialized with any
+// events being processed for the same loadbalancer
+func (s *Server) enqueueSync(ctx context.Context, lb *lbv1alpha1.LoadBalancer) {
+	if !s.startMessage(ctx) {
+		return
+	}
+
+	key := client.ObjectKeyFromObject(lb)
+
+	job := func() {
+		defer s.inFlight.Done()
+
+		if s.stopping(ctx) {
+			return
+		}
+
+		if err := s.syncLoadBalancer(ctx, key, false); err != nil {
+			s.Logger.Errorw("unable to sync loadbalancer resource", "loadbalancer", key, "error", err)
+		}
+	}
+
+	if s.pool == nil {
+		job()
+		return
+	}
+
+	s.pool.submit(lb.Spec.LoadBalancerID.String(), job)
+}
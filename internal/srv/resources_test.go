@@ -0,0 +1,232 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	lbv1alpha1 "go.infratographer.com/loadbalanceroperator/pkg/api/v1alpha1"
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func newFakeLoadBalancerClient(t *testing.T, objs ...client.Object) client.WithWatch {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := lbv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func TestApplyLoadBalancer(t *testing.T) {
+	srv := Server{
+		Logger:   zap.NewNop().Sugar(),
+		lbClient: newFakeLoadBalancerClient(t),
+	}
+
+	lbdata := events.LoadBalancerData{
+		LoadBalancerID: uuid.New(),
+		LocationID:     uuid.New(),
+		Resources: events.LoadBalancerResources{
+			CPU:    "100m",
+			Memory: "128Mi",
+		},
+		QueryURL: "https://example.com/lb",
+	}
+
+	key, err := srv.applyLoadBalancer(context.TODO(), "lb-group", &lbdata, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "lb-group", key.Namespace)
+	assert.Equal(t, lbdata.LoadBalancerID.String(), key.Name)
+
+	lb := &lbv1alpha1.LoadBalancer{}
+	if err := srv.lbClient.Get(context.TODO(), key, lb); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, lbdata, loadBalancerData(lb))
+	assert.True(t, controllerutil.ContainsFinalizer(lb, lbv1alpha1.Finalizer))
+
+	assert.Nil(t, lb.Spec.Values)
+
+	lbdata.Resources.CPU = "500m"
+	mapped := []valueSet{{helmKey: "replicaCount", data: float64(3)}}
+
+	_, err = srv.applyLoadBalancer(context.TODO(), "lb-group", &lbdata, mapped)
+	assert.Nil(t, err)
+
+	if err := srv.lbClient.Get(context.TODO(), key, lb); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "500m", lb.Spec.Resources.CPU)
+
+	values, err := decodeValues(lb.Spec.Values)
+	assert.Nil(t, err)
+	assert.Equal(t, mapped, values)
+}
+
+func TestUpdateLoadBalancerStatus(t *testing.T) {
+	type testCase struct {
+		name         string
+		deployErr    error
+		expectStatus metav1.ConditionStatus
+		expectReason string
+	}
+
+	testCases := []testCase{
+		{
+			name:         "deployed",
+			expectStatus: metav1.ConditionTrue,
+			expectReason: lbv1alpha1.ReasonDeployed,
+		},
+		{
+			name:         "failed",
+			deployErr:    errors.New("install failed"), //nolint:goerr113
+			expectStatus: metav1.ConditionFalse,
+			expectReason: lbv1alpha1.ReasonDeployFailed,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			lb := &lbv1alpha1.LoadBalancer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       uuid.NewString(),
+					Namespace:  "lb-group",
+					Generation: 2,
+				},
+			}
+
+			srv := Server{
+				Logger:   zap.NewNop().Sugar(),
+				lbClient: newFakeLoadBalancerClient(t, lb),
+			}
+
+			if err := srv.lbClient.Get(context.TODO(), client.ObjectKeyFromObject(lb), lb); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Nil(t, srv.updateLoadBalancerStatus(context.TODO(), lb, tcase.deployErr))
+
+			updated := &lbv1alpha1.LoadBalancer{}
+			if err := srv.lbClient.Get(context.TODO(), client.ObjectKeyFromObject(lb), updated); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, int64(2), updated.Status.ObservedGeneration)
+			assert.Equal(t, newReleaseName(lb.Name, lb.Namespace), updated.Status.ReleaseName)
+
+			cond := meta.FindStatusCondition(updated.Status.Conditions, lbv1alpha1.ConditionReady)
+			if assert.NotNil(t, cond) {
+				assert.Equal(t, tcase.expectStatus, cond.Status)
+				assert.Equal(t, tcase.expectReason, cond.Reason)
+			}
+
+			// an unchanged status is not written again
+			assert.Nil(t, srv.updateLoadBalancerStatus(context.TODO(), updated, tcase.deployErr))
+
+			unchanged := &lbv1alpha1.LoadBalancer{}
+			if err := srv.lbClient.Get(context.TODO(), client.ObjectKeyFromObject(lb), unchanged); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, updated.ResourceVersion, unchanged.ResourceVersion)
+		})
+	}
+}
+
+func TestSyncLoadBalancer(t *testing.T) {
+	now := metav1.NewTime(time.Now())
+
+	deleted := &lbv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              uuid.NewString(),
+			Namespace:         "lb-group",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{"example.com/other"},
+		},
+	}
+
+	srv := Server{
+		Logger:   zap.NewNop().Sugar(),
+		lbClient: newFakeLoadBalancerClient(t, deleted),
+	}
+
+	// missing resources have nothing to sync
+	assert.Nil(t, srv.syncLoadBalancer(context.TODO(), loadBalancerKey("lb-group", uuid.NewString()), false))
+
+	// resources being deleted without the operator's finalizer are left alone
+	assert.Nil(t, srv.syncLoadBalancer(context.TODO(), client.ObjectKeyFromObject(deleted), false))
+}
+
+func TestNeedsSync(t *testing.T) {
+	now := metav1.NewTime(time.Now())
+
+	type testCase struct {
+		name      string
+		eventType watch.EventType
+		lb        lbv1alpha1.LoadBalancer
+		expect    bool
+	}
+
+	testCases := []testCase{
+		{
+			name:      "added",
+			eventType: watch.Added,
+			expect:    true,
+		},
+		{
+			name:      "spec changed",
+			eventType: watch.Modified,
+			lb: lbv1alpha1.LoadBalancer{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Status:     lbv1alpha1.LoadBalancerStatus{ObservedGeneration: 1},
+			},
+			expect: true,
+		},
+		{
+			name:      "status changed",
+			eventType: watch.Modified,
+			lb: lbv1alpha1.LoadBalancer{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Status:     lbv1alpha1.LoadBalancerStatus{ObservedGeneration: 2},
+			},
+			expect: false,
+		},
+		{
+			name:      "deleting",
+			eventType: watch.Modified,
+			lb: lbv1alpha1.LoadBalancer{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2, DeletionTimestamp: &now},
+				Status:     lbv1alpha1.LoadBalancerStatus{ObservedGeneration: 2},
+			},
+			expect: true,
+		},
+		{
+			name:      "deleted",
+			eventType: watch.Deleted,
+			expect:    false,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expect, needsSync(tcase.eventType, &tcase.lb))
+		})
+	}
+}
@@ -2,40 +2,329 @@ package srv
 
 import (
 	"context"
-	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"helm.sh/helm/v3/pkg/chart"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // Server holds options for server connectivity and settings
 type Server struct {
-	Context         context.Context
-	StreamName      string
-	Logger          *zap.SugaredLogger
-	KubeClient      *rest.Config
-	JetstreamClient nats.JetStreamContext
-	Debug           bool
-	Prefix          string
-	Chart           *chart.Chart
-	ChartPath       string
-	ValuesPath      string
+	Context           context.Context
+	StreamName        string
+	Logger            *zap.SugaredLogger
+	KubeClient        *rest.Config
+	JetstreamClient   nats.JetStreamContext
+	NATSClient        *nats.Conn
+	Debug             bool
+	Prefix            string
+	Chart             *chart.Chart
+	ChartPath         string
+	ValuesPath        string
+	MaxDeliver        int
+	NakDelay          time.Duration
+	DeadLetterSubject string
+	StatusSubject     string
+	Workers           int
+	ConsumerName      string
+	FetchBatch        int
+	FetchTimeout      time.Duration
+	AckWait           time.Duration
+	MaxAckPending     int
+	LeaderElection    bool
+	LeaseName         string
+	LeaseNamespace    string
+	LeaseIdentity     string
+	LeaseDuration     time.Duration
+	RenewDeadline     time.Duration
+	RetryPeriod       time.Duration
+	// LeaseWaitTimeout bounds how long RunLeading waits to acquire the
+	// leader lease, zero waits until ctx is done
+	LeaseWaitTimeout time.Duration
+	// UseCustomResources records each loadbalancer as a LoadBalancer
+	// resource and drives helm from it
+	UseCustomResources bool
+	// ReconcileInterval is how often deployed releases are checked for
+	// drift, zero disables the check
+	ReconcileInterval time.Duration
+	// UpgradeOnReload upgrades every deployed release as soon as the chart
+	// or values file changes, in batches as described by ReloadUpgrade
+	UpgradeOnReload bool
+	ReloadUpgrade   FleetUpgradeOptions
+	// Clusters holds the clusters loadbalancers may be deployed to
+	Clusters *ClusterRegistry
+	// Locations maps lowercase location IDs to the cluster loadbalancers in
+	// that location are deployed to. When empty every loadbalancer is
+	// deployed to KubeClient.
+	Locations map[string]*Cluster
+	// ClusterHealthInterval is how often every cluster is checked for
+	// reachability
+	ClusterHealthInterval time.Duration
+	// QueryEnabled fetches the full definition of each loadbalancer from the
+	// QueryURL of its event and sets it in the chart values under
+	// QueryValuesKey. Only QueryURLs under one of the QueryAllowedURLs are
+	// requested.
+	QueryEnabled     bool
+	QueryAllowedURLs []*url.URL
+	QueryClient      *http.Client
+	QueryToken       string
+	QueryTokenFile   string
+	QueryTimeout     time.Duration
+	QueryRetries     int
+	QueryValuesKey   string
+	// EventFormat is the format of received events, one of EventFormatAuto,
+	// EventFormatPubsubx or EventFormatCloudEvents
+	EventFormat string
+	// ValueMapper sets chart values from the additional data of events
+	ValueMapper *ValueMapper
+	// EventValuesKey is the chart values key the parts of v1alpha2 event
+	// data without a v1alpha1 equivalent are set under
+	EventValuesKey string
+	// DedupBucket is the jetstream key-value bucket applied events are
+	// recorded in so duplicate and out of order events are skipped, empty
+	// disables deduplication
+	DedupBucket string
+	// DedupTTL is how long applied events are remembered
+	DedupTTL time.Duration
+	// CPUBounds and MemoryBounds limit the resources loadbalancers may request
+	CPUBounds    QuantityBounds
+	MemoryBounds QuantityBounds
+
+	pool         *workerPool
+	subscription *nats.Subscription
+	healthServer *http.Server
+	stopLeading  context.CancelFunc
+	lbClient     client.WithWatch
+	processed    nats.KeyValue
+	reloaded     chan struct{}
+
+	// namespaceLocks keeps namespaces from being removed while loadbalancers
+	// are deployed to them
+	namespaceLocks namespaceLocks
+	leading        int32
+	homeCluster    *Cluster
+	homeOnce       sync.Once
+
+	// chartMu guards the chart and values so a reload is only swapped in
+	// once deployments using the previous ones have finished
+	chartMu       sync.RWMutex
+	values        map[string]interface{}
+	chartDigest   string
+	valuesDigest  string
+	chartLoadedAt time.Time
+
+	// mu guards draining so no message starts processing once Shutdown has
+	// begun waiting for inFlight
+	mu       sync.RWMutex
+	draining bool
+	inFlight sync.WaitGroup
 }
 
 // Run will start the server queue connections and healthcheck endpoints
 func (s *Server) Run(ctx context.Context) error {
-	subscription, err := s.JetstreamClient.QueueSubscribe(fmt.Sprintf("%s.>", s.Prefix), "loadbalanceroperator-workers", s.MessageHandler, nats.BindStream(s.StreamName))
+	s.pool = newWorkerPool(s.Workers)
+	s.reloaded = make(chan struct{}, 1)
+
+	if s.UseCustomResources && s.lbClient == nil {
+		lbClient, err := newLoadBalancerClient(s.KubeClient)
+		if err != nil {
+			s.Logger.Errorw("unable to create loadbalancer resource client", "error", err)
+			return err
+		}
+
+		s.lbClient = lbClient
+	}
+
+	if _, err := s.reloadChart(); err != nil {
+		s.Logger.Errorw("unable to load chart", "error", err)
+		return err
+	}
+
+	go s.checkClusters(ctx)
+
+	if err := s.watchChart(ctx); err != nil {
+		s.Logger.Errorw("unable to watch chart files", "error", err)
+		return err
+	}
+
+	if err := s.ensureDedupBucket(); err != nil {
+		return err
+	}
+
+	cfg := s.consumerConfig()
+
+	if err := s.ensureConsumer(cfg); err != nil {
+		return err
+	}
+
+	subscription, err := s.JetstreamClient.PullSubscribe(cfg.FilterSubject, cfg.Durable, nats.Bind(s.StreamName, cfg.Durable))
 	if err != nil {
 		s.Logger.Errorf("unable to subscribe to queue: %s", err)
 		return err
 	}
 
+	s.subscription = subscription
+
+	if err := s.startFetching(ctx, subscription); err != nil {
+		return err
+	}
+
 	if err := s.ExposeEndpoint(subscription, viper.GetString("healthcheck-port")); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Shutdown stops accepting new messages, drains the queue subscription and
+// waits for in-flight messages to finish processing before closing the NATS
+// connection and healthcheck endpoints. Readiness is reported as failing for
+// the duration of the shutdown. If ctx expires before in-flight messages
+// finish, the remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	if s.subscription != nil {
+		if err := s.subscription.Drain(); err != nil {
+			s.Logger.Errorw("unable to drain queue subscription", "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	var shutdownErr error
+
+	select {
+	case <-done:
+		s.Logger.Info("in-flight messages completed")
+	case <-ctx.Done():
+		s.Logger.Warn("timed out waiting for in-flight messages to complete")
+
+		shutdownErr = ctx.Err()
+	}
+
+	// the lease is only released once in-flight messages are done so the
+	// next leader never works on a loadbalancer that is still being processed
+	if s.stopLeading != nil {
+		s.stopLeading()
+	}
+
+	if s.NATSClient != nil {
+		if err := s.NATSClient.FlushTimeout(time.Second); err != nil {
+			s.Logger.Errorw("unable to flush NATS connection", "error", err)
+		}
+
+		s.NATSClient.Close()
+	}
+
+	if s.healthServer != nil {
+		if err := s.healthServer.Shutdown(ctx); err != nil {
+			s.Logger.Errorw("unable to gracefully shutdown healthcheck endpoints", "error", err)
+			_ = s.healthServer.Close()
+		}
+	}
+
+	return shutdownErr
+}
+
+// startFetching pulls messages from the subscription, either immediately or,
+// when leader election is enabled, only while this replica holds the lease.
+// Releases are checked for drift and reloaded charts rolled out alongside,
+// and LoadBalancer resources are watched when custom resources are enabled.
+func (s *Server) startFetching(ctx context.Context, subscription *nats.Subscription) error {
+	run := func(ctx context.Context) {
+		atomic.StoreInt32(&s.leading, 1)
+		defer atomic.StoreInt32(&s.leading, 0)
+
+		if s.UseCustomResources {
+			go s.watchLoadBalancers(ctx)
+		}
+
+		go s.reconcileDrift(ctx)
+		go s.upgradeOnReload(ctx)
+
+		s.fetchMessages(ctx, subscription)
+	}
+
+	if !s.LeaderElection {
+		go run(ctx)
+
+		return nil
+	}
+
+	kc, err := s.home().Clientset()
+	if err != nil {
+		s.Logger.Errorln("unable to authenticate against kubernetes cluster")
+		return err
+	}
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+
+	if err := s.campaign(leaderCtx, kc, run); err != nil {
+		cancel()
+		s.Logger.Errorw("unable to start leader election", "error", err)
+
+		return err
+	}
+
+	s.stopLeading = cancel
+
+	return nil
+}
+
+// startMessage registers a message as in-flight, returning false when the
+// server is shutting down or ctx, the context the work was received under,
+// is done because leadership was lost
+func (s *Server) startMessage(ctx context.Context) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.draining || ctx.Err() != nil {
+		return false
+	}
+
+	s.inFlight.Add(1)
+
+	return true
+}
+
+// stopping reports whether work queued under ctx should no longer run,
+// either because the server is shutting down or leadership was lost
+func (s *Server) stopping(ctx context.Context) bool {
+	return ctx.Err() != nil || s.isDraining()
+}
+
+// waitForInFlight waits for every in-flight message, drift check and sync
+// to finish. It is called once the context they were started under has been
+// cancelled, so no further work can be registered.
+func (s *Server) waitForInFlight() {
+	// startMessage checks the context while holding the read lock, taking
+	// the write lock ensures any work that passed the check is counted
+	s.mu.Lock()
+	s.mu.Unlock() //nolint:staticcheck
+
+	s.inFlight.Wait()
+}
+
+// isDraining reports whether the server is shutting down
+func (s *Server) isDraining() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.draining
+}
@@ -0,0 +1,84 @@
+package srv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestShutdown(t *testing.T) {
+	type testCase struct {
+		name        string
+		inFlight    int
+		expectError error
+	}
+
+	testCases := []testCase{
+		{
+			name:        "no in-flight messages",
+			inFlight:    0,
+			expectError: nil,
+		},
+		{
+			name:        "in-flight messages exceed deadline",
+			inFlight:    1,
+			expectError: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := &Server{
+				Context: context.TODO(),
+				Logger:  zap.NewNop().Sugar(),
+			}
+
+			for i := 0; i < tcase.inFlight; i++ {
+				assert.True(t, srv.startMessage(context.Background()))
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			err := srv.Shutdown(ctx)
+			assert.ErrorIs(t, err, tcase.expectError)
+
+			assert.True(t, srv.isDraining())
+			assert.False(t, srv.startMessage(context.Background()), "no messages should start once shutdown has begun")
+		})
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	nc, js, cleanup := newTestJetstream(t, "lbo", "lbo.>")
+	defer cleanup()
+
+	viper.Set("healthcheck-port", "127.0.0.1:0")
+	defer viper.Reset()
+
+	srv := &Server{
+		Context:         context.TODO(),
+		Logger:          zap.NewNop().Sugar(),
+		JetstreamClient: js,
+		NATSClient:      nc,
+		Prefix:          "lbo",
+		StreamName:      "lbo",
+		MaxDeliver:      5,
+	}
+
+	if err := srv.Run(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, srv.subscription.IsValid())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Nil(t, srv.Shutdown(ctx))
+	assert.True(t, nc.IsClosed())
+}
@@ -0,0 +1,86 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+
+	"go.infratographer.com/x/pubsubx"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+const statusSource = "loadbalanceroperator"
+
+// publishStatus reports the state of a loadbalancer on the status subject
+// for that loadbalancer. Failures to publish are logged and otherwise ignored
+// so they never affect processing of the event itself.
+func (s *Server) publishStatus(ctx context.Context, m *pubsubx.Message, lbdata *events.LoadBalancerData, state string, procErr error) {
+	if s.StatusSubject == "" {
+		return
+	}
+
+	status := events.LoadBalancerStatus{
+		LoadBalancerID: lbdata.LoadBalancerID,
+		State:          state,
+		ReleaseName:    newReleaseName(lbdata.LoadBalancerID.String(), m.SubjectURN),
+		Namespace:      m.SubjectURN,
+	}
+
+	if procErr != nil {
+		status.Error = procErr.Error()
+	}
+
+	data, err := statusData(&status)
+	if err != nil {
+		s.Logger.Errorw("unable to prepare status event", "error", err)
+		return
+	}
+
+	msg := pubsubx.Message{
+		SubjectURN:     m.SubjectURN,
+		EventType:      events.EVENTSTATUS,
+		ActorURN:       m.ActorURN,
+		Source:         statusSource,
+		Timestamp:      time.Now().UTC(),
+		AdditionalData: data,
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		s.Logger.Errorw("unable to encode status event", "error", err)
+		return
+	}
+
+	subject := fmt.Sprintf("%s.%s", s.StatusSubject, lbdata.LoadBalancerID)
+
+	statusMsg := nats.NewMsg(subject)
+	statusMsg.Data = payload
+
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(statusMsg.Header))
+
+	if _, err := s.JetstreamClient.PublishMsg(statusMsg); err != nil {
+		s.Logger.Errorw("unable to publish status event", "subject", subject, "error", err)
+		return
+	}
+
+	s.Logger.Debugw("published status event", "subject", subject, "state", state)
+}
+
+func statusData(status *events.LoadBalancerStatus) (map[string]interface{}, error) {
+	d, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err := json.Unmarshal(d, &data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,149 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"k8s.io/client-go/rest"
+
+	"go.infratographer.com/x/pubsubx"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func TestPublishStatus(t *testing.T) {
+	type testCase struct {
+		name        string
+		state       string
+		err         error
+		expectError string
+	}
+
+	_, js, cleanup := newTestJetstream(t, "status", "lbo.status.>")
+	defer cleanup()
+
+	testCases := []testCase{
+		{
+			name:  "ready",
+			state: events.STATUSREADY,
+		},
+		{
+			name:        "failed",
+			state:       events.STATUSFAILED,
+			err:         errors.New("helm install failed"), //nolint:goerr113
+			expectError: "helm install failed",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			srv := Server{
+				Logger:          zap.NewNop().Sugar(),
+				JetstreamClient: js,
+				StatusSubject:   "lbo.status",
+			}
+
+			m := &pubsubx.Message{
+				SubjectURN: uuid.NewString(),
+				EventType:  events.EVENTCREATE,
+				ActorURN:   uuid.NewString(),
+			}
+			lbdata := &events.LoadBalancerData{LoadBalancerID: uuid.New()}
+
+			srv.publishStatus(context.TODO(), m, lbdata, tcase.state, tcase.err)
+
+			raw, err := js.GetLastMsg("status", "lbo.status."+lbdata.LoadBalancerID.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := pubsubx.Message{}
+			if err := json.Unmarshal(raw.Data, &msg); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := json.Marshal(msg.AdditionalData)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status := events.LoadBalancerStatus{}
+			if err := json.Unmarshal(d, &status); err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, events.EVENTSTATUS, msg.EventType)
+			assert.Equal(t, m.SubjectURN, msg.SubjectURN)
+			assert.Equal(t, m.ActorURN, msg.ActorURN)
+			assert.Equal(t, lbdata.LoadBalancerID, status.LoadBalancerID)
+			assert.Equal(t, tcase.state, status.State)
+			assert.Equal(t, m.SubjectURN, status.Namespace)
+			assert.Equal(t, newReleaseName(lbdata.LoadBalancerID.String(), m.SubjectURN), status.ReleaseName)
+			assert.Equal(t, tcase.expectError, status.Error)
+		})
+	}
+}
+
+func TestPublishStatusDisabled(t *testing.T) {
+	srv := Server{
+		Logger: zap.NewNop().Sugar(),
+	}
+
+	// without a status subject nothing is published, so the missing
+	// jetstream client must never be used
+	srv.publishStatus(context.TODO(), &pubsubx.Message{}, &events.LoadBalancerData{}, events.STATUSREADY, nil)
+}
+
+func TestStatusPublishedOnFailure(t *testing.T) {
+	_, js, cleanup := newTestJetstream(t, "status", "lbo.status.>")
+	defer cleanup()
+
+	srv := Server{
+		Context:         context.TODO(),
+		Logger:          zap.NewNop().Sugar(),
+		KubeClient:      &rest.Config{Host: "http://127.0.0.1:1", Timeout: time.Second},
+		JetstreamClient: js,
+		StatusSubject:   "lbo.status",
+	}
+
+	lbID := uuid.New()
+	msg := &pubsubx.Message{
+		SubjectURN:     uuid.NewString(),
+		EventType:      events.EVENTCREATE,
+		Timestamp:      time.Now(),
+		AdditionalData: map[string]interface{}{"load_balancer_id": lbID, "location_id": uuid.New(), "resources": map[string]interface{}{"cpu": "500m", "memory": "512Mi"}},
+	}
+
+	err := srv.deployMessageHandler(context.TODO(), msg, false)
+	assert.NotNil(t, err)
+
+	sub, err := js.SubscribeSync("lbo.status."+lbID.String(), nats.DeliverAll())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := []string{}
+
+	for i := 0; i < 2; i++ {
+		raw, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		evt := pubsubx.Message{}
+		if err := json.Unmarshal(raw.Data, &evt); err != nil {
+			t.Fatal(err)
+		}
+
+		states = append(states, evt.AdditionalData["state"].(string))
+	}
+
+	assert.Equal(t, []string{events.STATUSPROVISIONING, events.STATUSFAILED}, states)
+}
@@ -0,0 +1,57 @@
+package srv
+
+import (
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("go.infratographer.com/loadbalanceroperator/internal/srv")
+
+// headerCarrier adapts NATS message headers so trace context can be
+// extracted from and injected into them
+type headerCarrier nats.Header
+
+// Get returns the first value for a key. NATS headers are case-sensitive so
+// a case-insensitive match is used when the exact key is not present.
+func (c headerCarrier) Get(key string) string {
+	if v := nats.Header(c).Get(key); v != "" {
+		return v
+	}
+
+	for k, v := range c {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+
+	return ""
+}
+
+// Set sets the value for a key
+func (c headerCarrier) Set(key string, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+// Keys lists the keys present in the headers
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// recordSpanError marks a span as failed when an error occurred
+func recordSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,108 @@
+package srv
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestHeaderCarrier(t *testing.T) {
+	type testCase struct {
+		name     string
+		header   nats.Header
+		key      string
+		expected string
+	}
+
+	testCases := []testCase{
+		{
+			name:     "exact key",
+			header:   nats.Header{"traceparent": []string{"00-abc-def-01"}},
+			key:      "traceparent",
+			expected: "00-abc-def-01",
+		},
+		{
+			name:     "canonical key",
+			header:   nats.Header{"Traceparent": []string{"00-abc-def-01"}},
+			key:      "traceparent",
+			expected: "00-abc-def-01",
+		},
+		{
+			name:     "missing key",
+			header:   nats.Header{},
+			key:      "traceparent",
+			expected: "",
+		},
+		{
+			name:     "nil header",
+			header:   nil,
+			key:      "traceparent",
+			expected: "",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, headerCarrier(tcase.header).Get(tcase.key))
+		})
+	}
+}
+
+var (
+	recorder     = tracetest.NewSpanRecorder()
+	recorderOnce sync.Once
+)
+
+// useSpanRecorder installs a global tracer provider that records spans. The
+// package tracer only binds to the first global provider that is installed,
+// so the same recorder is shared by every test.
+func useSpanRecorder() *sdktrace.TracerProvider {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	recorderOnce.Do(func() {
+		otel.SetTracerProvider(tp)
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+
+	return tp
+}
+
+func TestMessageHandlerTracePropagation(t *testing.T) {
+	tp := useSpanRecorder()
+
+	parentCtx, parent := tp.Tracer("test").Start(context.Background(), "publish")
+	parent.End()
+
+	m := nats.NewMsg("lbo.events")
+	m.Data = []byte("not json")
+	otel.GetTextMapPropagator().Inject(parentCtx, headerCarrier(m.Header))
+
+	srv := Server{
+		Context: context.TODO(),
+		Logger:  zap.NewNop().Sugar(),
+	}
+
+	srv.MessageHandler(m)
+
+	var handlerSpan sdktrace.ReadOnlySpan
+
+	for _, span := range recorder.Ended() {
+		if span.Name() == "MessageHandler" && span.SpanContext().TraceID() == parent.SpanContext().TraceID() {
+			handlerSpan = span
+		}
+	}
+
+	if assert.NotNil(t, handlerSpan) {
+		assert.Equal(t, parent.SpanContext().TraceID(), handlerSpan.SpanContext().TraceID())
+		assert.Equal(t, parent.SpanContext().SpanID(), handlerSpan.Parent().SpanID())
+		assert.NotEmpty(t, handlerSpan.Events(), "expected the processing error to be recorded")
+	}
+}
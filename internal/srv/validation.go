@@ -0,0 +1,94 @@
+package srv
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+// ValidationError describes a field of the loadbalancer data of an event
+// that is missing or invalid. Events failing validation are never retried.
+type ValidationError struct {
+	// Field is the event field that failed validation, such as resources.cpu
+	Field string
+	// Value is the value received for the field
+	Value string
+	// Err is one of the validation errors such as ErrInvalidQuantity
+	Err error
+}
+
+// Error returns the field, value and reason of a validation failure
+func (e *ValidationError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid loadbalancer data: %s: %s", e.Field, e.Err)
+	}
+
+	return fmt.Sprintf("invalid loadbalancer data: %s %q: %s", e.Field, e.Value, e.Err)
+}
+
+// Unwrap returns the reason a field failed validation
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// QuantityBounds are the smallest and largest quantity of a resource a
+// loadbalancer may request, either being unbounded when nil
+type QuantityBounds struct {
+	Min *resource.Quantity
+	Max *resource.Quantity
+}
+
+// validateLoadBalancerRef checks the loadbalancer data needed to find an
+// existing loadbalancer
+func validateLoadBalancerRef(lbdata *events.LoadBalancerData) error {
+	if lbdata.LoadBalancerID == uuid.Nil {
+		return &ValidationError{Field: "load_balancer_id", Err: ErrLoadBalancerIDRequired}
+	}
+
+	return nil
+}
+
+// validateLBData checks the loadbalancer data needed to deploy a
+// loadbalancer. The CPU and memory are always required and must fall within
+// the bounds that are configured.
+func (s *Server) validateLBData(lbdata *events.LoadBalancerData) error {
+	if err := validateLoadBalancerRef(lbdata); err != nil {
+		return err
+	}
+
+	if lbdata.LocationID == uuid.Nil {
+		return &ValidationError{Field: "location_id", Err: ErrLocationIDRequired}
+	}
+
+	if err := validateQuantity("resources.cpu", lbdata.Resources.CPU, s.CPUBounds); err != nil {
+		return err
+	}
+
+	return validateQuantity("resources.memory", lbdata.Resources.Memory, s.MemoryBounds)
+}
+
+// validateQuantity checks that value is a positive quantity within bounds
+func validateQuantity(field string, value string, bounds QuantityBounds) error {
+	if value == "" {
+		return &ValidationError{Field: field, Err: ErrResourceRequired}
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return &ValidationError{Field: field, Value: value, Err: fmt.Errorf("%w: %s", ErrInvalidQuantity, err)}
+	}
+
+	switch {
+	case quantity.Sign() <= 0:
+		return &ValidationError{Field: field, Value: value, Err: fmt.Errorf("%w: must be greater than 0", ErrQuantityOutOfBounds)}
+	case bounds.Min != nil && quantity.Cmp(*bounds.Min) < 0:
+		return &ValidationError{Field: field, Value: value, Err: fmt.Errorf("%w: must be at least %s", ErrQuantityOutOfBounds, bounds.Min)}
+	case bounds.Max != nil && quantity.Cmp(*bounds.Max) > 0:
+		return &ValidationError{Field: field, Value: value, Err: fmt.Errorf("%w: must be at most %s", ErrQuantityOutOfBounds, bounds.Max)}
+	}
+
+	return nil
+}
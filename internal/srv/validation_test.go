@@ -0,0 +1,190 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	events "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+func TestValidateLBData(t *testing.T) {
+	minCPU := resource.MustParse("100m")
+	maxCPU := resource.MustParse("2")
+	maxMemory := resource.MustParse("1Gi")
+
+	type testCase struct {
+		name        string
+		lbdata      events.LoadBalancerData
+		resources   bool
+		unbounded   bool
+		expectField string
+		expectError error
+	}
+
+	valid := events.LoadBalancerData{
+		LoadBalancerID: uuid.New(),
+		LocationID:     uuid.New(),
+		Resources:      events.LoadBalancerResources{CPU: "500m", Memory: "512Mi"},
+	}
+
+	withResources := func(cpu, memory string) events.LoadBalancerData {
+		lbdata := valid
+		lbdata.Resources = events.LoadBalancerResources{CPU: cpu, Memory: memory}
+
+		return lbdata
+	}
+
+	testCases := []testCase{
+		{
+			name:      "valid",
+			lbdata:    valid,
+			resources: true,
+		},
+		{
+			name:      "resources not bounded",
+			lbdata:    withResources("64", "256Gi"),
+			unbounded: true,
+		},
+		{
+			name:        "missing loadbalancer id",
+			lbdata:      events.LoadBalancerData{LocationID: uuid.New()},
+			expectField: "load_balancer_id",
+			expectError: ErrLoadBalancerIDRequired,
+		},
+		{
+			name:        "missing location id",
+			lbdata:      events.LoadBalancerData{LoadBalancerID: uuid.New()},
+			expectField: "location_id",
+			expectError: ErrLocationIDRequired,
+		},
+		{
+			name:        "missing required cpu",
+			lbdata:      withResources("", "512Mi"),
+			resources:   true,
+			expectField: "resources.cpu",
+			expectError: ErrResourceRequired,
+		},
+		{
+			name:        "missing required memory",
+			lbdata:      withResources("500m", ""),
+			resources:   true,
+			expectField: "resources.memory",
+			expectError: ErrResourceRequired,
+		},
+		{
+			name:        "cpu required without chart values",
+			lbdata:      withResources("", "512Mi"),
+			expectField: "resources.cpu",
+			expectError: ErrResourceRequired,
+		},
+		{
+			name:        "memory required without bounds",
+			lbdata:      withResources("500m", ""),
+			unbounded:   true,
+			expectField: "resources.memory",
+			expectError: ErrResourceRequired,
+		},
+		{
+			name:        "invalid cpu without bounds",
+			lbdata:      withResources("half a core", "512Mi"),
+			unbounded:   true,
+			expectField: "resources.cpu",
+			expectError: ErrInvalidQuantity,
+		},
+		{
+			name:        "invalid cpu",
+			lbdata:      withResources("half a core", "512Mi"),
+			expectField: "resources.cpu",
+			expectError: ErrInvalidQuantity,
+		},
+		{
+			name:        "invalid memory",
+			lbdata:      withResources("500m", "512MB of ram"),
+			expectField: "resources.memory",
+			expectError: ErrInvalidQuantity,
+		},
+		{
+			name:        "zero cpu",
+			lbdata:      withResources("0", "512Mi"),
+			expectField: "resources.cpu",
+			expectError: ErrQuantityOutOfBounds,
+		},
+		{
+			name:        "cpu below minimum",
+			lbdata:      withResources("50m", "512Mi"),
+			expectField: "resources.cpu",
+			expectError: ErrQuantityOutOfBounds,
+		},
+		{
+			name:        "cpu above maximum",
+			lbdata:      withResources("2500m", "512Mi"),
+			expectField: "resources.cpu",
+			expectError: ErrQuantityOutOfBounds,
+		},
+		{
+			name:        "memory above maximum",
+			lbdata:      withResources("500m", "2Gi"),
+			expectField: "resources.memory",
+			expectError: ErrQuantityOutOfBounds,
+		},
+		{
+			name:   "bounds are inclusive",
+			lbdata: withResources("2", "1024Mi"),
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			if tcase.resources {
+				viper.Set("helm-cpu-flag", []string{"resources.limits.cpu"})
+				viper.Set("helm-memory-flag", []string{"resources.limits.memory"})
+
+				defer viper.Reset()
+			}
+
+			srv := &Server{
+				CPUBounds:    QuantityBounds{Min: &minCPU, Max: &maxCPU},
+				MemoryBounds: QuantityBounds{Max: &maxMemory},
+			}
+
+			if tcase.unbounded {
+				srv = &Server{}
+			}
+
+			err := srv.validateLBData(&tcase.lbdata)
+
+			if tcase.expectError == nil {
+				assert.Nil(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, tcase.expectError)
+			assert.True(t, isPermanentError(err))
+
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, tcase.expectField, validationErr.Field)
+			}
+		})
+	}
+}
+
+func TestValidateLoadBalancerRef(t *testing.T) {
+	err := validateLoadBalancerRef(&events.LoadBalancerData{})
+	assert.ErrorIs(t, err, ErrLoadBalancerIDRequired)
+	assert.EqualError(t, err, "invalid loadbalancer data: load_balancer_id: load balancer id is required")
+
+	// deleting a loadbalancer only needs its ID
+	assert.Nil(t, validateLoadBalancerRef(&events.LoadBalancerData{LoadBalancerID: uuid.New()}))
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	max := resource.MustParse("2")
+
+	err := validateQuantity("resources.cpu", "4", QuantityBounds{Max: &max})
+	assert.EqualError(t, err, `invalid loadbalancer data: resources.cpu "4": resource quantity out of bounds: must be at most 2`)
+}
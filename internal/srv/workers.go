@@ -0,0 +1,117 @@
+package srv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const defaultWorkers = 4
+
+// workerPool runs jobs with bounded concurrency. Jobs that share a key run
+// one at a time in the order they were submitted, while jobs for different
+// keys run in parallel up to the size of the pool.
+type workerPool struct {
+	sem chan struct{}
+
+	mu      sync.Mutex
+	pending map[string][]func()
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = defaultWorkers
+	}
+
+	return &workerPool{
+		sem:     make(chan struct{}, size),
+		pending: map[string][]func(){},
+	}
+}
+
+// submit queues a job behind any other jobs with the same key
+func (p *workerPool) submit(key string, job func()) {
+	p.mu.Lock()
+
+	if queue, running := p.pending[key]; running {
+		p.pending[key] = append(queue, job)
+		p.mu.Unlock()
+
+		return
+	}
+
+	p.pending[key] = nil
+	p.mu.Unlock()
+
+	go p.run(key, job)
+}
+
+// run executes the job and then every job queued behind it for the same key
+func (p *workerPool) run(key string, job func()) {
+	for {
+		p.sem <- struct{}{}
+		job()
+		<-p.sem
+
+		p.mu.Lock()
+
+		queue := p.pending[key]
+		if len(queue) == 0 {
+			delete(p.pending, key)
+			p.mu.Unlock()
+
+			return
+		}
+
+		job = queue[0]
+		p.pending[key] = queue[1:]
+		p.mu.Unlock()
+	}
+}
+
+// messageKey returns the key used to serialize processing of a message. The
+// loadbalancer id is used when present so that every event for a
+// loadbalancer is processed in order, falling back to the message subject.
+// Ids are keyed in their canonical form, as drift checks and LoadBalancer
+// resource syncs are, so that all work for a loadbalancer shares one key.
+func (s *Server) messageKey(m *nats.Msg) string {
+	msg, err := s.decodeMessage(m)
+	if err == nil {
+		if id, ok := msg.AdditionalData["load_balancer_id"].(string); ok && id != "" {
+			if lbID, err := uuid.Parse(id); err == nil {
+				return lbID.String()
+			}
+
+			return id
+		}
+	}
+
+	return m.Subject
+}
+
+// keepInProgress periodically marks a message as in progress until the
+// returned function is called. This keeps messages from being redelivered
+// while they wait on a busy worker or a slow helm operation.
+func (s *Server) keepInProgress(m *nats.Msg) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(s.inProgressInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := m.InProgress(); err != nil {
+					s.Logger.Debugw("unable to mark message in progress", "subject", m.Subject, "error", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,169 @@
+package srv
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolSerializesKeys(t *testing.T) {
+	pool := newWorkerPool(4)
+
+	var (
+		mu      sync.Mutex
+		order   []int
+		running int32
+		overlap bool
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 10; i++ {
+		i := i
+
+		wg.Add(1)
+		pool.submit("lb", func() {
+			defer wg.Done()
+
+			if atomic.AddInt32(&running, 1) > 1 {
+				overlap = true
+			}
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	wg.Wait()
+
+	assert.False(t, overlap, "jobs for the same key must not run concurrently")
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order)
+}
+
+func TestWorkerPoolParallelKeys(t *testing.T) {
+	pool := newWorkerPool(2)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for _, key := range []string{"lb-a", "lb-b"} {
+		wg.Add(1)
+		pool.submit(key, func() {
+			defer wg.Done()
+
+			started <- struct{}{}
+			<-release
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("jobs for different keys did not run in parallel")
+		}
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestWorkerPoolBounded(t *testing.T) {
+	pool := newWorkerPool(2)
+
+	var (
+		running int32
+		maxSeen int32
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		pool.submit(uuid.NewString(), func() {
+			defer wg.Done()
+
+			current := atomic.AddInt32(&running, 1)
+
+			for {
+				seen := atomic.LoadInt32(&maxSeen)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxSeen, seen, current) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxSeen), int32(2))
+	assert.Eventually(t, func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		return len(pool.pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMessageKey(t *testing.T) {
+	type testCase struct {
+		name     string
+		data     string
+		expected string
+	}
+
+	lbID := uuid.NewString()
+
+	testCases := []testCase{
+		{
+			name:     "loadbalancer id",
+			data:     `{"event_type":"create","additional_data":{"load_balancer_id":"` + lbID + `"}}`,
+			expected: lbID,
+		},
+		{
+			name:     "non-canonical loadbalancer id",
+			data:     `{"event_type":"create","additional_data":{"load_balancer_id":"{` + strings.ToUpper(lbID) + `}"}}`,
+			expected: lbID,
+		},
+		{
+			name:     "unparseable loadbalancer id",
+			data:     `{"event_type":"create","additional_data":{"load_balancer_id":"lb-1"}}`,
+			expected: "lb-1",
+		},
+		{
+			name:     "missing loadbalancer id",
+			data:     `{"event_type":"create","additional_data":{}}`,
+			expected: "lbo.events",
+		},
+		{
+			name:     "cloudevent",
+			data:     `{"specversion":"1.0","id":"1","source":"loadbalancerapi","type":"create","data":{"load_balancer_id":"` + lbID + `"}}`,
+			expected: lbID,
+		},
+		{
+			name:     "invalid message",
+			data:     "not json",
+			expected: "lbo.events",
+		},
+	}
+
+	for _, tcase := range testCases {
+		t.Run(tcase.name, func(t *testing.T) {
+			assert.Equal(t, tcase.expected, (&Server{}).messageKey(&nats.Msg{Subject: "lbo.events", Data: []byte(tcase.data)}))
+		})
+	}
+}
@@ -2,13 +2,24 @@
 package utils
 
 import (
+	"errors"
+	"io"
 	"os"
+	"time"
 
+	"github.com/nats-io/nats-server/v2/server"
+	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
 	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
 )
 
+// ErrNATSServerStartup is returned when the test NATS server does not become ready
+var ErrNATSServerStartup = errors.New("nats server failed to start")
+
 // CreateTestChart creates a dummy chart for testing purposes
 func CreateTestChart(outputDir string) (string, error) {
 	mockreleaseoptions := release.MockReleaseOptions{}
@@ -37,3 +48,41 @@ func CreateTestValues(outputDir string, yamlString string) (string, error) {
 
 	return outputDir + "/values.yaml", err
 }
+
+// StartNATSServer starts an in-process NATS server with jetstream enabled,
+// storing its data in the provided directory
+func StartNATSServer(storeDir string) (*server.Server, error) {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  storeDir,
+	}
+
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(10 * time.Second) {
+		srv.Shutdown()
+		return nil, ErrNATSServerStartup
+	}
+
+	return srv, nil
+}
+
+// NewTestHelmConfig creates a helm configuration that stores releases in
+// memory and does not talk to a kubernetes cluster
+func NewTestHelmConfig() *action.Configuration {
+	return &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: io.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(format string, v ...interface{}) {},
+	}
+}
@@ -0,0 +1,67 @@
+// Package v1alpha1 contains the LoadBalancer custom resource that records
+// the desired state of each deployed load balancer
+package v1alpha1
+
+import (
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// Finalizer is added to LoadBalancer resources so their helm release is
+	// uninstalled before the resource is removed
+	Finalizer = GroupName + "/release"
+
+	// ConditionReady reports whether the helm release for a LoadBalancer has
+	// been deployed with its current spec
+	ConditionReady = "Ready"
+
+	// ReasonDeployed is the Ready condition reason once the release is deployed
+	ReasonDeployed = "Deployed"
+	// ReasonDeployFailed is the Ready condition reason when deploying the
+	// release failed
+	ReasonDeployFailed = "DeployFailed"
+)
+
+// LoadBalancer is the desired state of a load balancer deployed by the operator
+type LoadBalancer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LoadBalancerSpec   `json:"spec"`
+	Status LoadBalancerStatus `json:"status,omitempty"`
+}
+
+// LoadBalancerSpec mirrors the load balancer data received in events
+type LoadBalancerSpec struct {
+	LoadBalancerID uuid.UUID             `json:"loadBalancerID"`
+	LocationID     uuid.UUID             `json:"locationID"`
+	Resources      LoadBalancerResources `json:"resources"`
+	QueryURL       string                `json:"queryURL,omitempty"`
+	// Values are the chart values mapped from the event data, keyed by their
+	// dotted chart values key
+	Values *runtime.RawExtension `json:"values,omitempty"`
+}
+
+// LoadBalancerResources are the resources requested for a load balancer
+type LoadBalancerResources struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// LoadBalancerStatus is the observed state of a load balancer
+type LoadBalancerStatus struct {
+	// ObservedGeneration is the generation of the spec last deployed
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	ReleaseName        string             `json:"releaseName,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// LoadBalancerList is a list of LoadBalancer resources
+type LoadBalancerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LoadBalancer `json:"items"`
+}
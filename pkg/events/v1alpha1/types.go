@@ -4,11 +4,43 @@ package events
 
 import "github.com/google/uuid"
 
+// SchemaVersion is the schema_version of events using this schema. Events
+// without a schema_version are treated as using it.
+const SchemaVersion = "v1alpha1"
+
 const (
 	// EVENTCREATE is the event type to handle creation events
 	EVENTCREATE = "create"
 	// EVENTUPDATE is the event type to handle update events
 	EVENTUPDATE = "update"
+	// EVENTDELETE is the event type to handle deletion events
+	EVENTDELETE = "delete"
+	// EVENTSTATUS is the event type published when the state of a load balancer changes
+	EVENTSTATUS = "status"
+)
+
+const (
+	// STATUSPROVISIONING is reported while a load balancer is being deployed
+	STATUSPROVISIONING = "provisioning"
+	// STATUSREADY is reported once a load balancer has been deployed
+	STATUSREADY = "ready"
+	// STATUSFAILED is reported when an operation on a load balancer has failed
+	STATUSFAILED = "failed"
+	// STATUSDELETED is reported once a load balancer has been removed
+	STATUSDELETED = "deleted"
+)
+
+const (
+	// DeadLetterSubjectHeader holds the subject an event was originally received on
+	DeadLetterSubjectHeader = "Lbo-Dead-Letter-Subject"
+	// DeadLetterErrorHeader holds the error that caused an event to be dead-lettered
+	DeadLetterErrorHeader = "Lbo-Dead-Letter-Error"
+	// DeadLetterHandlerHeader holds the handler that failed to process an event
+	DeadLetterHandlerHeader = "Lbo-Dead-Letter-Handler"
+	// DeadLetterAttemptsHeader holds the number of delivery attempts made for an event
+	DeadLetterAttemptsHeader = "Lbo-Dead-Letter-Attempts"
+	// DeadLetterTimestampHeader holds the time, in RFC 3339 format, an event was dead-lettered
+	DeadLetterTimestampHeader = "Lbo-Dead-Letter-Timestamp"
 )
 
 type LoadBalancerResources struct {
@@ -17,8 +49,19 @@ type LoadBalancerResources struct {
 }
 
 type LoadBalancerData struct {
+	SchemaVersion  string                `json:"schema_version,omitempty"`
 	LoadBalancerID uuid.UUID             `json:"load_balancer_id"`
 	LocationID     uuid.UUID             `json:"location_id"`
 	Resources      LoadBalancerResources `json:"resources"`
 	QueryURL       string                `json:"query_url"`
 }
+
+// LoadBalancerStatus is published by the operator to report the state of a
+// deployed load balancer
+type LoadBalancerStatus struct {
+	LoadBalancerID uuid.UUID `json:"load_balancer_id"`
+	State          string    `json:"state"`
+	ReleaseName    string    `json:"release_name"`
+	Namespace      string    `json:"namespace"`
+	Error          string    `json:"error,omitempty"`
+}
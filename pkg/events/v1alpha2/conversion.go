@@ -0,0 +1,36 @@
+package events
+
+import (
+	v1alpha1 "go.infratographer.com/loadbalanceroperator/pkg/events/v1alpha1"
+)
+
+// ConvertFromV1alpha1 returns the v1alpha2 equivalent of v1alpha1 load
+// balancer data
+func ConvertFromV1alpha1(in *v1alpha1.LoadBalancerData) LoadBalancerData {
+	return LoadBalancerData{
+		SchemaVersion:  SchemaVersion,
+		LoadBalancerID: in.LoadBalancerID,
+		LocationID:     in.LocationID,
+		Resources: LoadBalancerResources{
+			CPU:    in.Resources.CPU,
+			Memory: in.Resources.Memory,
+		},
+		QueryURL: in.QueryURL,
+	}
+}
+
+// ConvertToV1alpha1 returns the v1alpha1 load balancer data held in d. The
+// labels, ports, listeners and backend pools have no v1alpha1 equivalent
+// and are dropped.
+func (d *LoadBalancerData) ConvertToV1alpha1() v1alpha1.LoadBalancerData {
+	return v1alpha1.LoadBalancerData{
+		SchemaVersion:  v1alpha1.SchemaVersion,
+		LoadBalancerID: d.LoadBalancerID,
+		LocationID:     d.LocationID,
+		Resources: v1alpha1.LoadBalancerResources{
+			CPU:    d.Resources.CPU,
+			Memory: d.Resources.Memory,
+		},
+		QueryURL: d.QueryURL,
+	}
+}
@@ -0,0 +1,72 @@
+// Package events contains the v1alpha2 schema of the load balancer data
+// carried by events, which describes how a load balancer routes traffic in
+// addition to the resources it is deployed with
+package events
+
+import "github.com/google/uuid"
+
+// SchemaVersion is the schema_version of events using this schema
+const SchemaVersion = "v1alpha2"
+
+type LoadBalancerResources struct {
+	CPU    string `json:"cpu"`
+	Memory string `json:"memory"`
+}
+
+type LoadBalancerData struct {
+	SchemaVersion  string                `json:"schema_version"`
+	LoadBalancerID uuid.UUID             `json:"load_balancer_id"`
+	LocationID     uuid.UUID             `json:"location_id"`
+	Resources      LoadBalancerResources `json:"resources"`
+	QueryURL       string                `json:"query_url,omitempty"`
+	Labels         map[string]string     `json:"labels,omitempty"`
+	Ports          []Port                `json:"ports,omitempty"`
+	Listeners      []Listener            `json:"listeners,omitempty"`
+	BackendPools   []BackendPool         `json:"backend_pools,omitempty"`
+}
+
+// Port is a port the load balancer accepts traffic on
+type Port struct {
+	Name     string `json:"name"`
+	Number   int32  `json:"number"`
+	Protocol string `json:"protocol"`
+}
+
+// Listener routes the traffic received on a port to a backend pool
+type Listener struct {
+	Name        string `json:"name"`
+	Port        string `json:"port"`
+	BackendPool string `json:"backend_pool"`
+	TLS         *TLS   `json:"tls,omitempty"`
+}
+
+// TLS terminates TLS on a listener
+type TLS struct {
+	CertificateSecret string `json:"certificate_secret"`
+	MinVersion        string `json:"min_version,omitempty"`
+}
+
+// BackendPool is a set of backends traffic is balanced across
+type BackendPool struct {
+	Name        string       `json:"name"`
+	Backends    []Backend    `json:"backends"`
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// Backend is a destination traffic is sent to
+type Backend struct {
+	Address string `json:"address"`
+	Port    int32  `json:"port"`
+	Weight  int32  `json:"weight,omitempty"`
+}
+
+// HealthCheck decides which backends of a pool receive traffic
+type HealthCheck struct {
+	Protocol           string `json:"protocol"`
+	Port               int32  `json:"port,omitempty"`
+	Path               string `json:"path,omitempty"`
+	Interval           string `json:"interval,omitempty"`
+	Timeout            string `json:"timeout,omitempty"`
+	HealthyThreshold   int32  `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int32  `json:"unhealthy_threshold,omitempty"`
+}